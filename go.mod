@@ -8,11 +8,13 @@ require (
 	github.com/golang-migrate/migrate/v4 v4.18.1
 	github.com/google/uuid v1.6.0
 	github.com/labstack/echo/v4 v4.12.0
+	github.com/moby/patternmatcher v0.6.0
 	github.com/olahol/melody v1.2.1
 	github.com/uptrace/bun v1.2.5
 	github.com/uptrace/bun/dialect/sqlitedialect v1.2.5
 	github.com/uptrace/bun/driver/sqliteshim v1.2.5
 	github.com/uptrace/bun/extra/bundebug v1.2.5
+	golang.org/x/crypto v0.28.0
 	modernc.org/sqlite v1.33.1
 )
 
@@ -56,7 +58,6 @@ require (
 	go.opentelemetry.io/otel/sdk v1.31.0 // indirect
 	go.opentelemetry.io/otel/trace v1.31.0 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
@@ -0,0 +1,146 @@
+package listeningports
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tcpStateListen is the state of listening sockets in /proc/net/tcp, see include/net/tcp_states.h of linux.
+const tcpStateListen = "0A"
+
+// Port is a tcp port that processes in a workspace listen on.
+type Port struct {
+	Port int `json:"port"`
+
+	// Addresses are the local addresses that the port is bound to, e.g. "0.0.0.0" or "::1".
+	Addresses []string `json:"addresses"`
+
+	// LoopbackOnly is whether the port is only bound to loopback addresses,
+	// in which case it only accepts connections from inside the workspace and cannot be forwarded.
+	LoopbackOnly bool `json:"loopbackOnly"`
+}
+
+// Parse reads the listening ports in the given content of /proc/net/tcp or /proc/net/tcp6, or both concatenated.
+// The returned ports are sorted by port. Lines that cannot be parsed are skipped.
+func Parse(r io.Reader) ([]Port, error) {
+	byPort := make(map[int]*Port)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g. "0: 00000000:0BB8 00000000:0000 0A ...", where the second field is the local address
+		// and the fourth is the state. The header line does not have a valid address, so it is skipped too.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpStateListen {
+			continue
+		}
+
+		ip, port, ok := parseAddress(fields[1])
+		if !ok {
+			continue
+		}
+
+		p, ok := byPort[port]
+		if !ok {
+			p = &Port{Port: port, LoopbackOnly: true}
+			byPort[port] = p
+		}
+		if addr := ip.String(); !slices.Contains(p.Addresses, addr) {
+			p.Addresses = append(p.Addresses, addr)
+		}
+		if !ip.IsLoopback() {
+			p.LoopbackOnly = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	ports := make([]Port, 0, len(byPort))
+	for _, p := range byPort {
+		ports = append(ports, *p)
+	}
+	slices.SortFunc(ports, func(a, b Port) int {
+		return a.Port - b.Port
+	})
+
+	return ports, nil
+}
+
+// parseAddress parses an address in /proc/net/tcp, e.g. "0100007F:1F90" for 127.0.0.1:8080.
+// The IP is written as 32-bit words in host byte order, which is little endian on the platforms docker runs on.
+func parseAddress(s string) (net.IP, int, bool) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, false
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(b); i += 4 {
+		slices.Reverse(b[i : i+4])
+	}
+
+	return net.IP(b), int(port), true
+}
+
+// Registry keeps the ports that were last detected in each workspace.
+type Registry struct {
+	mu    sync.Mutex
+	ports map[string][]Port
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ports: make(map[string][]Port),
+	}
+}
+
+// Ports returns the ports that were last detected in the given workspace,
+// and false if ports have not been detected in it since it was started.
+func (r *Registry) Ports(workspaceName string) ([]Port, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ports, ok := r.ports[workspaceName]
+	return ports, ok
+}
+
+// Set records the ports detected in the given workspace, and returns the ones that were not listening
+// when ports were last detected in it, including ports that were only bound to loopback addresses before.
+func (r *Registry) Set(workspaceName string, ports []Port) []Port {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.ports[workspaceName]
+	r.ports[workspaceName] = ports
+
+	var added []Port
+	for _, p := range ports {
+		wasListening := slices.ContainsFunc(previous, func(other Port) bool {
+			return other.Port == p.Port && (p.LoopbackOnly || !other.LoopbackOnly)
+		})
+		if !wasListening {
+			added = append(added, p)
+		}
+	}
+	return added
+}
+
+// Remove forgets the ports of the given workspace, e.g. once it is stopped.
+func (r *Registry) Remove(workspaceName string) {
+	r.mu.Lock()
+	delete(r.ports, workspaceName)
+	r.mu.Unlock()
+}
@@ -0,0 +1,86 @@
+package listeningports
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+const tcp6Header = "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Port
+	}{
+		{
+			name:  "empty",
+			input: tcpHeader,
+			want:  []Port{},
+		},
+		{
+			name: "tcp",
+			input: tcpHeader +
+				"   0: 00000000:07E8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 662 1 000000008c1ba534 100 0 0 10 0\n" +
+				"   1: 0100007F:BC8F 00000000:0000 0A 00000000:00000000 00:00000000 00000000 65534        0 913 1 0000000006aceb26 100 0 0 10 0\n" +
+				// an established connection from port 2024, which is not listening on its own.
+				"   2: 020011AC:07E8 010011AC:D6A4 01 00000000:00000000 02:000A7C2E 00000000     0        0 1024 2 00000000b5e2a1f0 20 4 30 10 -1\n",
+			want: []Port{
+				{Port: 2024, Addresses: []string{"0.0.0.0"}},
+				{Port: 48271, Addresses: []string{"127.0.0.1"}, LoopbackOnly: true},
+			},
+		},
+		{
+			name: "tcp6",
+			input: tcp6Header +
+				"   0: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20541 1 0000000017d2e3c4 100 0 0 10 0\n" +
+				"   1: 00000000000000000000000001000000:1538 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000   999        0 20602 1 00000000e1b0d5f7 100 0 0 10 0\n" +
+				"   2: 0000000000000000FFFF00000100007F:0CEA 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20733 1 000000004c9a6b02 100 0 0 10 0\n",
+			want: []Port{
+				{Port: 3306, Addresses: []string{"127.0.0.1"}, LoopbackOnly: true},
+				{Port: 5432, Addresses: []string{"::1"}, LoopbackOnly: true},
+				{Port: 8080, Addresses: []string{"::"}},
+			},
+		},
+		{
+			name: "tcp and tcp6 concatenated",
+			input: tcpHeader +
+				"   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20540 1 00000000a3f1c2d5 100 0 0 10 0\n" +
+				"   1: 0100007F:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20811 1 000000005e7d9a1c 100 0 0 10 0\n" +
+				tcp6Header +
+				"   0: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20541 1 0000000017d2e3c4 100 0 0 10 0\n" +
+				"   1: 00000000000000000000000001000000:0BB8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 20812 1 00000000c8b4e6f3 100 0 0 10 0\n",
+			want: []Port{
+				{Port: 3000, Addresses: []string{"127.0.0.1", "::1"}, LoopbackOnly: true},
+				{Port: 8080, Addresses: []string{"0.0.0.0", "::"}},
+			},
+		},
+		{
+			name: "malformed lines",
+			input: tcpHeader +
+				"   0: 00000000 00000000:0000 0A\n" +
+				"   1: 0000:1F90 00000000:0000 0A\n" +
+				"   2: 00000000:XYZ0 00000000:0000 0A\n" +
+				"   3: 00000000:1F90\n" +
+				"   4: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 100 1 0000000000000000 100 0 0 10 0\n",
+			want: []Port{
+				{Port: 80, Addresses: []string{"0.0.0.0"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
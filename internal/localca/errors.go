@@ -0,0 +1,9 @@
+package localca
+
+import "errors"
+
+var errNotCA = errors.New("the certificate of the CA is not a CA certificate")
+
+var errUnsupportedKey = errors.New("the private key of the CA cannot sign certificates")
+
+var errUnknownServerName = errors.New("server name is not the host name of tesseract or a subdomain that is routed to a workspace")
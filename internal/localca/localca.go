@@ -0,0 +1,352 @@
+package localca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certFileName and keyFileName are the names of the certificate and the private key of the CA in its directory.
+const (
+	certFileName = "ca.crt"
+	keyFileName  = "ca.key"
+)
+
+// caValidity is how long the generated CA certificate is valid for.
+// Browsers have to trust the CA again once it expires, so it is valid for long.
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// leafValidity is how long issued certificates are valid for.
+// Browsers reject certificates that are valid for more than 398 days.
+const leafValidity = 90 * 24 * time.Hour
+
+// leafRenewBefore is how long before they expire issued certificates are replaced.
+const leafRenewBefore = 30 * 24 * time.Hour
+
+// maxLeaves is how many issued certificates are kept. Certificates are only issued for routed subdomains,
+// but subdomains can be routed and removed again any number of times.
+const maxLeaves = 256
+
+// CA is a certificate authority that issues certificates for the host name of tesseract and the subdomains it routes,
+// so that they can be served over https once the certificate of the CA is trusted.
+// The CA certificate is name constrained to the host name, so the CA cannot issue certificates for other domains.
+type CA struct {
+	hostName string
+
+	// hostPolicy returns whether certificates can be issued for the given subdomain of hostName.
+	hostPolicy func(host string) bool
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+
+	// mu guards leaves
+	mu sync.Mutex
+
+	// leaves maps domains to the certificates issued for them, which are valid for the domain and *.domain.
+	leaves map[string]*tls.Certificate
+}
+
+// Load reads the CA stored in dir, which issues certificates for hostName and the subdomains that hostPolicy allows.
+// A CA is generated and saved in dir if dir does not contain one. If the CA in dir is not constrained to hostName,
+// e.g. because it was generated for another host name, an error is returned instead of replacing it,
+// since every machine that trusts it would have to trust the new one.
+func Load(dir string, hostName string, hostPolicy func(host string) bool) (*CA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	hostName = strings.ToLower(hostName)
+	certPath := filepath.Join(dir, certFileName)
+	keyPath := filepath.Join(dir, keyFileName)
+
+	_, err := os.Stat(certPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, err = generate(certPath, keyPath, hostName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, certPEM, key, err := load(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isConstrainedTo(cert, hostName) {
+		return nil, fmt.Errorf("the local CA in %v is not limited to %v; move or delete %v and %v to generate a new one, which has to be trusted again", dir, hostName, certPath, keyPath)
+	}
+
+	return &CA{
+		hostName:   hostName,
+		hostPolicy: hostPolicy,
+		cert:       cert,
+		certPEM:    certPEM,
+		key:        key,
+		leaves:     make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// load reads the CA certificate at certPath and its key at keyPath.
+// It returns the parsed certificate, the certificate in the PEM format, and the key.
+func load(certPath string, keyPath string) (*x509.Certificate, []byte, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !cert.IsCA {
+		return nil, nil, nil, errNotCA
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, errUnsupportedKey
+	}
+
+	return cert, certPEM, key, nil
+}
+
+// unusedDomain is the domain that the CA of an IP is constrained to, so that it cannot issue certificates for domains.
+// It is reserved by RFC 2606, so it never resolves.
+const unusedDomain = "invalid"
+
+// constrainTo limits the CA of the given template to issuing certificates for hostName and its subdomains,
+// or for hostName alone if it is an IP. Names of the other type are not allowed.
+func constrainTo(template *x509.Certificate, hostName string) {
+	template.PermittedDNSDomainsCritical = true
+	if ip := net.ParseIP(hostName); ip != nil {
+		template.PermittedIPRanges = []*net.IPNet{hostIPNet(ip)}
+		template.PermittedDNSDomains = []string{unusedDomain}
+	} else {
+		template.PermittedDNSDomains = []string{hostName}
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+}
+
+// isConstrainedTo returns whether the given CA certificate is constrained to hostName by constrainTo.
+func isConstrainedTo(cert *x509.Certificate, hostName string) bool {
+	if !cert.PermittedDNSDomainsCritical {
+		return false
+	}
+	if ip := net.ParseIP(hostName); ip != nil {
+		return len(cert.PermittedIPRanges) == 1 && cert.PermittedIPRanges[0].String() == hostIPNet(ip).String() &&
+			slices.Equal(cert.PermittedDNSDomains, []string{unusedDomain})
+	}
+	return len(cert.PermittedDNSDomains) == 1 && strings.EqualFold(cert.PermittedDNSDomains[0], hostName) &&
+		len(cert.PermittedIPRanges) == 0
+}
+
+// hostIPNet returns the network that only contains the given IP.
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// generate generates a self-signed CA certificate that is constrained to hostName and its key,
+// and saves them to certPath and keyPath. It returns the certificate in the PEM format.
+func generate(certPath string, keyPath string, hostName string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"tesseract"},
+			CommonName:   "tesseract local CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	constrainTo(template, hostName)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is written first, so that a certificate without a key is never left behind.
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, err
+	}
+
+	return certPEM, nil
+}
+
+// CertificatePEM returns the certificate of the CA in the PEM format, which browsers and operating systems need to trust.
+func (ca *CA) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// GetCertificate returns the certificate for the server name of the given hello, issuing it if needed.
+// It is meant to be used as tls.Config.GetCertificate.
+//
+// The host name gets a certificate valid for itself and *.hostName, which covers the subdomains of forwarded ports.
+// Deeper subdomains, e.g. a.web.hostName, get a certificate valid for *.web.hostName.
+// Certificates are only issued for subdomains that the host policy allows, or subdomains of them.
+// Clients that do not send a server name, e.g. because they connect to an IP, get the certificate of the host name.
+func (ca *CA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	var domain string
+	switch {
+	case name == "" || name == ca.hostName:
+		domain = ca.hostName
+	case strings.HasSuffix(name, "."+ca.hostName):
+		// the certificate of the parent domain is valid for name through its wildcard.
+		_, domain, _ = strings.Cut(name, ".")
+		if domain != ca.hostName && !ca.hostPolicy(name) && !ca.hostPolicy(domain) {
+			return nil, errUnknownServerName
+		}
+	default:
+		return nil, errUnknownServerName
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if cert, ok := ca.leaves[domain]; ok && time.Until(cert.Leaf.NotAfter) > leafRenewBefore {
+		return cert, nil
+	}
+
+	cert, err := ca.issue(domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca.leaves) >= maxLeaves {
+		ca.evictLeaf()
+	}
+	ca.leaves[domain] = cert
+
+	return cert, nil
+}
+
+// evictLeaf removes a certificate from the issued certificates to make room for another one.
+// Certificates that are due to be replaced are removed first. ca.mu must be held.
+func (ca *CA) evictLeaf() {
+	var evicted string
+	for domain, cert := range ca.leaves {
+		evicted = domain
+		if time.Until(cert.Leaf.NotAfter) <= leafRenewBefore {
+			break
+		}
+	}
+	delete(ca.leaves, evicted)
+}
+
+// issue issues a certificate valid for the given domain and all of its direct subdomains.
+// If the domain is an IP, the certificate is valid for the IP instead.
+func (ca *CA) issue(domain string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"tesseract"},
+			CommonName:   domain,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{domain, "*." + domain}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// ServeCertificate responds with the certificate of the CA, so that it can be downloaded and trusted.
+func (ca *CA) ServeCertificate(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="tesseract-ca.crt"`)
+	return c.Blob(http.StatusOK, "application/x-x509-ca-cert", ca.certPEM)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1 @@
+ALTER TABLE port_mappings ADD COLUMN wake_on_request BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE port_mappings ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
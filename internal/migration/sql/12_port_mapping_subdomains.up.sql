@@ -0,0 +1,11 @@
+-- an http port is routed by its subdomain, which is at least unique within its workspace in every subdomain scheme.
+-- the reverse proxy never routed duplicates, so only the first of them is kept.
+DELETE
+FROM port_mappings
+WHERE protocol = 'http'
+  AND rowid NOT IN (SELECT MIN(rowid)
+                    FROM port_mappings
+                    WHERE protocol = 'http'
+                    GROUP BY workspace_id, subdomain);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_port_mappings_subdomain ON port_mappings (workspace_id, subdomain) WHERE protocol = 'http';
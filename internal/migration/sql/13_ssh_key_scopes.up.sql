@@ -0,0 +1,5 @@
+-- keys only log in as the users and to the workspaces in their scope, which are JSON arrays of names or "*".
+-- existing keys were allowed everything, which is no longer the default, so they are given an empty scope.
+ALTER TABLE ssh_keys ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE ssh_keys ADD COLUMN users TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE ssh_keys ADD COLUMN workspaces TEXT NOT NULL DEFAULT '[]';
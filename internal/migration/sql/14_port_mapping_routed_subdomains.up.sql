@@ -0,0 +1,6 @@
+-- the subdomain of the host name that an http port is routed through depends on the subdomain scheme,
+-- and has to be unique across all workspaces. It is set for the configured scheme on startup,
+-- and is NULL for tcp and udp ports and for http ports that are not routed because of a conflict.
+ALTER TABLE port_mappings ADD COLUMN routed_subdomain TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_port_mappings_routed_subdomain ON port_mappings (routed_subdomain);
@@ -0,0 +1,7 @@
+-- share tokens are signed for the share secret of their port, which is replaced whenever the visibility of the port
+-- changes, so that share links that were revoked do not work again once the port is shared again,
+-- nor for another port that is added with the same subdomain later.
+ALTER TABLE port_mappings ADD COLUMN share_secret TEXT NOT NULL DEFAULT '';
+
+UPDATE port_mappings
+SET share_secret = lower(hex(randomblob(16)));
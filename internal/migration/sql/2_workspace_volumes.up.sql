@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS workspace_volumes
+(
+    name         TEXT NOT NULL UNIQUE,
+    workspace_id TEXT,
+    mount_path   TEXT NOT NULL,
+    created_at   TEXT NOT NULL,
+
+    CONSTRAINT pk_workspace_volumes PRIMARY KEY (name),
+    CONSTRAINT fk_workspace_workspace_volumes FOREIGN KEY (workspace_id) REFERENCES workspaces (id)
+        ON UPDATE CASCADE
+        ON DELETE SET NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE template_files
+    ADD COLUMN mode INTEGER NOT NULL DEFAULT 420;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS template_revisions
+(
+    id          TEXT NOT NULL UNIQUE,
+    template_id TEXT NOT NULL,
+    message     TEXT NOT NULL,
+    created_at  TEXT NOT NULL,
+
+    CONSTRAINT pk_template_revisions PRIMARY KEY (id),
+    CONSTRAINT fk_template_template_revisions FOREIGN KEY (template_id) REFERENCES templates (id)
+        ON UPDATE CASCADE
+        ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS template_revision_files
+(
+    revision_id TEXT    NOT NULL,
+    file_path   TEXT    NOT NULL,
+    content     BLOB    NOT NULL,
+    mode        INTEGER NOT NULL,
+
+    CONSTRAINT pk_template_revision_files PRIMARY KEY (revision_id, file_path),
+    CONSTRAINT fk_template_revision_template_revision_files FOREIGN KEY (revision_id) REFERENCES template_revisions (id)
+        ON UPDATE CASCADE
+        ON DELETE CASCADE
+);
+
+ALTER TABLE template_images
+    ADD COLUMN revision_id TEXT REFERENCES template_revisions (id) ON DELETE SET NULL;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS template_builds
+(
+    id          TEXT NOT NULL UNIQUE,
+    template_id TEXT NOT NULL,
+    revision_id TEXT,
+    image_tag   TEXT NOT NULL,
+    image_id    TEXT NOT NULL DEFAULT '',
+    build_args  TEXT,
+    started_at  TEXT NOT NULL,
+    finished_at TEXT,
+    status      TEXT NOT NULL,
+    log         TEXT NOT NULL DEFAULT '',
+
+    CONSTRAINT pk_template_builds PRIMARY KEY (id),
+    CONSTRAINT fk_template_template_builds FOREIGN KEY (template_id) REFERENCES templates (id)
+        ON UPDATE CASCADE
+        ON DELETE CASCADE,
+    CONSTRAINT fk_template_revision_template_builds FOREIGN KEY (revision_id) REFERENCES template_revisions (id)
+        ON UPDATE CASCADE
+        ON DELETE SET NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE template_builds ADD COLUMN queued_at TEXT NOT NULL DEFAULT '';
+
+UPDATE template_builds SET queued_at = started_at;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS ssh_keys
+(
+    id          TEXT NOT NULL UNIQUE,
+    name        TEXT NOT NULL,
+    public_key  TEXT NOT NULL,
+    fingerprint TEXT NOT NULL UNIQUE,
+    created_at  TEXT NOT NULL,
+
+    CONSTRAINT pk_ssh_keys PRIMARY KEY (id)
+);
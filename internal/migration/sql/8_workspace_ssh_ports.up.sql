@@ -0,0 +1,3 @@
+ALTER TABLE workspaces ADD COLUMN ssh_port INTEGER;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_workspaces_ssh_port ON workspaces (ssh_port);
@@ -0,0 +1,25 @@
+-- the protocol is part of the primary key, so that a port can be forwarded over both tcp and udp.
+-- sqlite cannot change the primary key of a table, so the table is recreated.
+CREATE TABLE IF NOT EXISTS port_mappings_new
+(
+    workspace_id   TEXT    NOT NULL,
+    container_port INTEGER NOT NULL,
+    protocol       TEXT    NOT NULL DEFAULT 'http',
+    subdomain      TEXT,
+    host_port      INTEGER,
+
+    CONSTRAINT pk_port_mappings PRIMARY KEY (workspace_id, container_port, protocol, subdomain),
+    CONSTRAINT fk_workspace_port_mappings FOREIGN KEY (workspace_id) REFERENCES workspaces (id)
+        ON UPDATE CASCADE
+        ON DELETE CASCADE
+);
+
+INSERT INTO port_mappings_new (workspace_id, container_port, protocol, subdomain)
+SELECT workspace_id, container_port, 'http', subdomain
+FROM port_mappings;
+
+DROP TABLE port_mappings;
+
+ALTER TABLE port_mappings_new RENAME TO port_mappings;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_port_mappings_host_port ON port_mappings (protocol, host_port);
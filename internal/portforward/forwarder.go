@@ -0,0 +1,138 @@
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Forwarder forwards tcp and udp ports of the host to addresses in workspace containers.
+type Forwarder struct {
+	// mu guards closed and forwards
+	mu sync.Mutex
+
+	closed bool
+
+	forwards map[forwardKey]forward
+}
+
+// forwardKey identifies a forwarded port. tcp and udp ports with the same number are different ports.
+type forwardKey struct {
+	protocol string
+	port     int
+}
+
+// forward is a host port that is being forwarded.
+type forward interface {
+	// setTarget changes the address that new connections are forwarded to.
+	setTarget(target string)
+
+	// close stops listening on the port and closes the connections that are being forwarded.
+	close() error
+}
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// upstreamTimeout is how long the forwarder waits to connect to the target of a tcp port.
+const upstreamTimeout = 10 * time.Second
+
+// udpIdleTimeout is how long a udp client is remembered without the target replying to it.
+const udpIdleTimeout = 2 * time.Minute
+
+// maxAcceptDelay is the longest the forwarder waits before accepting connections again after accepting fails.
+const maxAcceptDelay = time.Second
+
+var ErrUnsupportedProtocol = errors.New("protocol must be tcp or udp")
+var errForwarderClosed = errors.New("port forwarder is closed")
+
+func New() *Forwarder {
+	return &Forwarder{
+		forwards: make(map[forwardKey]forward),
+	}
+}
+
+// Listen binds the given host port and forwards connections to it to target, which is in the form of host:port.
+// Connections are refused while target is empty, e.g. while the workspace of the port is stopped.
+// An error wrapping syscall.EADDRINUSE is returned if the port is already bound, including by the forwarder itself.
+func (f *Forwarder) Listen(protocol string, port int, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return errForwarderClosed
+	}
+
+	key := forwardKey{protocol, port}
+	if _, ok := f.forwards[key]; ok {
+		return fmt.Errorf("%s port %d is already forwarded: %w", protocol, port, syscall.EADDRINUSE)
+	}
+
+	var fw forward
+	var err error
+	switch protocol {
+	case ProtocolTCP:
+		fw, err = listenTCP(port, target)
+	case ProtocolUDP:
+		fw, err = listenUDP(port, target)
+	default:
+		return ErrUnsupportedProtocol
+	}
+	if err != nil {
+		return err
+	}
+
+	f.forwards[key] = fw
+
+	return nil
+}
+
+// SetTarget changes the address that the given host port is forwarded to.
+// Connections that are already forwarded over tcp are kept. It does nothing if the port is not forwarded.
+func (f *Forwarder) SetTarget(protocol string, port int, target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fw, ok := f.forwards[forwardKey{protocol, port}]; ok {
+		fw.setTarget(target)
+	}
+}
+
+// Remove stops forwarding the given host port, and closes the connections that are being forwarded through it.
+func (f *Forwarder) Remove(protocol string, port int) {
+	f.mu.Lock()
+	fw, ok := f.forwards[forwardKey{protocol, port}]
+	delete(f.forwards, forwardKey{protocol, port})
+	f.mu.Unlock()
+
+	if ok {
+		_ = fw.close()
+	}
+}
+
+// IsForwarding returns whether the given host port is being forwarded.
+func (f *Forwarder) IsForwarding(protocol string, port int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.forwards[forwardKey{protocol, port}]
+	return ok
+}
+
+// Close stops forwarding all ports. Ports cannot be forwarded after the forwarder is closed.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	forwards := f.forwards
+	f.forwards = make(map[forwardKey]forward)
+	f.mu.Unlock()
+
+	var errs []error
+	for _, fw := range forwards {
+		errs = append(errs, fw.close())
+	}
+	return errors.Join(errs...)
+}
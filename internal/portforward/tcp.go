@@ -0,0 +1,140 @@
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpForward forwards the connections accepted on a tcp port to its target.
+type tcpForward struct {
+	listener net.Listener
+
+	// mu guards target, closed and conns
+	mu sync.Mutex
+
+	target string
+
+	closed bool
+
+	// conns are the accepted connections that are being forwarded.
+	conns map[net.Conn]struct{}
+}
+
+func listenTCP(port int, target string) (*tcpForward, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpForward{
+		listener: l,
+		target:   target,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go t.serve()
+
+	return t, nil
+}
+
+func (t *tcpForward) setTarget(target string) {
+	t.mu.Lock()
+	t.target = target
+	t.mu.Unlock()
+}
+
+func (t *tcpForward) close() error {
+	err := t.listener.Close()
+
+	t.mu.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = make(map[net.Conn]struct{})
+	t.mu.Unlock()
+
+	for conn := range conns {
+		_ = conn.Close()
+	}
+
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (t *tcpForward) serve() {
+	var delay time.Duration
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// accepting can fail temporarily, e.g. when there are too many open files,
+			// so it is retried with a backoff like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, maxAcceptDelay)
+			}
+			fmt.Printf("error accepting tcp connection at %v: %v; retrying in %v\n", t.listener.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+		go t.handleConnection(conn)
+	}
+}
+
+// handleConnection forwards the given connection to the target until either side closes it.
+func (t *tcpForward) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	t.mu.Lock()
+	target := t.target
+	t.mu.Unlock()
+	if target == "" {
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", target, upstreamTimeout)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	if !t.track(conn) {
+		return
+	}
+	defer t.untrack(conn)
+
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		if c, ok := upstream.(*net.TCPConn); ok {
+			_ = c.CloseWrite()
+		}
+	}()
+	_, _ = io.Copy(conn, upstream)
+}
+
+// track records the given connection so that it is closed with the forward.
+// It returns false if the forward is already closed.
+func (t *tcpForward) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tcpForward) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
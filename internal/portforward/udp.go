@@ -0,0 +1,144 @@
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize is the largest udp payload that can be forwarded.
+const maxDatagramSize = 64 * 1024
+
+// udpForward relays the datagrams received on a udp port to its target,
+// and the replies of the target back to the client that sent them.
+type udpForward struct {
+	conn net.PacketConn
+
+	// mu guards target, closed and peers
+	mu sync.Mutex
+
+	target string
+
+	closed bool
+
+	// peers maps the addresses of clients to the sockets that relay their datagrams to the target,
+	// so that the target can tell clients apart and its replies can be sent to the right client.
+	peers map[string]net.Conn
+}
+
+func listenUDP(port int, target string) (*udpForward, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &udpForward{
+		conn:   conn,
+		target: target,
+		peers:  make(map[string]net.Conn),
+	}
+	go u.serve()
+
+	return u, nil
+}
+
+// setTarget changes the target, and forgets the clients of the previous target,
+// as their datagrams would still be relayed to it otherwise.
+func (u *udpForward) setTarget(target string) {
+	u.mu.Lock()
+	u.target = target
+	peers := u.peers
+	u.peers = make(map[string]net.Conn)
+	u.mu.Unlock()
+
+	for _, peer := range peers {
+		_ = peer.Close()
+	}
+}
+
+func (u *udpForward) close() error {
+	err := u.conn.Close()
+
+	u.mu.Lock()
+	u.closed = true
+	peers := u.peers
+	u.peers = make(map[string]net.Conn)
+	u.mu.Unlock()
+
+	for _, peer := range peers {
+		_ = peer.Close()
+	}
+
+	return err
+}
+
+// serve relays received datagrams until the port is closed.
+// Datagrams that cannot be relayed are dropped, as udp does not guarantee delivery anyway.
+func (u *udpForward) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		peer, err := u.peer(addr)
+		if err != nil || peer == nil {
+			continue
+		}
+		_, _ = peer.Write(buf[:n])
+	}
+}
+
+// peer returns the socket that relays the datagrams of the given client to the target,
+// or nil if datagrams are not forwarded currently.
+func (u *udpForward) peer(addr net.Addr) (net.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed || u.target == "" {
+		return nil, nil
+	}
+	if peer, ok := u.peers[addr.String()]; ok {
+		return peer, nil
+	}
+
+	peer, err := net.Dial("udp", u.target)
+	if err != nil {
+		return nil, err
+	}
+	u.peers[addr.String()] = peer
+	go u.relayReplies(peer, addr)
+
+	return peer, nil
+}
+
+// relayReplies sends the datagrams that the target sends to the given peer socket back to the client,
+// until the target has not replied for udpIdleTimeout or the peer is closed.
+func (u *udpForward) relayReplies(peer net.Conn, addr net.Addr) {
+	defer func() {
+		_ = peer.Close()
+		u.mu.Lock()
+		if u.peers[addr.String()] == peer {
+			delete(u.peers, addr.String())
+		}
+		u.mu.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_ = peer.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := peer.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = u.conn.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package reverseproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Visibility is who can access a forwarded port.
+type Visibility string
+
+const (
+	// VisibilityPrivate ports are only accessible from browsers that opened the dashboard.
+	// tesseract has no user accounts, so anyone who can reach the dashboard can access them.
+	VisibilityPrivate Visibility = "private"
+
+	// VisibilityToken ports are accessible through share links, and from browsers that opened the dashboard.
+	VisibilityToken Visibility = "token"
+
+	// VisibilityPublic ports are accessible by anyone.
+	VisibilityPublic Visibility = "public"
+)
+
+// SessionCookieName is the cookie that browsers that opened the dashboard get, which gives access to private ports.
+// It is set on the host name, so that it is sent to every subdomain.
+const SessionCookieName = "tesseract_session"
+
+// ShareTokenParam is the query parameter that share links pass their token in.
+const ShareTokenParam = "tesseract_share"
+
+// shareCookieName is the cookie that a share token is kept in after the share link is opened,
+// so that the token is not needed in later requests. It is only set on the subdomain of the shared port.
+const shareCookieName = "tesseract_share"
+
+// sessionLifetime is how long session cookies are valid for.
+// They are renewed once they are valid for less than sessionRenewBefore, so that regular users stay signed in.
+const (
+	sessionLifetime    = 30 * 24 * time.Hour
+	sessionRenewBefore = 15 * 24 * time.Hour
+)
+
+// IsValid returns whether v is one of the visibility levels.
+func (v Visibility) IsValid() bool {
+	return v == VisibilityPrivate || v == VisibilityToken || v == VisibilityPublic
+}
+
+// SetVisibility sets who can access the given subdomain, and the secret that its share tokens are signed for.
+// It does nothing if the subdomain is not routed anywhere.
+func (p *ReverseProxy) SetVisibility(subdomain string, visibility Visibility, shareSecret string) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	if r, ok := p.routes[subdomain]; ok {
+		r.visibility = visibility
+		r.shareSecret = shareSecret
+		p.routes[subdomain] = r
+	}
+}
+
+// NewShareToken returns a token that gives access to the given subdomain of the given workspace until expiresAt,
+// as long as the subdomain has VisibilityToken and the given share secret.
+// Changing the share secret of a subdomain revokes every token that was created for it before.
+// It is passed to the subdomain in the ShareTokenParam query parameter.
+func (p *ReverseProxy) NewShareToken(workspaceName string, subdomain string, shareSecret string, expiresAt time.Time) string {
+	return p.signToken(shareTokenSubject(workspaceName, subdomain, shareSecret), expiresAt)
+}
+
+func shareTokenSubject(workspaceName string, subdomain string, shareSecret string) string {
+	return "share\n" + workspaceName + "\n" + subdomain + "\n" + shareSecret
+}
+
+const sessionTokenSubject = "session"
+
+// authorize checks whether the request may access the given route of the given subdomain.
+// If it may not, authorize responds to it and returns false.
+// Share links are answered by authorize as well, by storing their token in a cookie and redirecting to the link without it.
+func (p *ReverseProxy) authorize(c echo.Context, subdomain string, r route) (bool, error) {
+	req := c.Request()
+
+	switch r.visibility {
+	case VisibilityPublic:
+		return true, nil
+
+	case VisibilityToken:
+		subject := shareTokenSubject(r.workspaceName, subdomain, r.shareSecret)
+
+		if token := req.URL.Query().Get(ShareTokenParam); token != "" {
+			expiresAt, err := p.verifyToken(token, subject)
+			if err != nil {
+				return false, serveAccessDenied(c, "This share link is invalid or has expired.")
+			}
+
+			c.SetCookie(&http.Cookie{
+				Name:     shareCookieName,
+				Value:    token,
+				Path:     "/",
+				Expires:  expiresAt,
+				Secure:   c.IsTLS(),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			u := *req.URL
+			q := u.Query()
+			q.Del(ShareTokenParam)
+			u.RawQuery = q.Encode()
+			return false, c.Redirect(http.StatusFound, u.RequestURI())
+		}
+
+		if cookie, err := req.Cookie(shareCookieName); err == nil {
+			if _, err = p.verifyToken(cookie.Value, subject); err == nil {
+				return true, nil
+			}
+		}
+
+		if p.hasSession(req) {
+			return true, nil
+		}
+		return false, serveAccessDenied(c, "Ask the owner of the workspace for a share link to open this page.")
+
+	default:
+		if p.hasSession(req) {
+			return true, nil
+		}
+		return false, serveAccessDenied(c, "This port is private. Open the tesseract dashboard in this browser to access it.")
+	}
+}
+
+// hasSession returns whether the given request has a valid session cookie.
+func (p *ReverseProxy) hasSession(req *http.Request) bool {
+	cookie, err := req.Cookie(SessionCookieName)
+	if err != nil {
+		return false
+	}
+	_, err = p.verifyToken(cookie.Value, sessionTokenSubject)
+	return err == nil
+}
+
+// ensureSession gives the browser of the given dashboard request a session cookie,
+// unless it has one that is valid for long enough.
+// The dashboard does not authenticate anyone, so any request to it gets a session, including ones made without a browser.
+// Private ports are only as private as the dashboard itself, e.g. when it is only reachable through a VPN.
+func (p *ReverseProxy) ensureSession(c echo.Context) {
+	if cookie, err := c.Request().Cookie(SessionCookieName); err == nil {
+		expiresAt, err := p.verifyToken(cookie.Value, sessionTokenSubject)
+		if err == nil && time.Until(expiresAt) > sessionRenewBefore {
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(sessionLifetime)
+	cookie := &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    p.signToken(sessionTokenSubject, expiresAt),
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   c.IsTLS(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// cookies cannot be shared with subdomains of IPs, which cannot have subdomains anyway.
+	if net.ParseIP(p.hostName) == nil {
+		cookie.Domain = p.hostName
+	}
+	c.SetCookie(cookie)
+}
+
+// removeAccessCookies removes the cookies of tesseract from the given request before it is proxied,
+// so that they are not leaked to the servers in workspaces.
+func removeAccessCookies(req *http.Request) {
+	cookies := req.Cookies()
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name != SessionCookieName && cookie.Name != shareCookieName {
+			kept = append(kept, cookie.Name+"="+cookie.Value)
+		}
+	}
+
+	if len(kept) == len(cookies) {
+		return
+	}
+	if len(kept) == 0 {
+		req.Header.Del("Cookie")
+	} else {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// signToken returns a token for the given subject that expires at expiresAt,
+// in the form of "<expiry as unix time>.<signature>".
+func (p *ReverseProxy) signToken(subject string, expiresAt time.Time) string {
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + base64.RawURLEncoding.EncodeToString(p.tokenSignature(subject, expiry))
+}
+
+// verifyToken checks that the given token was signed for the given subject and has not expired,
+// and returns when it expires.
+func (p *ReverseProxy) verifyToken(token string, subject string) (time.Time, error) {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return time.Time{}, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, p.tokenSignature(subject, expiry)) {
+		return time.Time{}, errInvalidToken
+	}
+
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, errInvalidToken
+	}
+
+	expiresAt := time.Unix(unix, 0)
+	if time.Now().After(expiresAt) {
+		return time.Time{}, errTokenExpired
+	}
+	return expiresAt, nil
+}
+
+func (p *ReverseProxy) tokenSignature(subject string, expiry string) []byte {
+	mac := hmac.New(sha256.New, p.secretKey)
+	mac.Write([]byte(subject + "\n" + expiry))
+	return mac.Sum(nil)
+}
@@ -3,3 +3,6 @@ package reverseproxy
 import "errors"
 
 var ErrPortMappingConflict = errors.New("port mapping conflict")
+var errNoWaker = errors.New("workspaces cannot be started by the proxy")
+var errInvalidToken = errors.New("invalid token")
+var errTokenExpired = errors.New("token expired")
@@ -0,0 +1,86 @@
+package reverseproxy
+
+import (
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// workspacePage is shown instead of a forwarded port that is not available.
+var workspacePage = template.Must(template.New("workspace").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	{{if .RefreshSeconds}}<meta http-equiv="refresh" content="{{.RefreshSeconds}}">{{end}}
+	<title>{{.Title}}</title>
+	<style>
+		body { font-family: system-ui, sans-serif; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; color: #18181b; }
+		main { max-width: 32rem; padding: 1rem; text-align: center; }
+		p { color: #52525b; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{.Title}}</h1>
+		<p>{{.Message}}</p>
+	</main>
+</body>
+</html>
+`))
+
+type workspacePageData struct {
+	Title   string
+	Message string
+
+	// RefreshSeconds is after how many seconds the page reloads itself, or 0 if it does not.
+	RefreshSeconds int
+}
+
+// startingPageRefreshSeconds is how often the "starting" page checks whether the workspace is started.
+const startingPageRefreshSeconds = 2
+
+// serveWorkspaceUnavailable responds with a 503 page saying that the given workspace is not running.
+func serveWorkspaceUnavailable(c echo.Context, workspaceName string) error {
+	return serveWorkspacePage(c, http.StatusServiceUnavailable, workspacePageData{
+		Title:   "Workspace " + workspaceName + " is not running",
+		Message: "Start the workspace in tesseract, then reload this page.",
+	})
+}
+
+// serveWorkspaceStarting responds with a 503 page saying that the given workspace is starting,
+// which reloads itself until the workspace is started.
+func serveWorkspaceStarting(c echo.Context, workspaceName string) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(startingPageRefreshSeconds))
+	return serveWorkspacePage(c, http.StatusServiceUnavailable, workspacePageData{
+		Title:          "Starting workspace " + workspaceName + "…",
+		Message:        "This page will reload once the workspace is ready.",
+		RefreshSeconds: startingPageRefreshSeconds,
+	})
+}
+
+// serveWorkspaceFailedToStart responds with a 503 page saying that the given workspace cannot be started.
+func serveWorkspaceFailedToStart(c echo.Context, workspaceName string, err error) error {
+	return serveWorkspacePage(c, http.StatusServiceUnavailable, workspacePageData{
+		Title:   "Workspace " + workspaceName + " failed to start",
+		Message: err.Error(),
+	})
+}
+
+// serveAccessDenied responds with a 403 page with the given message, for requests that may not access a port.
+func serveAccessDenied(c echo.Context, message string) error {
+	return serveWorkspacePage(c, http.StatusForbidden, workspacePageData{
+		Title:   "Access denied",
+		Message: message,
+	})
+}
+
+func serveWorkspacePage(c echo.Context, status int, data workspacePageData) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	// the page must not be cached, as the port becomes available once the workspace is started or access is granted.
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	return workspacePage.Execute(res, data)
+}
@@ -3,27 +3,79 @@ package reverseproxy
 import (
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type ReverseProxy struct {
 	*echo.Echo
-	hostName    string
-	httpProxies map[string]*httputil.ReverseProxy
+	hostName string
+
+	// secretKey is the key that session cookies and share tokens are signed with.
+	secretKey []byte
+
+	// routesMu guards routes and addresses. It is read on every proxied request,
+	// so requests only wait for each other while the routes are changed.
+	routesMu sync.RWMutex
+
+	// routes maps subdomains to the ports of workspaces that requests to them are proxied to.
+	// A subdomain can have several labels, e.g. "web.my-workspace", and is relative to hostName.
+	routes map[string]route
+
+	// addresses maps the names of running workspaces to the IPs of their containers.
+	// Containers can get a different IP every time they are started, so the IP is looked up on every request.
+	addresses map[string]string
+
+	// wakeMu guards waker and waking
+	wakeMu sync.Mutex
+
+	waker Waker
+
+	// waking maps the names of workspaces that are started by requests to the state of their wake up
+	waking map[string]*wakeState
+
+	// mu guards sessions
+	mu sync.Mutex
+
+	// sessions maps session IDs to the requests that are being proxied
+	sessions map[string]*session
+}
+
+// route is where requests to a subdomain are proxied to.
+type route struct {
+	workspaceName string
+	port          int
+
+	// wakeOnRequest is whether requests start the workspace if it is stopped.
+	wakeOnRequest bool
+
+	// visibility is who can access the subdomain.
+	visibility Visibility
+
+	// shareSecret is the secret that share tokens of the subdomain are signed for.
+	shareSecret string
 }
 
 const keyReverseProxy = "reverseProxy"
 
-func New(hostName string) *ReverseProxy {
+// New returns a proxy for the subdomains of the given host name,
+// which signs session cookies and share tokens with the given secret key.
+func New(hostName string, secretKey []byte) *ReverseProxy {
 	e := echo.New()
 	proxy := &ReverseProxy{
-		e,
-		hostName,
-		make(map[string]*httputil.ReverseProxy),
+		Echo:      e,
+		hostName:  hostName,
+		secretKey: secretKey,
+		routes:    make(map[string]route),
+		addresses: make(map[string]string),
+		waking:    make(map[string]*wakeState),
+		sessions:  make(map[string]*session),
 	}
 
 	e.Any("/*", proxy.handleRequest)
@@ -37,24 +89,125 @@ func (p *ReverseProxy) Middleware() echo.MiddlewareFunc {
 			if p.shouldHandleRequest(c) {
 				return p.handleRequest(c)
 			}
+			// browsers that open the dashboard can access private ports.
+			p.ensureSession(c)
 			c.Set(keyReverseProxy, p)
 			return next(c)
 		}
 	}
 }
 
-func (p *ReverseProxy) AddEntry(subdomain string, url *url.URL) error {
-	_, ok := p.httpProxies[subdomain]
-	if ok {
+// EntryOptions are the settings of an entry, which are given when the entry is added,
+// so that requests are never routed to it without them.
+type EntryOptions struct {
+	// Visibility is who can access the subdomain. It defaults to VisibilityPrivate, as do invalid visibilities.
+	Visibility Visibility
+
+	// WakeOnRequest is whether requests start the workspace if it is stopped.
+	WakeOnRequest bool
+
+	// ShareSecret is the secret that share tokens of the subdomain are signed for. See NewShareToken.
+	ShareSecret string
+}
+
+// AddEntry routes requests to the given subdomain to the given port of the given workspace with the given options.
+// It returns ErrPortMappingConflict if the subdomain is already routed somewhere.
+func (p *ReverseProxy) AddEntry(subdomain string, workspaceName string, port int, opts EntryOptions) error {
+	visibility := opts.Visibility
+	if !visibility.IsValid() {
+		visibility = VisibilityPrivate
+	}
+
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	if _, ok := p.routes[subdomain]; ok {
 		return ErrPortMappingConflict
 	}
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	p.httpProxies[subdomain] = proxy
+	p.routes[subdomain] = route{
+		workspaceName: workspaceName,
+		port:          port,
+		wakeOnRequest: opts.WakeOnRequest,
+		visibility:    visibility,
+		shareSecret:   opts.ShareSecret,
+	}
 	return nil
 }
 
 func (p *ReverseProxy) RemoveEntry(subdomain string) {
-	delete(p.httpProxies, subdomain)
+	p.routesMu.Lock()
+	delete(p.routes, subdomain)
+	p.routesMu.Unlock()
+}
+
+// HasEntry returns whether requests to the given subdomain are routed anywhere.
+func (p *ReverseProxy) HasEntry(subdomain string) bool {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+	_, ok := p.routes[subdomain]
+	return ok
+}
+
+// HasHost returns whether the given host is the host name of tesseract, or a subdomain of it that is routed to a workspace.
+// Subdomains of the routed subdomains are not included, even though requests to them are routed too.
+func (p *ReverseProxy) HasHost(host string) bool {
+	host = strings.ToLower(host)
+	hostName := strings.ToLower(p.hostName)
+	if host == hostName {
+		return true
+	}
+
+	subdomain, ok := strings.CutSuffix(host, "."+hostName)
+	if !ok {
+		return false
+	}
+	return p.HasEntry(subdomain)
+}
+
+// findRoute returns the routed subdomain that requests to the given subdomain are proxied through, its route,
+// and the address of its workspace, which is empty if the workspace is not running.
+// Requests to subdomains of a routed subdomain are routed like it, e.g. "a.web" like "web",
+// so the longest suffix of the subdomain that is routed is used.
+func (p *ReverseProxy) findRoute(subdomain string) (string, route, string, bool) {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+
+	for {
+		if r, ok := p.routes[subdomain]; ok {
+			return subdomain, r, p.addresses[r.workspaceName], true
+		}
+
+		var ok bool
+		if _, subdomain, ok = strings.Cut(subdomain, "."); !ok {
+			return "", route{}, "", false
+		}
+	}
+}
+
+// SetWorkspaceAddress sets the IP of the container of the given workspace, which requests to it are proxied to.
+// An empty IP means that the workspace is not running, so requests to it are answered with a 503 page.
+func (p *ReverseProxy) SetWorkspaceAddress(workspaceName string, ip string) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	if ip == "" {
+		delete(p.addresses, workspaceName)
+	} else {
+		p.addresses[workspaceName] = ip
+	}
+}
+
+// RemoveWorkspace removes the address of the given workspace and every entry that routes requests to it.
+func (p *ReverseProxy) RemoveWorkspace(workspaceName string) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	delete(p.addresses, workspaceName)
+	for subdomain, r := range p.routes {
+		if r.workspaceName == workspaceName {
+			delete(p.routes, subdomain)
+		}
+	}
 }
 
 func (p *ReverseProxy) shouldHandleRequest(c echo.Context) bool {
@@ -92,14 +245,42 @@ func (p *ReverseProxy) handleRequest(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
 
-	ps := strings.Split(subdomain, ".")
-	first := ps[len(ps)-1]
-	proxy, ok := p.httpProxies[first]
+	routed, r, ip, ok := p.findRoute(subdomain)
 	if !ok {
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
+	// requests are authorized before anything else, so that requests that may not access the port cannot start the workspace.
+	if allowed, err := p.authorize(c, routed, r); !allowed {
+		return err
+	}
+	if r.wakeOnRequest && (ip == "" || p.isWaking(r.workspaceName)) {
+		if ip, err = p.wakeWorkspace(req, r); err != nil {
+			return serveWorkspaceFailedToStart(c, r.workspaceName, err)
+		}
+		if ip == "" {
+			return serveWorkspaceStarting(c, r.workspaceName)
+		}
+	}
+	if ip == "" {
+		return serveWorkspaceUnavailable(c, r.workspaceName)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(ip, strconv.Itoa(r.port)),
+	})
+
+	removeAccessCookies(req)
+
+	// the dev server may build absolute urls or set secure cookies depending on whether it is served over https.
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+
+	s, w, req := p.startSession(routed, res, req)
+	defer p.endSession(s)
 
-	proxy.ServeHTTP(res, req)
+	proxy.ServeHTTP(w, req)
 
 	return nil
 }
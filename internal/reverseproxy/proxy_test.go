@@ -0,0 +1,493 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHostName = "tesseract.test"
+
+var testSecretKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testWorkspace is the workspace that test servers run in. Its address is the loopback address.
+const testWorkspace = "ws"
+
+// startTestServer starts an http server that answers every request with the given name, and returns its port.
+func startTestServer(t *testing.T, name string) int {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name)
+	}))
+	t.Cleanup(s.Close)
+
+	return s.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func newTestProxy() *ReverseProxy {
+	p := New(testHostName, testSecretKey)
+	p.SetWorkspaceAddress(testWorkspace, "127.0.0.1")
+	return p
+}
+
+// get sends a request to the given subdomain through the proxy, and returns the status code and body of the response.
+func get(p *ReverseProxy, subdomain string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = subdomain + "." + testHostName
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestProxyRoutesBySubdomain(t *testing.T) {
+	p := newTestProxy()
+	if err := p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddEntry("api", testWorkspace, startTestServer(t, "api"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subdomain := range []string{"web", "api"} {
+		if code, body := get(p, subdomain); code != http.StatusOK || body != subdomain {
+			t.Errorf("expected %v to be routed to its server, got %d %q", subdomain, code, body)
+		}
+	}
+	if code, _ := get(p, "other"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a subdomain without an entry, got %d", code)
+	}
+}
+
+func TestProxyRoutesBySubdomainOfWorkspace(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress("other", "127.0.0.1")
+	if err := p.AddEntry("web."+testWorkspace, testWorkspace, startTestServer(t, "web of ws"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddEntry("web.other", "other", startTestServer(t, "web of other"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+
+	for subdomain, expected := range map[string]string{
+		"web." + testWorkspace:   "web of ws",
+		"a.web." + testWorkspace: "web of ws",
+		"web.other":              "web of other",
+	} {
+		if code, body := get(p, subdomain); code != http.StatusOK || body != expected {
+			t.Errorf("expected %v to be routed to %q, got %d %q", subdomain, expected, code, body)
+		}
+	}
+	for _, subdomain := range []string{"web", testWorkspace, "api." + testWorkspace} {
+		if code, _ := get(p, subdomain); code != http.StatusNotFound {
+			t.Errorf("expected 404 for %v, got %d", subdomain, code)
+		}
+	}
+}
+
+func TestAddEntryConflict(t *testing.T) {
+	p := newTestProxy()
+	if err := p.AddEntry("web", testWorkspace, startTestServer(t, "a"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddEntry("web", testWorkspace, startTestServer(t, "b"), EntryOptions{}); !errors.Is(err, ErrPortMappingConflict) {
+		t.Errorf("expected ErrPortMappingConflict, got %v", err)
+	}
+	if _, body := get(p, "web"); body != "a" {
+		t.Errorf("expected the existing entry to be kept, got %q", body)
+	}
+}
+
+func TestAddEntryDefaultsToPrivate(t *testing.T) {
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{})
+	_ = p.AddEntry("api", testWorkspace, startTestServer(t, "api"), EntryOptions{Visibility: "everyone"})
+
+	for _, subdomain := range []string{"web", "api"} {
+		if code, _ := get(p, subdomain); code != http.StatusForbidden {
+			t.Errorf("expected 403 for %v without a session, got %d", subdomain, code)
+		}
+	}
+}
+
+func TestRemoveEntry(t *testing.T) {
+	p := newTestProxy()
+	if err := p.AddEntry("web", testWorkspace, startTestServer(t, "a"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(p, "web"); body != "a" {
+		t.Fatalf("expected request to be routed to a, got %q", body)
+	}
+
+	p.RemoveEntry("web")
+	if p.HasEntry("web") {
+		t.Error("expected entry to be removed")
+	}
+	if code, _ := get(p, "web"); code != http.StatusNotFound {
+		t.Errorf("expected 404 after removing the entry, got %d", code)
+	}
+}
+
+// TestConcurrentRouting changes entries while requests are proxied, to be run with -race.
+func TestConcurrentRouting(t *testing.T) {
+	p := newTestProxy()
+	targets := []int{startTestServer(t, "a"), startTestServer(t, "b")}
+
+	// web is always routed somewhere, so requests to it must never fail.
+	if err := p.AddEntry("web", testWorkspace, targets[0], EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		subdomain := fmt.Sprintf("ws%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// the other subdomains go to a workspace that is started and stopped meanwhile.
+				_ = p.AddEntry(subdomain, "other", targets[j%2], EntryOptions{Visibility: VisibilityPublic})
+				p.SetWorkspaceAddress("other", "127.0.0.1")
+				_ = p.HasEntry(subdomain)
+				p.SetWorkspaceAddress("other", "")
+				_ = p.Sessions(subdomain)
+				p.RemoveEntry(subdomain)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// requests to the other subdomains fail while their entries are removed, which is expected.
+				_, _ = get(p, subdomain)
+				if code, body := get(p, "web"); code != http.StatusOK || body != "a" {
+					t.Errorf("expected request to web to be routed to a, got %d %q", code, body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+	if len(p.routes) != 1 {
+		t.Errorf("expected only web to be routed, got %v", p.routes)
+	}
+}
+
+func TestHasHost(t *testing.T) {
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, 80, EntryOptions{Visibility: VisibilityPublic})
+	_ = p.AddEntry("api.other", "other", 80, EntryOptions{Visibility: VisibilityPublic})
+
+	for host, expected := range map[string]bool{
+		testHostName:                 true,
+		"web." + testHostName:        true,
+		"WEB." + testHostName:        true,
+		"api." + testHostName:        false,
+		"a.web." + testHostName:      false,
+		"web.other.test":             false,
+		"web" + testHostName:         false,
+		"web." + testHostName + ".x": false,
+		"api.other." + testHostName:  true,
+		"other." + testHostName:      false,
+	} {
+		if actual := p.HasHost(host); actual != expected {
+			t.Errorf("expected HasHost(%q) to be %v, got %v", host, expected, actual)
+		}
+	}
+}
+
+func TestStoppedWorkspaceIsUnavailable(t *testing.T) {
+	p := newTestProxy()
+	if err := p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.SetWorkspaceAddress(testWorkspace, "")
+	code, body := get(p, "web")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "Workspace ws is not running") {
+		t.Errorf("expected 503 page for stopped workspace, got %d %q", code, body)
+	}
+
+	// the workspace is started again, which may give it another address.
+	p.SetWorkspaceAddress(testWorkspace, "127.0.0.1")
+	if code, body = get(p, "web"); code != http.StatusOK || body != "web" {
+		t.Errorf("expected request to be proxied once the workspace is started, got %d %q", code, body)
+	}
+}
+
+func TestRemoveWorkspace(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress("other", "127.0.0.1")
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic})
+	_ = p.AddEntry("api", testWorkspace, startTestServer(t, "api"), EntryOptions{Visibility: VisibilityPublic})
+	_ = p.AddEntry("other", "other", startTestServer(t, "other"), EntryOptions{Visibility: VisibilityPublic})
+
+	p.RemoveWorkspace(testWorkspace)
+
+	if p.HasEntry("web") || p.HasEntry("api") {
+		t.Error("expected entries of the removed workspace to be removed")
+	}
+	if code, body := get(p, "other"); code != http.StatusOK || body != "other" {
+		t.Errorf("expected entries of other workspaces to be kept, got %d %q", code, body)
+	}
+}
+
+func TestWakeOnRequest(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress(testWorkspace, "")
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic, WakeOnRequest: true})
+
+	var mu sync.Mutex
+	wakes := 0
+	p.SetWaker(func(ctx context.Context, workspaceName string) error {
+		mu.Lock()
+		wakes++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		p.SetWorkspaceAddress(workspaceName, "127.0.0.1")
+		return nil
+	})
+
+	// requests that are not from browsers are held until the workspace is started.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, body := get(p, "web"); code != http.StatusOK || body != "web" {
+				t.Errorf("expected request to be proxied once the workspace is started, got %d %q", code, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if wakes != 1 {
+		t.Errorf("expected workspace to be woken once, got %d", wakes)
+	}
+	if p.isWaking(testWorkspace) {
+		t.Error("expected workspace to stop waking once its port accepts connections")
+	}
+}
+
+func TestWakeOnRequestShowsStartingPage(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress(testWorkspace, "")
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic, WakeOnRequest: true})
+
+	started := make(chan struct{})
+	t.Cleanup(func() { close(started) })
+	p.SetWaker(func(ctx context.Context, workspaceName string) error {
+		<-started
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "web." + testHostName
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "Starting workspace ws") {
+		t.Errorf("expected starting page, got %d %q", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `http-equiv="refresh"`) {
+		t.Error("expected starting page to reload itself")
+	}
+}
+
+func TestWakeOnRequestFailure(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress(testWorkspace, "")
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPublic, WakeOnRequest: true})
+	_ = p.AddEntry("api", testWorkspace, startTestServer(t, "api"), EntryOptions{Visibility: VisibilityPublic})
+	p.SetWaker(func(ctx context.Context, workspaceName string) error {
+		return errors.New("no space left on device")
+	})
+
+	if code, body := get(p, "web"); code != http.StatusServiceUnavailable || !strings.Contains(body, "no space left on device") {
+		t.Errorf("expected page with the error, got %d %q", code, body)
+	}
+	// subdomains without wake on request do not start the workspace.
+	if code, body := get(p, "api"); code != http.StatusServiceUnavailable || !strings.Contains(body, "is not running") {
+		t.Errorf("expected not running page, got %d %q", code, body)
+	}
+}
+
+// serve sends the given request to the given subdomain through the proxy, and returns the response.
+func serve(p *ReverseProxy, subdomain string, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Host = subdomain + "." + testHostName
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+func sessionCookie(p *ReverseProxy) *http.Cookie {
+	return &http.Cookie{Name: SessionCookieName, Value: p.signToken(sessionTokenSubject, time.Now().Add(time.Hour))}
+}
+
+func TestPrivatePortRequiresSession(t *testing.T) {
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPrivate})
+
+	if rec := serve(p, "web", "/"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a session, got %d", rec.Code)
+	}
+
+	forged := &http.Cookie{Name: SessionCookieName, Value: New(testHostName, []byte("another key")).signToken(sessionTokenSubject, time.Now().Add(time.Hour))}
+	if rec := serve(p, "web", "/", forged); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with a session signed by another key, got %d", rec.Code)
+	}
+
+	expired := &http.Cookie{Name: SessionCookieName, Value: p.signToken(sessionTokenSubject, time.Now().Add(-time.Minute))}
+	if rec := serve(p, "web", "/", expired); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with an expired session, got %d", rec.Code)
+	}
+
+	if rec := serve(p, "web", "/", sessionCookie(p)); rec.Code != http.StatusOK || rec.Body.String() != "web" {
+		t.Errorf("expected request with a session to be proxied, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPrivatePortDoesNotWakeWorkspace(t *testing.T) {
+	p := newTestProxy()
+	p.SetWorkspaceAddress(testWorkspace, "")
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPrivate, WakeOnRequest: true})
+	p.SetWaker(func(ctx context.Context, workspaceName string) error {
+		t.Error("expected workspace not to be woken by a request without access")
+		return nil
+	})
+
+	if rec := serve(p, "web", "/"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a session, got %d", rec.Code)
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityToken, ShareSecret: "a"})
+
+	if rec := serve(p, "web", "/"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a share token, got %d", rec.Code)
+	}
+	if rec := serve(p, "web", "/", sessionCookie(p)); rec.Code != http.StatusOK {
+		t.Errorf("expected request with a session to be proxied, got %d", rec.Code)
+	}
+
+	// a token for another subdomain does not give access.
+	other := p.NewShareToken(testWorkspace, "api", "a", time.Now().Add(time.Hour))
+	if rec := serve(p, "web", "/?"+ShareTokenParam+"="+other); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with a token of another subdomain, got %d", rec.Code)
+	}
+
+	expired := p.NewShareToken(testWorkspace, "web", "a", time.Now().Add(-time.Minute))
+	if rec := serve(p, "web", "/?"+ShareTokenParam+"="+expired); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with an expired token, got %d", rec.Code)
+	}
+
+	// opening the link stores the token in a cookie, and redirects to the link without the token.
+	token := p.NewShareToken(testWorkspace, "web", "a", time.Now().Add(time.Hour))
+	rec := serve(p, "web", "/page?a=1&"+ShareTokenParam+"="+token)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/page?a=1" {
+		t.Fatalf("expected redirect to /page?a=1, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != shareCookieName || cookies[0].Domain != "" {
+		t.Fatalf("expected a share cookie on the subdomain, got %v", cookies)
+	}
+
+	if rec = serve(p, "web", "/page?a=1", cookies[0]); rec.Code != http.StatusOK || rec.Body.String() != "web" {
+		t.Errorf("expected request with the share cookie to be proxied, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// the token stops working once the port is made private.
+	p.SetVisibility("web", VisibilityPrivate, "b")
+	if rec = serve(p, "web", "/", cookies[0]); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with a share cookie for a private port, got %d", rec.Code)
+	}
+
+	// and stays revoked when the port is shared again with a new share secret.
+	p.SetVisibility("web", VisibilityToken, "c")
+	if rec = serve(p, "web", "/", cookies[0]); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with a share cookie of an earlier share secret, got %d", rec.Code)
+	}
+	if rec = serve(p, "web", "/?"+ShareTokenParam+"="+token); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with a share link of an earlier share secret, got %d", rec.Code)
+	}
+	token = p.NewShareToken(testWorkspace, "web", "c", time.Now().Add(time.Hour))
+	if rec = serve(p, "web", "/?"+ShareTokenParam+"="+token); rec.Code != http.StatusFound {
+		t.Errorf("expected a share link for the current share secret to be accepted, got %d", rec.Code)
+	}
+}
+
+func TestAccessCookiesAreNotProxied(t *testing.T) {
+	var received string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("Cookie")
+	}))
+	t.Cleanup(s.Close)
+
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, s.Listener.Addr().(*net.TCPAddr).Port, EntryOptions{Visibility: VisibilityPrivate})
+
+	serve(p, "web", "/", sessionCookie(p), &http.Cookie{Name: "app", Value: "1"})
+	if received != "app=1" {
+		t.Errorf("expected only the cookies of the app to be proxied, got %q", received)
+	}
+}
+
+func TestDashboardGetsSession(t *testing.T) {
+	p := newTestProxy()
+	_ = p.AddEntry("web", testWorkspace, startTestServer(t, "web"), EntryOptions{Visibility: VisibilityPrivate})
+	e := echo.New()
+	e.Use(p.Middleware())
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	// openDashboard returns the cookies that a request to the dashboard with the given cookies gets.
+	openDashboard := func(cookies ...*http.Cookie) []*http.Cookie {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = testHostName
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Result().Cookies()
+	}
+
+	cookies := openDashboard()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookieName || cookies[0].Domain != testHostName {
+		t.Fatalf("expected a session cookie for the host name and its subdomains, got %v", cookies)
+	}
+	if rec := serve(p, "web", "/", cookies[0]); rec.Code != http.StatusOK {
+		t.Error("expected the session cookie to give access to private ports")
+	}
+
+	if renewed := openDashboard(cookies[0]); len(renewed) != 0 {
+		t.Errorf("expected a new session not to be renewed, got %v", renewed)
+	}
+	if renewed := openDashboard(sessionCookie(p)); len(renewed) != 1 {
+		t.Errorf("expected a session that expires soon to be renewed, got %v", renewed)
+	}
+}
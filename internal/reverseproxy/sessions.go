@@ -0,0 +1,181 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProtocolHTTP      = "http"
+	ProtocolWebSocket = "websocket"
+)
+
+// Session describes an http request or websocket connection that is being proxied to a workspace.
+type Session struct {
+	ID        string
+	Subdomain string
+
+	// Protocol is either ProtocolHTTP or ProtocolWebSocket.
+	Protocol string
+
+	RemoteAddr string
+	StartedAt  time.Time
+
+	// BytesIn and BytesOut are the number of bytes of the bodies received from and sent to the client.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// session is a request that is being proxied.
+type session struct {
+	id         string
+	subdomain  string
+	protocol   string
+	remoteAddr string
+	startedAt  time.Time
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+
+	// cancel cancels the request, which disconnects the client.
+	cancel context.CancelFunc
+}
+
+// startSession records the given request as a session of the given subdomain.
+// The returned request and response writer must be used to proxy the request,
+// so that the session can be cancelled and its traffic counted.
+func (p *ReverseProxy) startSession(subdomain string, w http.ResponseWriter, req *http.Request) (*session, http.ResponseWriter, *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	s := &session{
+		id:         uuid.NewString(),
+		subdomain:  subdomain,
+		protocol:   ProtocolHTTP,
+		remoteAddr: req.RemoteAddr,
+		startedAt:  time.Now(),
+		cancel:     cancel,
+	}
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		s.protocol = ProtocolWebSocket
+	}
+
+	req = req.WithContext(ctx)
+	if req.Body != nil {
+		req.Body = &countingReadCloser{req.Body, &s.bytesIn}
+	}
+
+	p.mu.Lock()
+	p.sessions[s.id] = s
+	p.mu.Unlock()
+
+	return s, &countingResponseWriter{w, s}, req
+}
+
+// endSession removes a session recorded by startSession once its request is handled.
+func (p *ReverseProxy) endSession(s *session) {
+	s.cancel()
+	p.mu.Lock()
+	delete(p.sessions, s.id)
+	p.mu.Unlock()
+}
+
+// Sessions returns the requests and websocket connections that are being proxied to the given subdomain.
+func (p *ReverseProxy) Sessions(subdomain string) []Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sessions := make([]Session, 0)
+	for _, s := range p.sessions {
+		if s.subdomain != subdomain {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:         s.id,
+			Subdomain:  s.subdomain,
+			Protocol:   s.protocol,
+			RemoteAddr: s.remoteAddr,
+			StartedAt:  s.startedAt,
+			BytesIn:    s.bytesIn.Load(),
+			BytesOut:   s.bytesOut.Load(),
+		})
+	}
+
+	return sessions
+}
+
+// CloseSession cancels the request to the given subdomain with the given session ID, which disconnects the client.
+// It returns false if there is no such request.
+func (p *ReverseProxy) CloseSession(subdomain string, id string) bool {
+	p.mu.Lock()
+	s, ok := p.sessions[id]
+	p.mu.Unlock()
+
+	if !ok || s.subdomain != subdomain {
+		return false
+	}
+
+	s.cancel()
+	return true
+}
+
+// countingReadCloser counts the bytes read from an io.ReadCloser.
+type countingReadCloser struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response, including the traffic of hijacked connections.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	session *session
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.session.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// Hijack hijacks the underlying connection, which httputil.ReverseProxy does for websockets.
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{conn, w.session}, brw, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer, e.g. to flush it.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingConn counts the bytes read from and written to a hijacked connection.
+type countingConn struct {
+	net.Conn
+	session *session
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.session.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.session.bytesOut.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,171 @@
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Waker starts the workspace with the given name.
+type Waker func(ctx context.Context, workspaceName string) error
+
+// wakeTimeout is how long a woken workspace has to start and accept connections on the requested port.
+// Requests that are not from browsers are held for at most this long.
+const wakeTimeout = time.Minute
+
+// wakePollInterval is how often the requested port is checked while a workspace is woken.
+const wakePollInterval = 250 * time.Millisecond
+
+// interstitialWait is how long requests from browsers are held before the "starting" page is shown instead,
+// so that workspaces that start quickly do not flash the page.
+const interstitialWait = 2 * time.Second
+
+// wakeState is a workspace that is being woken.
+type wakeState struct {
+	startedAt time.Time
+
+	// done is closed once the workspace is started, after which err is set.
+	done chan struct{}
+	err  error
+}
+
+// SetWaker sets the function that starts stopped workspaces when one of their subdomains with wake on request is requested.
+func (p *ReverseProxy) SetWaker(waker Waker) {
+	p.wakeMu.Lock()
+	p.waker = waker
+	p.wakeMu.Unlock()
+}
+
+// SetWakeOnRequest sets whether requests to the given subdomain start its workspace if it is stopped.
+// It does nothing if the subdomain is not routed anywhere.
+func (p *ReverseProxy) SetWakeOnRequest(subdomain string, wakeOnRequest bool) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	if r, ok := p.routes[subdomain]; ok {
+		r.wakeOnRequest = wakeOnRequest
+		p.routes[subdomain] = r
+	}
+}
+
+// isWaking returns whether the given workspace was woken recently and is not accepting connections yet.
+// Workspaces that do not accept connections within wakeTimeout are not considered waking anymore,
+// so that requests to them are proxied as usual instead of waiting forever.
+func (p *ReverseProxy) isWaking(workspaceName string) bool {
+	p.wakeMu.Lock()
+	defer p.wakeMu.Unlock()
+
+	s, ok := p.waking[workspaceName]
+	if ok && time.Since(s.startedAt) >= wakeTimeout {
+		delete(p.waking, workspaceName)
+		return false
+	}
+	return ok
+}
+
+// wake starts the given workspace in the background unless it is already being woken,
+// and returns the state of the wake up.
+func (p *ReverseProxy) wake(workspaceName string) *wakeState {
+	p.wakeMu.Lock()
+	defer p.wakeMu.Unlock()
+
+	if s, ok := p.waking[workspaceName]; ok && time.Since(s.startedAt) < wakeTimeout {
+		return s
+	}
+
+	s := &wakeState{
+		startedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	p.waking[workspaceName] = s
+
+	waker := p.waker
+	go func() {
+		defer close(s.done)
+		if waker == nil {
+			s.err = errNoWaker
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), wakeTimeout)
+		defer cancel()
+		s.err = waker(ctx, workspaceName)
+	}()
+
+	return s
+}
+
+// finishWaking forgets the given wake up of the given workspace.
+func (p *ReverseProxy) finishWaking(workspaceName string, s *wakeState) {
+	p.wakeMu.Lock()
+	if p.waking[workspaceName] == s {
+		delete(p.waking, workspaceName)
+	}
+	p.wakeMu.Unlock()
+}
+
+// wakeWorkspace wakes the workspace of the given route, and waits until the port of the route accepts connections.
+// It returns the IP of the workspace once the port accepts connections, or an empty IP if the port is not ready
+// before the request should be answered, or the error if the workspace cannot be started.
+// Requests from browsers wait for interstitialWait, and other requests for wakeTimeout.
+func (p *ReverseProxy) wakeWorkspace(req *http.Request, r route) (string, error) {
+	s := p.wake(r.workspaceName)
+
+	wait := wakeTimeout - time.Since(s.startedAt)
+	if isBrowserNavigation(req) {
+		wait = min(wait, interstitialWait)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), wait)
+	defer cancel()
+
+	ticker := time.NewTicker(wakePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			if s.err != nil {
+				p.finishWaking(r.workspaceName, s)
+				return "", s.err
+			}
+		default:
+		}
+
+		p.routesMu.RLock()
+		ip := p.addresses[r.workspaceName]
+		p.routesMu.RUnlock()
+
+		if ip != "" && acceptsConnections(ctx, ip, r.port) {
+			p.finishWaking(r.workspaceName, s)
+			return ip, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// acceptsConnections returns whether the given port of the given IP accepts tcp connections.
+func acceptsConnections(ctx context.Context, ip string, port int) bool {
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, wakePollInterval)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// isBrowserNavigation returns whether the given request is a browser loading a page,
+// which can be shown the "starting" page instead of waiting.
+func isBrowserNavigation(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -13,10 +18,163 @@ type Config struct {
 	HostKeyDirectoryPath  string `json:"hostKeyDirectoryPath"`
 	HostName              string `json:"hostName"`
 	Debug                 bool   `json:"debug"`
+
+	// SecretKeyPath is the file containing the key that dashboard session cookies and share links of ports are signed with.
+	// It is generated if it does not exist. Changing the key signs everyone out and invalidates every share link.
+	SecretKeyPath string `json:"secretKeyPath"`
+
+	// SSHPort is the port of the SSH gateway, through which users ssh into workspaces.
+	SSHPort int `json:"sshPort"`
+
+	// SSHPortRange is the range of ports that workspaces get their own ssh port from.
+	// A workspace keeps its port for as long as it exists.
+	SSHPortRange PortRange `json:"sshPortRange"`
+
+	// ForwardedPortRange is the range of ports that tcp and udp ports of workspaces are forwarded from.
+	ForwardedPortRange PortRange `json:"forwardedPortRange"`
+
+	// SubdomainScheme is how the subdomains that http ports are forwarded through are laid out under HostName.
+	SubdomainScheme SubdomainScheme `json:"subdomainScheme"`
+
+	// MaxConcurrentBuilds is the maximum number of template builds that can run at the same time.
+	MaxConcurrentBuilds int `json:"maxConcurrentBuilds"`
+
+	// PortDetection configures how ports that processes in running workspaces listen on are detected.
+	PortDetection PortDetectionConfig `json:"portDetection"`
+
+	// TLS configures https for the dashboard and the subdomains of forwarded ports.
+	// They are served over plain http if it is not set.
+	TLS TLSConfig `json:"tls"`
+}
+
+// SubdomainScheme is how the subdomains that http ports are forwarded through are laid out under the host name.
+type SubdomainScheme string
+
+const (
+	// SubdomainSchemeFlat forwards ports through <subdomain>.<hostName>,
+	// so a subdomain can only be used by one workspace.
+	SubdomainSchemeFlat SubdomainScheme = "flat"
+
+	// SubdomainSchemeWorkspace forwards ports through <subdomain>.<workspace>.<hostName>,
+	// so every workspace can use the same subdomains.
+	SubdomainSchemeWorkspace SubdomainScheme = "workspace"
+)
+
+// RoutedSubdomain returns the subdomain of the host name that the given subdomain of a port of the given workspace
+// is served at, e.g. "web" or "web.my-workspace".
+func (s SubdomainScheme) RoutedSubdomain(workspaceName string, subdomain string) string {
+	if s == SubdomainSchemeWorkspace {
+		// host names are case-insensitive, and browsers always send them in lower case.
+		return subdomain + "." + strings.ToLower(workspaceName)
+	}
+	return subdomain
+}
+
+type PortDetectionConfig struct {
+	// Interval is how often the listening ports of running workspaces are detected, in seconds.
+	Interval int `json:"interval"`
+
+	// AutoForward makes tesseract forward ports that start listening in a workspace
+	// through a subdomain generated from SubdomainPattern.
+	AutoForward bool `json:"autoForward"`
+
+	// SubdomainPattern is the subdomain that automatically forwarded ports get,
+	// in which "{workspace}" is replaced with the name of the workspace and "{port}" with the port.
+	SubdomainPattern string `json:"subdomainPattern"`
+
+	// IgnoredPorts are ports that are never forwarded automatically, e.g. ssh servers.
+	IgnoredPorts []int `json:"ignoredPorts"`
+}
+
+// Subdomain returns the subdomain that the given port of the given workspace is automatically forwarded to.
+func (c PortDetectionConfig) Subdomain(workspaceName string, port int) string {
+	return strings.NewReplacer(
+		"{workspace}", strings.ToLower(workspaceName),
+		"{port}", strconv.Itoa(port),
+	).Replace(c.SubdomainPattern)
+}
+
+// TLSConfig configures where the certificate that tesseract serves https with comes from:
+// a certificate and key from files, a local certificate authority that tesseract runs itself, or an ACME server.
+type TLSConfig struct {
+	// CertFile and KeyFile are paths to a PEM certificate and its key,
+	// which should be valid for hostName and *.hostName.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// LocalCA makes tesseract issue certificates for hostName and all of its subdomains from a certificate authority
+	// that is generated on first start. Browsers accept the certificates once the CA certificate is trusted.
+	LocalCA bool `json:"localCA"`
+
+	// CADirectoryPath is the directory that the certificate and key of the local CA are kept in.
+	CADirectoryPath string `json:"caDirectoryPath"`
+
+	// ACME makes tesseract obtain and renew certificates for hostName and the subdomains of forwarded ports
+	// from an ACME server such as Let's Encrypt, if it is set.
+	ACME *ACMEConfig `json:"acme"`
+
+	// RedirectPort is the port on which plain http requests are redirected to https, or 0 to not redirect.
+	// ACME http-01 challenges are answered on it too.
+	RedirectPort int `json:"redirectPort"`
+}
+
+// Enabled returns whether https is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.LocalCA || c.CertFile != "" || c.ACME != nil
+}
+
+type ACMEConfig struct {
+	// DirectoryURL is the directory of the ACME server. The default is the production directory of Let's Encrypt.
+	DirectoryURL string `json:"directoryURL"`
+
+	// Email is the contact address of the ACME account, which the ACME server sends notices about certificates to.
+	Email string `json:"email"`
+
+	// CacheDirectoryPath is the directory that the account key and obtained certificates are kept in.
+	CacheDirectoryPath string `json:"cacheDirectoryPath"`
+
+	// DirectoryCAFile is the path to a PEM certificate that the https certificate of the ACME server is verified with
+	// in addition to the system roots, e.g. the certificate of a local test server.
+	DirectoryCAFile string `json:"directoryCAFile"`
 }
 
 const defaultPort = 8080
 
+const defaultMaxConcurrentBuilds = 2
+
+const defaultSSHPort = 2222
+
+var defaultSSHPortRange = PortRange{Start: 2223, End: 2322}
+
+var defaultForwardedPortRange = PortRange{Start: 20000, End: 20999}
+
+const defaultHostKeyDirectoryPath = "./host-keys"
+
+const defaultCADirectoryPath = "./ca"
+
+const defaultSecretKeyPath = "./secret.key"
+
+const defaultPortDetectionInterval = 10
+
+const defaultSubdomainPattern = "{workspace}-{port}"
+
+// defaultWorkspaceSubdomainPattern is the default subdomain pattern of SubdomainSchemeWorkspace,
+// whose subdomains already contain the name of the workspace.
+const defaultWorkspaceSubdomainPattern = "{port}"
+
+var defaultIgnoredPorts = []int{22}
+
+// subdomainRegex matches the subdomains that ports can be forwarded to.
+var subdomainRegex = regexp.MustCompile("^[\\w-]+$")
+
+// IsValidSubdomain returns whether a port can be forwarded to the given subdomain.
+// Subdomains cannot contain dots, since requests to subdomains of a routed subdomain are routed like it.
+func IsValidSubdomain(subdomain string) bool {
+	return subdomainRegex.MatchString(subdomain)
+}
+
+const defaultACMECacheDirectoryPath = "./acme"
+
 func ReadConfigFrom(reader io.Reader) (Config, error) {
 	var config Config
 	err := json.NewDecoder(reader).Decode(&config)
@@ -34,14 +192,181 @@ func ReadConfigFrom(reader io.Reader) (Config, error) {
 		return Config{}, err
 	}
 
+	if config.HostKeyDirectoryPath == "" {
+		config.HostKeyDirectoryPath = defaultHostKeyDirectoryPath
+	}
 	config.HostKeyDirectoryPath, err = filepath.Abs(config.HostKeyDirectoryPath)
 	if err != nil {
 		return Config{}, err
 	}
 
+	if config.SecretKeyPath == "" {
+		config.SecretKeyPath = defaultSecretKeyPath
+	}
+	config.SecretKeyPath, err = filepath.Abs(config.SecretKeyPath)
+	if err != nil {
+		return Config{}, err
+	}
+
 	if config.Port == 0 {
 		config.Port = defaultPort
 	}
 
+	if config.SSHPort == 0 {
+		config.SSHPort = defaultSSHPort
+	}
+
+	if config.SSHPortRange == (PortRange{}) {
+		config.SSHPortRange = defaultSSHPortRange
+	}
+	if config.SSHPortRange.Contains(config.SSHPort) {
+		return Config{}, fmt.Errorf("sshPortRange %v must not contain sshPort %d", config.SSHPortRange, config.SSHPort)
+	}
+
+	if config.ForwardedPortRange == (PortRange{}) {
+		config.ForwardedPortRange = defaultForwardedPortRange
+	}
+	if config.ForwardedPortRange.Contains(config.Port) || config.ForwardedPortRange.Contains(config.SSHPort) {
+		return Config{}, fmt.Errorf("forwardedPortRange %v must not contain port %d or sshPort %d", config.ForwardedPortRange, config.Port, config.SSHPort)
+	}
+	if config.ForwardedPortRange.Overlaps(config.SSHPortRange) {
+		return Config{}, fmt.Errorf("forwardedPortRange %v must not overlap sshPortRange %v", config.ForwardedPortRange, config.SSHPortRange)
+	}
+
+	if config.MaxConcurrentBuilds <= 0 {
+		config.MaxConcurrentBuilds = defaultMaxConcurrentBuilds
+	}
+
+	if config.SubdomainScheme == "" {
+		config.SubdomainScheme = SubdomainSchemeFlat
+	}
+	if config.SubdomainScheme != SubdomainSchemeFlat && config.SubdomainScheme != SubdomainSchemeWorkspace {
+		return Config{}, fmt.Errorf("subdomainScheme %q must be %q or %q", config.SubdomainScheme, SubdomainSchemeFlat, SubdomainSchemeWorkspace)
+	}
+
+	if config.PortDetection.Interval <= 0 {
+		config.PortDetection.Interval = defaultPortDetectionInterval
+	}
+	if config.PortDetection.SubdomainPattern == "" {
+		if config.SubdomainScheme == SubdomainSchemeWorkspace {
+			config.PortDetection.SubdomainPattern = defaultWorkspaceSubdomainPattern
+		} else {
+			config.PortDetection.SubdomainPattern = defaultSubdomainPattern
+		}
+	}
+	if !strings.Contains(config.PortDetection.SubdomainPattern, "{port}") ||
+		!subdomainRegex.MatchString(config.PortDetection.Subdomain("workspace", 3000)) {
+		return Config{}, fmt.Errorf("portDetection.subdomainPattern %q must contain {port}, and only letters, digits, _ and - otherwise", config.PortDetection.SubdomainPattern)
+	}
+	if config.PortDetection.IgnoredPorts == nil {
+		config.PortDetection.IgnoredPorts = defaultIgnoredPorts
+	}
+
+	if config.TLS, err = readTLSConfig(config); err != nil {
+		return Config{}, err
+	}
+
 	return config, nil
 }
+
+func readTLSConfig(config Config) (TLSConfig, error) {
+	c := config.TLS
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return TLSConfig{}, errors.New("tls.certFile and tls.keyFile must be set together")
+	}
+	if c.LocalCA && c.CertFile != "" {
+		return TLSConfig{}, errors.New("tls.localCA cannot be used with tls.certFile and tls.keyFile")
+	}
+	if c.ACME != nil && (c.LocalCA || c.CertFile != "") {
+		return TLSConfig{}, errors.New("tls.acme cannot be used with tls.localCA, or tls.certFile and tls.keyFile")
+	}
+
+	var err error
+	if c.CertFile != "" {
+		if c.CertFile, err = filepath.Abs(c.CertFile); err != nil {
+			return TLSConfig{}, err
+		}
+		if c.KeyFile, err = filepath.Abs(c.KeyFile); err != nil {
+			return TLSConfig{}, err
+		}
+	}
+
+	if c.CADirectoryPath == "" {
+		c.CADirectoryPath = defaultCADirectoryPath
+	}
+	if c.CADirectoryPath, err = filepath.Abs(c.CADirectoryPath); err != nil {
+		return TLSConfig{}, err
+	}
+
+	if c.ACME != nil {
+		acme := *c.ACME
+		if acme.CacheDirectoryPath == "" {
+			acme.CacheDirectoryPath = defaultACMECacheDirectoryPath
+		}
+		if acme.CacheDirectoryPath, err = filepath.Abs(acme.CacheDirectoryPath); err != nil {
+			return TLSConfig{}, err
+		}
+		if acme.DirectoryCAFile != "" {
+			if acme.DirectoryCAFile, err = filepath.Abs(acme.DirectoryCAFile); err != nil {
+				return TLSConfig{}, err
+			}
+		}
+		c.ACME = &acme
+	}
+
+	if c.RedirectPort != 0 {
+		if !c.Enabled() {
+			return TLSConfig{}, errors.New("tls.redirectPort requires tls.certFile and tls.keyFile, tls.localCA, or tls.acme")
+		}
+		if c.RedirectPort == config.Port || c.RedirectPort == config.SSHPort ||
+			config.SSHPortRange.Contains(c.RedirectPort) || config.ForwardedPortRange.Contains(c.RedirectPort) {
+			return TLSConfig{}, fmt.Errorf("tls.redirectPort %d must not be port, sshPort, or in sshPortRange or forwardedPortRange", c.RedirectPort)
+		}
+	}
+
+	return c, nil
+}
+
+// PortRange is an inclusive range of ports, written as "start-end" in the config, e.g. "2223-2322".
+type PortRange struct {
+	Start int
+	End   int
+}
+
+var errInvalidPortRange = errors.New("port range must be in the form of start-end, where 0 < start <= end <= 65535")
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+func (r PortRange) Overlaps(other PortRange) bool {
+	return r.Start <= other.End && other.Start <= r.End
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+func (r PortRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *PortRange) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	var start, end int
+	if n, err := fmt.Sscanf(s, "%d-%d", &start, &end); err != nil || n != 2 {
+		return errInvalidPortRange
+	}
+	if start <= 0 || start > end || end > 65535 {
+		return errInvalidPortRange
+	}
+
+	r.Start = start
+	r.End = end
+	return nil
+}
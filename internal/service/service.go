@@ -1,7 +1,12 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/docker/docker/client"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
@@ -11,31 +16,61 @@ import (
 	"github.com/uptrace/bun/dialect/sqlitedialect"
 	"github.com/uptrace/bun/driver/sqliteshim"
 	"github.com/uptrace/bun/extra/bundebug"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/fs"
 	_ "modernc.org/sqlite"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"tesseract/internal/listeningports"
+	"tesseract/internal/localca"
+	"tesseract/internal/portforward"
 	"tesseract/internal/reverseproxy"
 	"tesseract/internal/sshproxy"
 )
 
 const (
-	keyHTTPClient   = "httpClient"
-	keyDockerClient = "dockerClient"
-	keyDB           = "db"
-	keyConfig       = "config"
-	keySSHProxy     = "sshProxy"
-	keyReverseProxy = "reverseProxy"
+	keyHTTPClient    = "httpClient"
+	keyDockerClient  = "dockerClient"
+	keyDB            = "db"
+	keyConfig        = "config"
+	keySSHProxy      = "sshProxy"
+	keyReverseProxy  = "reverseProxy"
+	keyPortForwarder = "portForwarder"
+	keyMelody        = "melody"
 )
 
+// maxWebSocketMessageSize is the maximum size of a message received over websocket connections.
+const maxWebSocketMessageSize = 64 * 1024
+
 type Services struct {
-	HTTPClient   *http.Client
-	DockerClient *client.Client
-	Database     *bun.DB
-	Config       Config
-	SSHProxy     *sshproxy.SSHProxy
-	ReverseProxy *reverseproxy.ReverseProxy
-	Melody       *melody.Melody
+	HTTPClient    *http.Client
+	DockerClient  *client.Client
+	Database      *bun.DB
+	Config        Config
+	SSHProxy      *sshproxy.SSHProxy
+	ReverseProxy  *reverseproxy.ReverseProxy
+	PortForwarder *portforward.Forwarder
+	Melody        *melody.Melody
+
+	// ListeningPorts keeps the ports that were last detected in running workspaces.
+	ListeningPorts *listeningports.Registry
+
+	// TLSConfig is the config that the dashboard and forwarded subdomains are served with over https,
+	// or nil if they are served over plain http.
+	TLSConfig *tls.Config
+
+	// LocalCA issues the certificates of TLSConfig if the local CA is enabled, and is nil otherwise.
+	LocalCA *localca.CA
+
+	// ACMEManager obtains the certificates of TLSConfig if ACME is enabled, and is nil otherwise.
+	ACMEManager *autocert.Manager
 }
 
+var errUnknownHost = errors.New("host is not the host name of tesseract or a subdomain of a forwarded port")
+
 func HTTPClient(c echo.Context) *http.Client {
 	return c.Get(keyHTTPClient).(*http.Client)
 }
@@ -56,6 +91,14 @@ func ReverseProxy(c echo.Context) *reverseproxy.ReverseProxy {
 	return c.Get(keyReverseProxy).(*reverseproxy.ReverseProxy)
 }
 
+func PortForwarder(c echo.Context) *portforward.Forwarder {
+	return c.Get(keyPortForwarder).(*portforward.Forwarder)
+}
+
+func Melody(c echo.Context) *melody.Melody {
+	return c.Get(keyMelody).(*melody.Melody)
+}
+
 func Initialize(config Config) (Services, error) {
 	hc := &http.Client{}
 
@@ -73,17 +116,38 @@ func Initialize(config Config) (Services, error) {
 		bundb.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
 	}
 
-	sshProxy := sshproxy.New()
+	sshProxy, err := sshproxy.New(config.SSHPort, config.HostKeyDirectoryPath, docker)
+	if err != nil {
+		return Services{}, err
+	}
 
-	return Services{
-		HTTPClient:   hc,
-		DockerClient: docker,
-		Database:     bundb,
-		Config:       config,
-		Melody:       melody.New(),
-		SSHProxy:     sshProxy,
-		ReverseProxy: reverseproxy.New(config.HostName),
-	}, nil
+	secretKey, err := loadSecretKey(config.SecretKeyPath)
+	if err != nil {
+		return Services{}, err
+	}
+
+	m := melody.New()
+	m.Config.MaxMessageSize = maxWebSocketMessageSize
+	m.Upgrader.CheckOrigin = func(r *http.Request) bool {
+		return isDashboardOrigin(r, config.HostName)
+	}
+
+	services := Services{
+		HTTPClient:     hc,
+		DockerClient:   docker,
+		Database:       bundb,
+		Config:         config,
+		Melody:         m,
+		SSHProxy:       sshProxy,
+		ReverseProxy:   reverseproxy.New(config.HostName, secretKey),
+		PortForwarder:  portforward.New(),
+		ListeningPorts: listeningports.NewRegistry(),
+	}
+	if err = services.initializeTLS(); err != nil {
+		return Services{}, err
+	}
+
+	return services, nil
 }
 
 func (s Services) Middleware() echo.MiddlewareFunc {
@@ -95,7 +159,132 @@ func (s Services) Middleware() echo.MiddlewareFunc {
 			c.Set(keyConfig, s.Config)
 			c.Set(keySSHProxy, s.SSHProxy)
 			c.Set(keyReverseProxy, s.ReverseProxy)
+			c.Set(keyPortForwarder, s.PortForwarder)
+			c.Set(keyMelody, s.Melody)
 			return next(c)
 		}
 	}
 }
+
+// secretKeySize is the size of the generated secret key in bytes.
+const secretKeySize = 32
+
+// loadSecretKey reads the secret key at path, which is generated if it does not exist yet.
+func loadSecretKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < secretKeySize {
+			return nil, fmt.Errorf("%v must contain at least %d bytes", path, secretKeySize)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, secretKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// initializeTLS sets up the config to serve https with according to the tls config, if https is configured,
+// along with the local CA or the ACME manager that provides its certificates.
+func (s *Services) initializeTLS() error {
+	c := s.Config.TLS
+	switch {
+	case c.LocalCA:
+		// certificates are only issued for the subdomains that ports are forwarded to, like with ACME.
+		ca, err := localca.Load(c.CADirectoryPath, s.Config.HostName, s.ReverseProxy.HasHost)
+		if err != nil {
+			return err
+		}
+		s.LocalCA = ca
+		s.TLSConfig = &tls.Config{GetCertificate: ca.GetCertificate}
+
+	case c.ACME != nil:
+		client := &acme.Client{DirectoryURL: c.ACME.DirectoryURL}
+		if c.ACME.DirectoryCAFile != "" {
+			hc, err := newHTTPClientTrusting(c.ACME.DirectoryCAFile)
+			if err != nil {
+				return err
+			}
+			client.HTTPClient = hc
+		}
+
+		proxy := s.ReverseProxy
+		s.ACMEManager = &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(c.ACME.CacheDirectoryPath),
+			Client: client,
+			Email:  c.ACME.Email,
+			// certificates are only obtained for the subdomains that ports are forwarded to,
+			// so that requests to made up subdomains do not use up the rate limits of the ACME server.
+			HostPolicy: func(ctx context.Context, host string) error {
+				if !proxy.HasHost(host) {
+					return fmt.Errorf("%w: %v", errUnknownHost, host)
+				}
+				return nil
+			},
+		}
+		s.TLSConfig = &tls.Config{
+			GetCertificate: s.ACMEManager.GetCertificate,
+			// websocket connections need http/1.1, so http/2 is not offered.
+			NextProtos: []string{"http/1.1", acme.ALPNProto},
+		}
+
+	case c.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return nil
+}
+
+// newHTTPClientTrusting returns an http client that trusts the PEM certificates in the given file
+// in addition to the system roots.
+func newHTTPClientTrusting(caFile string) (*http.Client, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%v does not contain any PEM certificate", caFile)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+// isDashboardOrigin returns whether the given websocket request comes from the dashboard,
+// i.e. from the same origin as the request or from the host name of tesseract.
+// melody accepts every origin by default, which would let any website that a user visits open a terminal in a workspace.
+// Requests without an origin do not come from browsers, and are allowed.
+func isDashboardOrigin(r *http.Request, hostName string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) || strings.EqualFold(u.Hostname(), hostName)
+}
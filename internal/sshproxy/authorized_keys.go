@@ -0,0 +1,163 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/crypto/ssh"
+	"slices"
+	"strings"
+)
+
+// AnyName matches any user or workspace in the scope of an AuthorizedKey.
+// It does not match rootUser, which has to be listed by name.
+const AnyName = "*"
+
+// rootUser is the user that keys can only log in as if it is in their scope by name.
+const rootUser = "root"
+
+// extensionRootAllowed is set in the permissions of a connection whose key may log in as rootUser.
+const extensionRootAllowed = "tesseract-root-allowed"
+
+// envClientKey is the environment variable that passes the client key of the proxy to clientKeyScript.
+const envClientKey = "TESSERACT_AUTHORIZED_KEY"
+
+// clientKeyComment is the comment of the client key of the proxy in authorized_keys.
+const clientKeyComment = "tesseract-gateway"
+
+// clientKeyScript adds the key in $TESSERACT_AUTHORIZED_KEY to the authorized_keys of the user running it,
+// in a block managed by tesseract, so that keys added by the user are left untouched.
+// It runs as the user, so that it cannot be made to write files the user cannot write.
+const clientKeyScript = `set -e
+mkdir -p ~/.ssh
+chmod 700 ~/.ssh
+f=~/.ssh/authorized_keys
+touch "$f"
+chmod 600 "$f"
+grep -qxF "$TESSERACT_AUTHORIZED_KEY" "$f" && exit 0
+tmp="$(mktemp)"
+sed '/^# BEGIN tesseract$/,/^# END tesseract$/d' "$f" > "$tmp"
+{ echo "# BEGIN tesseract"; printf '%s\n' "$TESSERACT_AUTHORIZED_KEY"; echo "# END tesseract"; } >> "$tmp"
+cat "$tmp" > "$f"
+rm -f "$tmp"
+`
+
+// AuthorizedKey is a public key that is allowed to log in as the given users to the given workspaces.
+type AuthorizedKey struct {
+	Key ssh.PublicKey
+
+	// Users are the user names the key can log in as, which may include AnyName for any user but root.
+	Users []string
+
+	// Workspaces are the names of the workspaces the key can log in to, which may include AnyName.
+	Workspaces []string
+}
+
+// allows returns whether the key can log in as the given user to the given workspace.
+func (k AuthorizedKey) allows(user string, workspaceName string) bool {
+	if !IsValidUserName(user) {
+		return false
+	}
+	return (slices.Contains(k.Users, user) || (user != rootUser && slices.Contains(k.Users, AnyName))) &&
+		(slices.Contains(k.Workspaces, AnyName) || slices.Contains(k.Workspaces, workspaceName))
+}
+
+// IsValidUserName returns whether the given name can be logged in as.
+// docker exec also accepts uids and "user:group", which could run as uid or gid 0 under a name other than root,
+// so names that are only digits or contain a colon are not user names.
+func IsValidUserName(name string) bool {
+	if name == "" || strings.Contains(name, ":") {
+		return false
+	}
+	return strings.ContainsFunc(name, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+}
+
+// SetAuthorizedKeys replaces the public keys that are allowed to log in to workspaces.
+// A key that is given more than once is allowed everything any of its scopes allows.
+func (p *SSHProxy) SetAuthorizedKeys(keys []AuthorizedKey) {
+	authorizedKeys := make(map[string][]AuthorizedKey, len(keys))
+	for _, key := range keys {
+		k := string(key.Key.Marshal())
+		authorizedKeys[k] = append(authorizedKeys[k], key)
+	}
+
+	p.mu.Lock()
+	p.authorizedKeys = authorizedKeys
+	p.mu.Unlock()
+}
+
+// isAuthorizedKey returns whether the given key is allowed to log in as the given user to the given workspace.
+func (p *SSHProxy) isAuthorizedKey(key ssh.PublicKey, user string, workspaceName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, k := range p.authorizedKeys[string(key.Marshal())] {
+		if k.allows(user, workspaceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeClientKey adds the client key of the proxy to the authorized_keys of the given user in the given container,
+// so that the proxy can log in to the ssh server of the workspace as the user.
+// Only users someone logs in as through the proxy have the key authorized.
+func (p *SSHProxy) authorizeClientKey(ctx context.Context, containerID string, user string) error {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(p.clientKey.PublicKey()))) + " " + clientKeyComment
+
+	if _, err := p.execOutput(ctx, containerID, user, []string{envClientKey + "=" + line}, []string{"/bin/sh", "-c", clientKeyScript}); err != nil {
+		return fmt.Errorf("authorizing the gateway key failed: %w", err)
+	}
+	return nil
+}
+
+// checkNotRoot returns an error if the given user has uid 0 in the given container,
+// which users can have under any name, or if the uid of the user cannot be found.
+func (p *SSHProxy) checkNotRoot(ctx context.Context, containerID string, user string) error {
+	output, err := p.execOutput(ctx, containerID, user, nil, []string{"id", "-u"})
+	if err != nil {
+		return fmt.Errorf("finding the uid of %v failed: %w", user, err)
+	}
+	if strings.TrimSpace(output) == "0" {
+		return errRootUser
+	}
+	return nil
+}
+
+// execOutput runs the given command as the given user in the given container, and returns what it writes to stdout.
+// What it writes to stderr is included in the returned error if it exits with a non-zero status.
+func (p *SSHProxy) execOutput(ctx context.Context, containerID string, user string, env []string, cmd []string) (string, error) {
+	res, err := p.docker.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		User:         user,
+		Env:          env,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	attached, err := p.docker.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer attached.Close()
+
+	var stdout, stderr strings.Builder
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, attached.Reader); err != nil {
+		return "", err
+	}
+
+	inspect, err := p.docker.ContainerExecInspect(ctx, res.ID)
+	if err != nil {
+		return "", err
+	}
+	if inspect.ExitCode != 0 {
+		return "", fmt.Errorf("%v exited with status %d: %v", cmd[0], inspect.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
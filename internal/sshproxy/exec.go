@@ -0,0 +1,428 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"tesseract/internal/docker"
+)
+
+// loginShellScript runs the login shell of $USER in /etc/passwd, or /bin/sh if the user has none.
+const loginShellScript = `shell=
+while IFS=: read -r name _ _ _ _ _ s; do
+	if [ "$name" = "$USER" ]; then shell=$s; break; fi
+done < /etc/passwd
+exec "${shell:-/bin/sh}" -l`
+
+// sftpServerScript runs the sftp-server of OpenSSH, which is installed at different paths by different distros.
+const sftpServerScript = `for p in /usr/lib/openssh/sftp-server /usr/libexec/openssh/sftp-server /usr/lib/ssh/sftp-server /usr/libexec/sftp-server /usr/lib/sftp-server $(command -v sftp-server); do
+	if [ -x "$p" ]; then exec "$p"; fi
+done
+echo "sftp-server is not installed in this workspace" >&2
+exit 127`
+
+// relayScript connects its stdin and stdout to port $2 of host $1 with whichever of nc, socat and bash the container has.
+const relayScript = `if command -v nc >/dev/null 2>&1; then exec nc "$1" "$2"; fi
+if command -v socat >/dev/null 2>&1; then exec socat - "TCP:$1:$2"; fi
+if command -v bash >/dev/null 2>&1; then exec bash -c 'exec 3<>"/dev/tcp/$0/$1" || exit 1; cat <&3 & cat >&3' "$1" "$2"; fi
+echo "forwarding ports on localhost requires nc, socat or bash in the workspace" >&2
+exit 127`
+
+// ptyRequestMsg is the payload of a "pty-req" request, as defined in RFC 4254 section 6.2.
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// windowChangeMsg is the payload of a "window-change" request, as defined in RFC 4254 section 6.7.
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// envRequestMsg is the payload of an "env" request, as defined in RFC 4254 section 6.4.
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+// execRequestMsg is the payload of an "exec" request, as defined in RFC 4254 section 6.5.
+type execRequestMsg struct {
+	Command string
+}
+
+// subsystemRequestMsg is the payload of a "subsystem" request, as defined in RFC 4254 section 6.5.
+type subsystemRequestMsg struct {
+	Name string
+}
+
+// exitStatusMsg is the payload of an "exit-status" request, as defined in RFC 4254 section 6.10.
+type exitStatusMsg struct {
+	Status uint32
+}
+
+// directTCPIPMsg is the extra data of a "direct-tcpip" channel, as defined in RFC 4254 section 7.2.
+type directTCPIPMsg struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// execSession is an ssh session that runs its command in a container with docker exec.
+type execSession struct {
+	ctx         context.Context
+	docker      *client.Client
+	channel     ssh.Channel
+	containerID string
+	user        string
+	env         []string
+
+	// pty is the requested pseudo-terminal, or nil if none is requested.
+	pty *ptyRequestMsg
+
+	// execID is the ID of the docker exec instance running the command of the session,
+	// or empty if the command is not started yet.
+	execID string
+}
+
+// serveExec serves the ssh connection of an authenticated user in the given container
+// by running sessions with docker exec as the given user, until the connection is closed.
+// Unless rootAllowed, the connection is closed before anything runs if the user has uid 0.
+func (p *SSHProxy) serveExec(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, containerID string, user string, rootAllowed bool) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go ssh.DiscardRequests(reqs)
+
+	checked := rootAllowed
+	for newChannel := range chans {
+		// the uid of the user is only looked up once something is run as the user.
+		if !checked {
+			if err := p.checkNotRoot(ctx, containerID, user); err != nil {
+				fmt.Printf("refused ssh connection as %v: %v\n", user, err)
+				_ = newChannel.Reject(ssh.Prohibited, errRootUser.Error())
+				return
+			}
+			checked = true
+		}
+
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, channelReqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			s := &execSession{
+				ctx:         ctx,
+				docker:      p.docker,
+				channel:     channel,
+				containerID: containerID,
+				user:        user,
+				env:         []string{"USER=" + user, "LOGNAME=" + user},
+			}
+			go s.serve(channelReqs)
+
+		case "direct-tcpip":
+			go p.forwardTCP(ctx, newChannel, containerID, user)
+
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serve handles the requests of the session until the session is closed.
+func (s *execSession) serve(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		var ok bool
+		var run func()
+
+		switch req.Type {
+		case "pty-req":
+			var msg ptyRequestMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil && s.execID == "" {
+				s.pty = &msg
+				ok = true
+			}
+
+		case "window-change":
+			var msg windowChangeMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil && s.pty != nil {
+				s.pty.Columns, s.pty.Rows = msg.Columns, msg.Rows
+				if s.execID != "" {
+					_ = s.docker.ContainerExecResize(s.ctx, s.execID, container.ResizeOptions{
+						Height: uint(msg.Rows),
+						Width:  uint(msg.Columns),
+					})
+				}
+				ok = true
+			}
+
+		case "env":
+			var msg envRequestMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				s.env = append(s.env, msg.Name+"="+msg.Value)
+				ok = true
+			}
+
+		case "shell":
+			run = s.start(shellCommand(loginShellScript))
+
+		case "exec":
+			var msg execRequestMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				run = s.start(shellCommand(msg.Command))
+			}
+
+		case "subsystem":
+			var msg subsystemRequestMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil && msg.Name == "sftp" {
+				run = s.start(shellCommand(sftpServerScript))
+			}
+		}
+
+		if run != nil {
+			ok = true
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+		// the command is only run after the request is replied to,
+		// so that clients do not receive its output or exit status before the reply.
+		if run != nil {
+			go run()
+		}
+	}
+
+	if s.execID == "" {
+		_ = s.channel.Close()
+	}
+}
+
+// shellCommand returns a command that runs the given script with /bin/sh in the home directory of the user,
+// which is where ssh servers run commands.
+func shellCommand(script string) []string {
+	return []string{"/bin/sh", "-c", "cd ~ 2>/dev/null\n" + script}
+}
+
+// start starts the given command in the container and returns a function that forwards its input and output
+// until it exits, or nil if the command cannot be started. A session can only start one command.
+func (s *execSession) start(cmd []string) func() {
+	if s.execID != "" {
+		return nil
+	}
+
+	env := s.env
+	var consoleSize *[2]uint
+	if s.pty != nil {
+		env = append(env, "TERM="+s.pty.Term)
+		if s.pty.Rows > 0 && s.pty.Columns > 0 {
+			consoleSize = &[2]uint{uint(s.pty.Rows), uint(s.pty.Columns)}
+		}
+	}
+
+	res, err := s.docker.ContainerExecCreate(s.ctx, s.containerID, container.ExecOptions{
+		User:         s.user,
+		Tty:          s.pty != nil,
+		ConsoleSize:  consoleSize,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          env,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(s.channel.Stderr(), "%v\r\n", docker.CleanErrorMessage(err.Error()))
+		return nil
+	}
+
+	attached, err := s.docker.ContainerExecAttach(s.ctx, res.ID, container.ExecAttachOptions{
+		Tty:         s.pty != nil,
+		ConsoleSize: consoleSize,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(s.channel.Stderr(), "%v\r\n", docker.CleanErrorMessage(err.Error()))
+		return nil
+	}
+
+	s.execID = res.ID
+	tty := s.pty != nil
+
+	return func() {
+		s.run(attached, res.ID, tty)
+	}
+}
+
+// run forwards the input and output of the given exec instance until it exits,
+// then sends its exit status and closes the session.
+func (s *execSession) run(attached types.HijackedResponse, execID string, tty bool) {
+	defer attached.Close()
+	defer s.channel.Close()
+
+	go func() {
+		_, _ = io.Copy(attached.Conn, s.channel)
+		_ = attached.CloseWrite()
+	}()
+
+	// with a tty, docker sends the output as is. Otherwise, stdout and stderr are multiplexed into one stream.
+	if tty {
+		_, _ = io.Copy(s.channel, attached.Reader)
+	} else {
+		_, _ = stdcopy.StdCopy(s.channel, s.channel.Stderr(), attached.Reader)
+	}
+
+	_ = s.channel.CloseWrite()
+
+	inspect, err := s.docker.ContainerExecInspect(s.ctx, execID)
+	if err != nil {
+		return
+	}
+	_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{uint32(inspect.ExitCode)}))
+}
+
+// forwardTCP forwards a "direct-tcpip" channel, which is used by local port forwarding, to a port in the container.
+// Connections to the container itself are dialed from the host. Connections to localhost are relayed by a process
+// that runs in the container as the given user, so that they reach services that only listen on loopback,
+// as they would through an ssh server in the container.
+// Any other address is rejected, so that the proxy cannot be used to reach the network of the host.
+func (p *SSHProxy) forwardTCP(ctx context.Context, newChannel ssh.NewChannel, containerID string, user string) {
+	var msg directTCPIPMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	if isLoopback(msg.Host) {
+		p.relayTCP(ctx, newChannel, containerID, user, msg.Host, msg.Port)
+		return
+	}
+
+	inspect, err := p.docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, docker.CleanErrorMessage(err.Error()))
+		return
+	}
+
+	host, ok := containerAddress(inspect, msg.Host)
+	if !ok {
+		_ = newChannel.Reject(ssh.Prohibited, "only ports in the workspace can be forwarded")
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(msg.Port))), upstreamTimeout)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		if c, ok := conn.(*net.TCPConn); ok {
+			_ = c.CloseWrite()
+		}
+	}()
+	_, _ = io.Copy(channel, conn)
+}
+
+// relayTCP forwards a "direct-tcpip" channel to the given port of the given loopback host in the container
+// through relayScript, which runs in the container as the given user.
+func (p *SSHProxy) relayTCP(ctx context.Context, newChannel ssh.NewChannel, containerID string, user string, host string, port uint32) {
+	res, err := p.docker.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		User:         user,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", relayScript, "sh", host, strconv.Itoa(int(port))},
+	})
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, docker.CleanErrorMessage(err.Error()))
+		return
+	}
+
+	attached, err := p.docker.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{})
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, docker.CleanErrorMessage(err.Error()))
+		return
+	}
+	defer attached.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		_, _ = io.Copy(attached.Conn, channel)
+		_ = attached.CloseWrite()
+	}()
+
+	// the channel is already accepted once the relay can tell whether it connected, so failures can only be logged.
+	var stderr strings.Builder
+	_, _ = stdcopy.StdCopy(channel, &stderr, attached.Reader)
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		fmt.Printf("failed to forward %v in container %v: %v\n", net.JoinHostPort(host, strconv.Itoa(int(port))), containerID, msg)
+	}
+}
+
+// isLoopback returns whether host is localhost or a loopback address.
+func isLoopback(host string) bool {
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+// containerAddress returns the IP address of the given container that forwarding to host connects to,
+// and false if host is not an address or the host name of the container.
+func containerAddress(inspect types.ContainerJSON, host string) (string, bool) {
+	var addrs []string
+	if inspect.NetworkSettings != nil {
+		if inspect.NetworkSettings.IPAddress != "" {
+			addrs = append(addrs, inspect.NetworkSettings.IPAddress)
+		}
+		for _, n := range inspect.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				addrs = append(addrs, n.IPAddress)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return "", false
+	}
+
+	if inspect.Config != nil && host == inspect.Config.Hostname {
+		return addrs[0], true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return addr, true
+			}
+		}
+	}
+	return "", false
+}
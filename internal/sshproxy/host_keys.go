@@ -0,0 +1,108 @@
+package sshproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hostKeyFileName is the name of the host key that is generated when there are no host keys.
+const hostKeyFileName = "ssh_host_ed25519_key"
+
+// clientKeyFileName is the name of the key the proxy uses to log in to the ssh servers of workspaces.
+// It is kept alongside the host keys.
+const clientKeyFileName = "gateway_client_ed25519_key"
+
+// loadHostKeys reads all "ssh_host_*_key" private keys in dir, the same naming used by OpenSSH.
+// An ed25519 host key is generated and saved in dir if it does not contain any host key.
+func loadHostKeys(dir string) ([]ssh.Signer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "ssh_host_") || !strings.HasSuffix(name, "_key") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		return signers, nil
+	}
+
+	signer, err := generateKey(filepath.Join(dir, hostKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return []ssh.Signer{signer}, nil
+}
+
+// loadClientKey reads the client key of the proxy in dir, which is generated if it does not exist yet.
+func loadClientKey(dir string) (ssh.Signer, error) {
+	path := filepath.Join(dir, clientKeyFileName)
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return generateKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(b)
+}
+
+// generateKey generates an ed25519 key, and saves it to path in the OpenSSH format,
+// along with its public key at path.pub.
+func generateKey(path string) (ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
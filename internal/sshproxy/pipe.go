@@ -0,0 +1,126 @@
+package sshproxy
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync"
+)
+
+// pipe forwards channels and requests between the ssh connections a and b until either of them is closed.
+func pipe(a ssh.Conn, aChans <-chan ssh.NewChannel, aReqs <-chan *ssh.Request, b ssh.Conn, bChans <-chan ssh.NewChannel, bReqs <-chan *ssh.Request) {
+	go forwardChannels(aChans, b)
+	go forwardChannels(bChans, a)
+	go forwardGlobalRequests(aReqs, b)
+	go forwardGlobalRequests(bReqs, a)
+
+	closed := make(chan struct{}, 2)
+	go func() {
+		_ = a.Wait()
+		closed <- struct{}{}
+	}()
+	go func() {
+		_ = b.Wait()
+		closed <- struct{}{}
+	}()
+
+	<-closed
+	_ = a.Close()
+	_ = b.Close()
+}
+
+func forwardGlobalRequests(reqs <-chan *ssh.Request, dest ssh.Conn) {
+	for req := range reqs {
+		ok, payload, err := dest.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, payload)
+		}
+	}
+}
+
+func forwardChannels(chans <-chan ssh.NewChannel, dest ssh.Conn) {
+	for newChan := range chans {
+		go forwardChannel(newChan, dest)
+	}
+}
+
+// forwardChannel opens the same channel on dest, then forwards data and requests
+// between the two channels until they are closed.
+func forwardChannel(newChan ssh.NewChannel, dest ssh.Conn) {
+	destChan, destReqs, err := dest.OpenChannel(newChan.ChannelType(), newChan.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = newChan.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = newChan.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+
+	srcChan, srcReqs, err := newChan.Accept()
+	if err != nil {
+		_ = destChan.Close()
+		return
+	}
+
+	// a channel must not be closed while a request from it is being forwarded,
+	// otherwise the reply to the request is lost.
+	var srcMu, destMu sync.Mutex
+
+	go func() {
+		forwardChannelRequests(srcReqs, destChan, &srcMu)
+		// the source channel is closed
+		destMu.Lock()
+		_ = destChan.Close()
+		destMu.Unlock()
+	}()
+
+	go func() {
+		_, _ = io.Copy(destChan, srcChan)
+		_ = destChan.CloseWrite()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(srcChan, destChan)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(srcChan.Stderr(), destChan.Stderr())
+	}()
+	go func() {
+		// nothing can be written to the channel after EOF is sent, including stderr.
+		wg.Wait()
+		_ = srcChan.CloseWrite()
+	}()
+
+	// requests such as exit-status are sent before the destination channel is closed,
+	// so they have to be forwarded before the source channel is closed.
+	forwardChannelRequests(destReqs, srcChan, &destMu)
+	wg.Wait()
+	srcMu.Lock()
+	_ = srcChan.Close()
+	srcMu.Unlock()
+}
+
+// forwardChannelRequests forwards requests to dest until reqs is closed.
+// mu is held while a request is forwarded and replied to.
+func forwardChannelRequests(reqs <-chan *ssh.Request, dest ssh.Channel, mu *sync.Mutex) {
+	for req := range reqs {
+		mu.Lock()
+		ok, err := dest.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,92 @@
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Session describes an open ssh connection to a workspace.
+type Session struct {
+	ID string
+
+	// User is the user name in the workspace that the connection is logged in as.
+	User string
+
+	RemoteAddr string
+	StartedAt  time.Time
+
+	// BytesIn and BytesOut are the number of bytes received from and sent to the client, including ssh overhead.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// connection is an open ssh connection to a workspace.
+type connection struct {
+	id        string
+	conn      *ssh.ServerConn
+	user      string
+	counted   *countingConn
+	startedAt time.Time
+}
+
+// countingConn is a net.Conn that counts the bytes read from and written to it.
+type countingConn struct {
+	net.Conn
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+// Sessions returns the open ssh connections to the given workspace.
+func (p *SSHProxy) Sessions(workspaceName string) []Session {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(p.connections[workspaceName]))
+	for _, c := range p.connections[workspaceName] {
+		sessions = append(sessions, Session{
+			ID:         c.id,
+			User:       c.user,
+			RemoteAddr: c.conn.RemoteAddr().String(),
+			StartedAt:  c.startedAt,
+			BytesIn:    c.counted.bytesRead.Load(),
+			BytesOut:   c.counted.bytesWritten.Load(),
+		})
+	}
+
+	return sessions
+}
+
+// CloseSession closes the open ssh connection to the given workspace with the given session ID.
+// It returns false if there is no such connection.
+func (p *SSHProxy) CloseSession(workspaceName string, id string) bool {
+	p.mu.RLock()
+	var conn *ssh.ServerConn
+	for _, c := range p.connections[workspaceName] {
+		if c.id == id {
+			conn = c.conn
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	if conn == nil {
+		return false
+	}
+
+	_ = conn.Close()
+	return true
+}
@@ -1,51 +1,534 @@
 package sshproxy
 
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SSHProxy is an SSH gateway that lets users ssh into any workspace through a single port.
+// Users connect as "user+workspace", and are then connected to the ssh server of that workspace as "user".
+// Workspaces can also have ports of their own, on which users connect as "user".
+// Workspaces that do not run an ssh server are served by the proxy itself, by running sessions with docker exec.
 type SSHProxy struct {
-	// internalPorts maps internal docker ssh ports to the corresponding external ssh ports
-	// that users use to ssh into workspaces
-	internalPorts map[int]int
+	port     int
+	hostKeys []ssh.Signer
+	docker   *client.Client
+
+	// clientKey is the key used to log in to the ssh servers of workspaces
+	// when users authenticate with public keys.
+	clientKey ssh.Signer
+
+	// handshakeTimeout is how long clients have to authenticate before they are disconnected.
+	handshakeTimeout time.Duration
+
+	// mu guards all fields below, which are accessed from http handlers and ssh connections at the same time.
+	mu sync.RWMutex
+
+	// listener is the listener on the gateway port, or nil if the proxy is not started.
+	listener net.Listener
+
+	// closed is whether the proxy is closed, after which it no longer accepts connections.
+	closed bool
+
+	// routes maps workspace names to where ssh connections to the workspaces go
+	routes map[string]route
+
+	// listeners maps workspace names to the listeners on the ports of the workspaces
+	listeners map[string]net.Listener
 
-	connections map[int]*proxyConnection
+	// connections maps workspace names to the open ssh connections to the workspaces
+	connections map[string]map[*ssh.ServerConn]*connection
 
-	closedConnections chan *proxyConnection
+	// authorizedKeys maps the public keys that are allowed to log in, in the ssh wire format, to their scopes.
+	authorizedKeys map[string][]AuthorizedKey
 }
 
-func New() *SSHProxy {
-	p := &SSHProxy{
-		internalPorts:     map[int]int{},
-		connections:       map[int]*proxyConnection{},
-		closedConnections: make(chan *proxyConnection),
+// route is where ssh connections to a workspace go.
+type route struct {
+	workspaceName string
+	containerID   string
+
+	// internalPort is the port on the host that exposes port 22 of the container, or 0 if it is not exposed.
+	internalPort int
+}
+
+// userSeparator separates the user name from the workspace name in the user name of an ssh connection.
+const userSeparator = "+"
+
+// upstreamTimeout is how long the proxy waits for the ssh server of a workspace to respond.
+const upstreamTimeout = 10 * time.Second
+
+// defaultHandshakeTimeout is how long clients have to authenticate, like LoginGraceTime of OpenSSH.
+// Users may type a password in that time, so it is not short.
+const defaultHandshakeTimeout = 2 * time.Minute
+
+// maxAcceptDelay is the longest the proxy waits before accepting connections again after accepting fails.
+const maxAcceptDelay = time.Second
+
+// sshVersionPrefix is what ssh servers start the connection with.
+const sshVersionPrefix = "SSH-"
+
+var errInvalidUser = errors.New("user must be in the form of user" + userSeparator + "workspace")
+var errInvalidUserName = errors.New("user name must not be a uid or contain a group")
+var errWorkspaceNotFound = errors.New("workspace not found or not running ssh")
+var errUnauthorizedKey = errors.New("public key is not authorized for this user and workspace")
+var errRootUser = errors.New("keys can only log in as a user with uid 0 if root is in their scope")
+var errNoSSHServer = errors.New("workspace is not running an ssh server")
+var errPasswordUnsupported = errors.New("password authentication requires an ssh server in the workspace")
+var errProxyClosed = errors.New("ssh proxy is closed")
+
+// New creates an SSH proxy that listens on the given port, using the host keys in hostKeyDirectoryPath.
+// A host key is generated if the directory does not contain any.
+// docker is used to run sessions in workspaces that do not run an ssh server.
+func New(port int, hostKeyDirectoryPath string, docker *client.Client) (*SSHProxy, error) {
+	hostKeys, err := loadHostKeys(hostKeyDirectoryPath)
+	if err != nil {
+		return nil, err
 	}
 
-	go p.handleClosedConnections()
+	clientKey, err := loadClientKey(hostKeyDirectoryPath)
+	if err != nil {
+		return nil, err
+	}
 
-	return p
+	return &SSHProxy{
+		port:             port,
+		hostKeys:         hostKeys,
+		docker:           docker,
+		clientKey:        clientKey,
+		handshakeTimeout: defaultHandshakeTimeout,
+		routes:           map[string]route{},
+		listeners:        map[string]net.Listener{},
+		connections:      map[string]map[*ssh.ServerConn]*connection{},
+		authorizedKeys:   map[string][]AuthorizedKey{},
+	}, nil
 }
 
-func (p *SSHProxy) NewProxyEntryTo(toPort int) error {
-	c, err := newProxyConnection(toPort, p.closedConnections)
+// Start starts accepting ssh connections in the background.
+func (p *SSHProxy) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errProxyClosed
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.port))
 	if err != nil {
 		return err
 	}
+	p.listener = l
+
+	go p.serve(l, "")
+
+	return nil
+}
+
+// Close stops accepting ssh connections on all ports, and closes all open connections.
+// The proxy cannot be started again once it is closed.
+func (p *SSHProxy) Close() error {
+	p.mu.Lock()
+
+	p.closed = true
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+		p.listener = nil
+	}
+	for _, l := range p.listeners {
+		_ = l.Close()
+	}
+	clear(p.listeners)
+
+	var conns []*ssh.ServerConn
+	for _, c := range p.connections {
+		for conn := range c {
+			conns = append(conns, conn)
+		}
+	}
+	clear(p.connections)
+
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	return err
+}
 
-	go c.start()
+// ListenWorkspace accepts ssh connections to the given workspace on the given port,
+// replacing any port the workspace is already listening on.
+// Users connecting to the port log in as "user" instead of "user+workspace".
+func (p *SSHProxy) ListenWorkspace(workspaceName string, port int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errProxyClosed
+	}
+
+	if l, ok := p.listeners[workspaceName]; ok {
+		if l.Addr().(*net.TCPAddr).Port == port {
+			return nil
+		}
+		_ = l.Close()
+		delete(p.listeners, workspaceName)
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	p.listeners[workspaceName] = l
 
-	p.connections[toPort] = c
-	p.internalPorts[toPort] = c.externalPort
+	go p.serve(l, workspaceName)
 
 	return nil
 }
 
-func (p *SSHProxy) FindExternalPort(internalPort int) int {
-	if port, ok := p.internalPorts[internalPort]; ok {
-		return port
+// CloseWorkspace stops accepting ssh connections on the port of the given workspace.
+// Connections that are already established are kept.
+func (p *SSHProxy) CloseWorkspace(workspaceName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.listeners[workspaceName]; ok {
+		_ = l.Close()
+		delete(p.listeners, workspaceName)
+	}
+}
+
+// IsListening returns whether the given workspace is accepting ssh connections on its own port.
+func (p *SSHProxy) IsListening(workspaceName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.listeners[workspaceName]
+	return ok
+}
+
+// serve accepts ssh connections from the given listener until it is closed.
+// Connections are routed to workspaceName, or by user name if it is empty.
+func (p *SSHProxy) serve(l net.Listener, workspaceName string) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// accepting can fail temporarily, e.g. when there are too many open files,
+			// so it is retried with a backoff like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, maxAcceptDelay)
+			}
+			fmt.Printf("error accepting ssh connection at %v: %v; retrying in %v\n", l.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+		go p.handleConnection(conn, workspaceName)
 	}
-	return -1
 }
 
-func (p *SSHProxy) handleClosedConnections() {
-	for c := range p.closedConnections {
-		delete(p.internalPorts, c.internalPort)
-		delete(p.connections, c.internalPort)
+// Port returns the gateway port, on which users ssh into any workspace as "user+workspace".
+func (p *SSHProxy) Port() int {
+	return p.port
+}
+
+// AddEntry routes ssh connections for the given workspace to the given container,
+// replacing any existing route for the workspace.
+// Connections go to the ssh server behind internalPort, which is the port on the host exposing port 22 of the container,
+// or to sessions run with docker exec if there is no ssh server or internalPort is not positive.
+func (p *SSHProxy) AddEntry(workspaceName string, containerID string, internalPort int) {
+	if internalPort < 0 {
+		internalPort = 0
+	}
+	p.mu.Lock()
+	p.routes[workspaceName] = route{workspaceName, containerID, internalPort}
+	p.mu.Unlock()
+}
+
+// RemoveEntry stops routing ssh connections to the given workspace, and closes the open connections to it.
+func (p *SSHProxy) RemoveEntry(workspaceName string) {
+	p.mu.Lock()
+	delete(p.routes, workspaceName)
+	conns := p.connections[workspaceName]
+	delete(p.connections, workspaceName)
+	p.mu.Unlock()
+
+	for conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// trackConnection records an open connection that is routed with the given route,
+// so that it can be listed, and closed when the route is removed.
+// It returns false if the workspace is no longer routed this way, in which case the connection should be closed.
+func (p *SSHProxy) trackConnection(r route, c *connection) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if current, ok := p.routes[r.workspaceName]; !ok || current != r || p.closed {
+		return false
+	}
+
+	conns, ok := p.connections[r.workspaceName]
+	if !ok {
+		conns = map[*ssh.ServerConn]*connection{}
+		p.connections[r.workspaceName] = conns
+	}
+	conns[c.conn] = c
+
+	return true
+}
+
+// untrackConnection removes a connection recorded by trackConnection once it is closed.
+func (p *SSHProxy) untrackConnection(workspaceName string, conn *ssh.ServerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns, ok := p.connections[workspaceName]
+	if !ok {
+		return
+	}
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(p.connections, workspaceName)
+	}
+}
+
+// HasEntry returns whether ssh connections to the given workspace are routed.
+func (p *SSHProxy) HasEntry(workspaceName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.routes[workspaceName]
+	return ok
+}
+
+func (p *SSHProxy) handleConnection(conn net.Conn, workspaceName string) {
+	defer conn.Close()
+
+	// upstream is the connection to the ssh server of the workspace.
+	// With password authentication, it is established while the user is authenticated,
+	// because only the ssh server of the workspace can check the password.
+	var upstream *upstreamConn
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			u, err := p.dialUpstream(meta.User(), workspaceName, passwordAuth(string(password)))
+			if errors.Is(err, errNoSSHServer) {
+				return nil, errPasswordUnsupported
+			}
+			if err != nil {
+				return nil, err
+			}
+			if upstream != nil {
+				_ = upstream.conn.Close()
+			}
+			upstream = u
+			return nil, nil
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			userName, r, err := p.parseUser(meta.User(), workspaceName)
+			if err != nil {
+				return nil, err
+			}
+			if !p.isAuthorizedKey(key, userName, r.workspaceName) {
+				return nil, errUnauthorizedKey
+			}
+			if p.isAuthorizedKey(key, rootUser, r.workspaceName) {
+				return &ssh.Permissions{Extensions: map[string]string{extensionRootAllowed: ""}}, nil
+			}
+			return nil, nil
+		},
+	}
+	for _, key := range p.hostKeys {
+		config.AddHostKey(key)
+	}
+
+	counted := &countingConn{Conn: conn}
+	startedAt := time.Now()
+
+	// clients that never finish authenticating would otherwise hold the connection open forever.
+	_ = conn.SetDeadline(startedAt.Add(p.handshakeTimeout))
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(counted, config)
+	if err != nil {
+		if upstream != nil {
+			_ = upstream.conn.Close()
+		}
+		return
+	}
+	defer serverConn.Close()
+
+	// authenticated sessions can stay idle for as long as users want.
+	_ = conn.SetDeadline(time.Time{})
+
+	// the route is checked again, because the workspace may have been stopped or removed during authentication.
+	userName, r, err := p.parseUser(serverConn.User(), workspaceName)
+	if err != nil || !p.trackConnection(r, &connection{
+		id:        uuid.NewString(),
+		conn:      serverConn,
+		user:      userName,
+		counted:   counted,
+		startedAt: startedAt,
+	}) {
+		if upstream != nil {
+			_ = upstream.conn.Close()
+		}
+		return
+	}
+	defer p.untrackConnection(r.workspaceName, serverConn)
+
+	if upstream == nil {
+		var rootAllowed bool
+		if serverConn.Permissions != nil {
+			_, rootAllowed = serverConn.Permissions.Extensions[extensionRootAllowed]
+		}
+
+		// the user is authenticated with a public key, which cannot be passed on to the workspace,
+		// so the proxy logs in with its own key instead, which is only authorized for the users logged in as.
+		if r.internalPort != 0 {
+			if !rootAllowed {
+				if err = p.checkNotRoot(context.Background(), r.containerID, userName); err != nil {
+					fmt.Printf("refused ssh connection as %v: %v\n", serverConn.User(), err)
+					return
+				}
+			}
+			if err = p.authorizeClientKey(context.Background(), r.containerID, userName); err != nil {
+				fmt.Printf("error authorizing the gateway key for %v: %v\n", serverConn.User(), err)
+			}
+		}
+		upstream, err = p.dialUpstream(serverConn.User(), workspaceName, []ssh.AuthMethod{ssh.PublicKeys(p.clientKey)})
+		if errors.Is(err, errNoSSHServer) {
+			p.serveExec(serverConn, chans, reqs, r.containerID, userName, rootAllowed)
+			return
+		}
+		if err != nil {
+			fmt.Printf("error connecting to workspace ssh as %v: %v\n", serverConn.User(), err)
+			return
+		}
+	}
+
+	pipe(serverConn, chans, reqs, upstream.conn, upstream.chans, upstream.reqs)
+}
+
+// upstreamConn is an ssh connection to the ssh server of a workspace.
+type upstreamConn struct {
+	conn  ssh.Conn
+	chans <-chan ssh.NewChannel
+	reqs  <-chan *ssh.Request
+}
+
+// dialUpstream connects to the ssh server of the workspace of the given user name
+// and authenticates as the user with the given auth methods.
+// See parseUser for how the user name is interpreted.
+// errNoSSHServer is returned if the workspace does not run an ssh server.
+func (p *SSHProxy) dialUpstream(user string, workspaceName string, auth []ssh.AuthMethod) (*upstreamConn, error) {
+	userName, r, err := p.parseUser(user, workspaceName)
+	if err != nil {
+		return nil, err
+	}
+	if r.internalPort == 0 {
+		return nil, errNoSSHServer
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", r.internalPort)
+	c, err := net.DialTimeout("tcp", addr, upstreamTimeout)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, errNoSSHServer
+		}
+		return nil, err
+	}
+
+	// docker accepts connections to published ports even if nothing listens in the container,
+	// so whether there is an ssh server is only known once it sends its version.
+	br := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(upstreamTimeout))
+	version, err := br.Peek(len(sshVersionPrefix))
+	if err != nil || string(version) != sshVersionPrefix {
+		_ = c.Close()
+		return nil, errNoSSHServer
+	}
+	_ = c.SetReadDeadline(time.Time{})
+
+	conn, chans, reqs, err := ssh.NewClientConn(&bufferedConn{c, br}, addr, &ssh.ClientConfig{
+		User: userName,
+		Auth: auth,
+		// the ssh server runs in a workspace container on this host, and is only reachable from this host.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         upstreamTimeout,
+	})
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return &upstreamConn{conn, chans, reqs}, nil
+}
+
+// parseUser finds the user name in the workspace and the route to the workspace.
+// If workspaceName is empty, user is split as "user+workspace", otherwise user is the user name in workspaceName.
+func (p *SSHProxy) parseUser(user string, workspaceName string) (string, route, error) {
+	userName := user
+	if workspaceName == "" {
+		i := strings.LastIndex(user, userSeparator)
+		if i <= 0 || i == len(user)-1 {
+			return "", route{}, errInvalidUser
+		}
+		userName, workspaceName = user[:i], user[i+1:]
+	}
+	if !IsValidUserName(userName) {
+		return "", route{}, errInvalidUserName
+	}
+
+	p.mu.RLock()
+	r, ok := p.routes[workspaceName]
+	p.mu.RUnlock()
+	if !ok {
+		return "", route{}, errWorkspaceNotFound
+	}
+
+	return userName, r, nil
+}
+
+// bufferedConn is a net.Conn that reads through a buffered reader, so that data can be peeked before it is read.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// passwordAuth returns auth methods that log in with the given password.
+func passwordAuth(password string) []ssh.AuthMethod {
+	return []ssh.AuthMethod{
+		ssh.Password(password),
+		ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}),
 	}
 }
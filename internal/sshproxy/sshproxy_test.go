@@ -0,0 +1,502 @@
+package sshproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPassword = "password"
+
+// startTestSSHServer starts an ssh server that accepts testPassword for any user,
+// and answers every command with the name of the user. It returns the port of the server.
+func startTestSSHServer(t *testing.T) int {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != testPassword {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range channelReqs {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				_, _ = channel.Write([]byte(serverConn.User()))
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{0}))
+				return
+			}
+		}()
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func newTestProxy(t *testing.T) *SSHProxy {
+	t.Helper()
+	p, err := New(freePort(t), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+func dialProxy(port int, user string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(testPassword)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func runCommand(c *ssh.Client) (string, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	out, err := s.Output("whoami")
+	return string(out), err
+}
+
+// waitClosed returns whether the given client is disconnected within a second.
+func waitClosed(c *ssh.Client) bool {
+	closed := make(chan struct{})
+	go func() {
+		_ = c.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestProxyRoutesByUserName(t *testing.T) {
+	p := newTestProxy(t)
+	p.AddEntry("ws", "container", startTestSSHServer(t))
+
+	c, err := dialProxy(p.Port(), "alice+ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	out, err := runCommand(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "alice" {
+		t.Errorf("expected to be logged in as alice, got %q", out)
+	}
+
+	if _, err = dialProxy(p.Port(), "alice+other"); err == nil {
+		t.Error("expected connection to a workspace without an entry to fail")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	p, err := New(freePort(t), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.handshakeTimeout = 100 * time.Millisecond
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client never sends its version, so the handshake never finishes.
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Error("expected the proxy to close a connection that does not authenticate")
+	}
+}
+
+func TestAuthorizedKeyScope(t *testing.T) {
+	p := newTestProxy(t)
+	// workspaces without an ssh server are served by the proxy, which is enough to authenticate.
+	p.AddEntry("ws", "container", 0)
+	p.AddEntry("other", "container", 0)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuthorizedKeys([]AuthorizedKey{{Key: signer.PublicKey(), Users: []string{"alice"}, Workspaces: []string{"ws"}}})
+
+	tests := []struct {
+		user    string
+		allowed bool
+	}{
+		{"alice+ws", true},
+		{"root+ws", false},
+		{"alice+other", false},
+	}
+
+	for _, tt := range tests {
+		c, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), &ssh.ClientConfig{
+			User:            tt.user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			_ = c.Close()
+		}
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("expected logging in as %v to be allowed: %v, got error %v", tt.user, tt.allowed, err)
+		}
+	}
+
+	p.SetAuthorizedKeys([]AuthorizedKey{{Key: signer.PublicKey(), Users: []string{AnyName}, Workspaces: []string{AnyName}}})
+	tests = []struct {
+		user    string
+		allowed bool
+	}{
+		{"bob+other", true},
+		// root has to be in the scope by name.
+		{"root+other", false},
+		// docker exec runs uids and groups as given, which would be root under another name.
+		{"0+other", false},
+		{"1000+other", false},
+		{"0:0+other", false},
+		{"nobody:0+other", false},
+		{"bob:bob+other", false},
+	}
+
+	for _, tt := range tests {
+		c, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), &ssh.ClientConfig{
+			User:            tt.user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			_ = c.Close()
+		}
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("expected logging in as %v with any user to be allowed: %v, got error %v", tt.user, tt.allowed, err)
+		}
+	}
+}
+
+func TestContainerAddress(t *testing.T) {
+	inspect := types.ContainerJSON{
+		Config: &container.Config{Hostname: "ws"},
+		NetworkSettings: &types.NetworkSettings{
+			DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: "172.17.0.2"},
+			Networks: map[string]*network.EndpointSettings{
+				"other": {IPAddress: "172.18.0.3"},
+			},
+		},
+	}
+
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		// connections to loopback are relayed in the container instead, since they cannot reach it from the host.
+		{"localhost", "", false},
+		{"127.0.0.1", "", false},
+		{"::1", "", false},
+		{"ws", "172.17.0.2", true},
+		{"172.18.0.3", "172.18.0.3", true},
+		{"172.17.0.1", "", false},
+		{"169.254.169.254", "", false},
+		{"example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := containerAddress(inspect, tt.host)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("containerAddress(%q) = %q, %v, expected %q, %v", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRemoveEntryClosesConnections(t *testing.T) {
+	p := newTestProxy(t)
+	p.AddEntry("ws", "container", startTestSSHServer(t))
+	p.AddEntry("other", "container", startTestSSHServer(t))
+
+	c, err := dialProxy(p.Port(), "alice+ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	other, err := dialProxy(p.Port(), "alice+other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	p.RemoveEntry("ws")
+
+	if !waitClosed(c) {
+		t.Error("expected connection to removed workspace to be closed")
+	}
+	if _, err = runCommand(other); err != nil {
+		t.Errorf("expected connection to other workspace to be kept, got %v", err)
+	}
+	if p.HasEntry("ws") {
+		t.Error("expected entry to be removed")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	p := newTestProxy(t)
+	p.AddEntry("ws", "container", startTestSSHServer(t))
+
+	c, err := dialProxy(p.Port(), "alice+ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = runCommand(c); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := p.Sessions("ws")
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %v", sessions)
+	}
+	s := sessions[0]
+	if s.User != "alice" || s.RemoteAddr != c.LocalAddr().String() || s.BytesIn == 0 || s.BytesOut == 0 {
+		t.Errorf("unexpected session %+v", s)
+	}
+
+	if p.CloseSession("other", s.ID) {
+		t.Error("expected session not to be found in another workspace")
+	}
+	if !p.CloseSession("ws", s.ID) {
+		t.Fatal("expected session to be closed")
+	}
+	if !waitClosed(c) {
+		t.Error("expected client to be disconnected")
+	}
+}
+
+func TestCloseWorkspaceStopsListening(t *testing.T) {
+	p := newTestProxy(t)
+	p.AddEntry("ws", "container", startTestSSHServer(t))
+
+	port := freePort(t)
+	if err := p.ListenWorkspace("ws", port); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dialProxy(port, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p.CloseWorkspace("ws")
+
+	if p.IsListening("ws") {
+		t.Error("expected workspace to stop listening")
+	}
+	if _, err = net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+		t.Error("expected port to be closed")
+	}
+	if _, err = runCommand(c); err != nil {
+		t.Errorf("expected open connection to be kept, got %v", err)
+	}
+
+	// the port can be bound again, e.g. when the workspace is started again
+	if err = p.ListenWorkspace("ws", port); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := dialProxy(port, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+}
+
+func TestClose(t *testing.T) {
+	p := newTestProxy(t)
+	p.AddEntry("ws", "container", startTestSSHServer(t))
+
+	port := freePort(t)
+	if err := p.ListenWorkspace("ws", port); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dialProxy(p.Port(), "alice+ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitClosed(c) {
+		t.Error("expected open connections to be closed")
+	}
+	for _, port := range []int{p.Port(), port} {
+		if _, err = net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+			t.Errorf("expected port %d to be closed", port)
+		}
+	}
+	if err = p.ListenWorkspace("ws", port); !errors.Is(err, errProxyClosed) {
+		t.Errorf("expected errProxyClosed, got %v", err)
+	}
+}
+
+// TestConcurrentAccess changes entries and listeners while connections are made, to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	p := newTestProxy(t)
+	internalPort := startTestSSHServer(t)
+
+	workspaces := []string{"a", "b", "c"}
+	ports := make(map[string]int, len(workspaces))
+	for _, w := range workspaces {
+		ports[w] = freePort(t)
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range workspaces {
+		w := w
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				p.AddEntry(w, "container", internalPort)
+				_ = p.ListenWorkspace(w, ports[w])
+				p.SetAuthorizedKeys(nil)
+				_ = p.HasEntry(w)
+				_ = p.IsListening(w)
+				time.Sleep(time.Millisecond)
+				p.RemoveEntry(w)
+				p.CloseWorkspace(w)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				// connections fail while the workspace is removed, which is expected.
+				if c, err := dialProxy(p.Port(), "alice+"+w); err == nil {
+					_, _ = runCommand(c)
+					_ = c.Close()
+				}
+				if c, err := dialProxy(ports[w], "alice"); err == nil {
+					_, _ = runCommand(c)
+					_ = c.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.routes) != 0 || len(p.listeners) != 0 {
+		t.Errorf("expected all entries and listeners to be removed, got %v and %v", p.routes, p.listeners)
+	}
+	// connections are untracked when they are closed, which may happen after their workspace is removed.
+	for w, conns := range p.connections {
+		if len(conns) > 0 {
+			t.Logf("%d connections to %v are still closing", len(conns), w)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package template
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+	"path"
+	"sort"
+	"strings"
+)
+
+const defaultDockerfilePath = "Dockerfile"
+
+const dockerignorePath = ".dockerignore"
+
+// defaultFileMode is the mode of a template file if none is specified.
+const defaultFileMode = 0644
+
+// newBuildContext packs the given template files into a tar archive that can be used as a docker build context.
+// Files excluded by .dockerignore are left out, except for the Dockerfile and .dockerignore itself.
+func newBuildContext(files []*templateFile, dockerfilePath string) (*bytes.Buffer, error) {
+	var dockerfile, dockerignore *templateFile
+	for _, f := range files {
+		switch f.FilePath {
+		case dockerfilePath:
+			dockerfile = f
+		case dockerignorePath:
+			dockerignore = f
+		}
+	}
+	if dockerfile == nil || len(dockerfile.Content) == 0 {
+		return nil, &errBadTemplate{
+			message: fmt.Sprintf("template does not contain %v", dockerfilePath),
+		}
+	}
+
+	var pm *patternmatcher.PatternMatcher
+	if dockerignore != nil {
+		patterns, err := ignorefile.ReadAll(bytes.NewReader(dockerignore.Content))
+		if err != nil {
+			return nil, &errBadTemplate{
+				message: fmt.Sprintf("invalid .dockerignore: %v", err),
+			}
+		}
+
+		pm, err = patternmatcher.New(patterns)
+		if err != nil {
+			return nil, &errBadTemplate{
+				message: fmt.Sprintf("invalid .dockerignore: %v", err),
+			}
+		}
+	}
+
+	sorted := make([]*templateFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].FilePath < sorted[j].FilePath
+	})
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, f := range sorted {
+		if !isValidTemplateFilePath(f.FilePath) {
+			return nil, &errBadTemplate{
+				message: fmt.Sprintf("invalid file path %v", f.FilePath),
+			}
+		}
+
+		if pm != nil && f != dockerfile && f != dockerignore {
+			excluded, err := pm.MatchesOrParentMatches(f.FilePath)
+			if err != nil {
+				return nil, err
+			}
+			if excluded {
+				continue
+			}
+		}
+
+		mode := f.Mode
+		if mode == 0 {
+			mode = defaultFileMode
+		}
+
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.FilePath,
+			Mode:     mode,
+			Size:     int64(len(f.Content)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = tw.Write(f.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// isValidTemplateFilePath checks whether the given path is a clean, relative path that stays in the template.
+func isValidTemplateFilePath(p string) bool {
+	return p != "" &&
+		p == path.Clean(p) &&
+		!path.IsAbs(p) &&
+		p != ".." &&
+		!strings.HasPrefix(p, "../")
+}
@@ -0,0 +1,135 @@
+package template
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// buildJob is a build that is running in the background, independent of the request that started it.
+// Clients can attach to and detach from its output at any time.
+type buildJob struct {
+	build *templateBuild
+
+	// ctx is cancelled when the build is cancelled.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// buildContext is the tar archive sent to docker when the build starts.
+	buildContext   []byte
+	dockerfilePath string
+
+	// done is closed once the build has finished and its final status is saved.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// log is the full output of the build so far
+	log strings.Builder
+
+	// changed is closed and replaced every time the build outputs something or finishes.
+	changed chan struct{}
+
+	finished bool
+}
+
+// buildJobs keeps track of builds that are currently running.
+type buildJobs struct {
+	mu   sync.Mutex
+	jobs map[uuid.UUID]*buildJob
+}
+
+func newBuildJobs() *buildJobs {
+	return &buildJobs{
+		jobs: make(map[uuid.UUID]*buildJob),
+	}
+}
+
+func newBuildJob(build *templateBuild, buildContext []byte, dockerfilePath string) *buildJob {
+	// the build must not be tied to the context of the request that started it.
+	ctx, cancel := context.WithCancel(context.Background())
+	return &buildJob{
+		build:          build,
+		ctx:            ctx,
+		cancel:         cancel,
+		buildContext:   buildContext,
+		dockerfilePath: dockerfilePath,
+		done:           make(chan struct{}),
+		changed:        make(chan struct{}),
+	}
+}
+
+func (jobs *buildJobs) add(job *buildJob) {
+	jobs.mu.Lock()
+	jobs.jobs[job.build.ID] = job
+	jobs.mu.Unlock()
+}
+
+func (jobs *buildJobs) remove(id uuid.UUID) {
+	jobs.mu.Lock()
+	delete(jobs.jobs, id)
+	jobs.mu.Unlock()
+}
+
+func (jobs *buildJobs) find(id uuid.UUID) (*buildJob, bool) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	job, ok := jobs.jobs[id]
+	return job, ok
+}
+
+// write appends text to the output of the build and wakes up all attached clients.
+func (job *buildJob) write(text string) {
+	job.mu.Lock()
+	job.log.WriteString(text)
+	close(job.changed)
+	job.changed = make(chan struct{})
+	job.mu.Unlock()
+}
+
+// finish marks the output of the build as complete.
+func (job *buildJob) finish() {
+	job.mu.Lock()
+	job.finished = true
+	close(job.changed)
+	job.changed = make(chan struct{})
+	job.mu.Unlock()
+}
+
+// follow calls onOutput with the output of the build, starting at offset, until the build finishes or ctx is done.
+// Cancelling ctx only detaches from the build; the build itself keeps running.
+func (job *buildJob) follow(ctx context.Context, offset int, onOutput func(string) error) error {
+	for {
+		job.mu.Lock()
+		log := job.log.String()
+		changed := job.changed
+		finished := job.finished
+		job.mu.Unlock()
+
+		if offset < len(log) {
+			if err := onOutput(log[offset:]); err != nil {
+				return err
+			}
+			offset = len(log)
+		}
+
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// output returns the output of the build so far.
+func (job *buildJob) output() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.log.String()
+}
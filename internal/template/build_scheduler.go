@@ -0,0 +1,116 @@
+package template
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// buildScheduler decides when queued builds start.
+// At most maxConcurrentBuilds builds run at the same time, and at most one build of each template runs at a time,
+// so that builds of the same template never race to update its images.
+type buildScheduler struct {
+	mu sync.Mutex
+
+	maxConcurrentBuilds int
+
+	// queue contains the jobs that are waiting to start, in the order they are queued.
+	queue []*buildJob
+
+	// active contains the jobs that are running, keyed by the ID of their template.
+	active map[uuid.UUID]*buildJob
+
+	// start is called in a new goroutine for every job that is started.
+	start func(job *buildJob)
+}
+
+func newBuildScheduler(maxConcurrentBuilds int, start func(job *buildJob)) *buildScheduler {
+	if maxConcurrentBuilds < 1 {
+		maxConcurrentBuilds = 1
+	}
+	return &buildScheduler{
+		maxConcurrentBuilds: maxConcurrentBuilds,
+		active:              make(map[uuid.UUID]*buildJob),
+		start:               start,
+	}
+}
+
+// enqueue adds the given job to the end of the queue, and starts it right away if possible.
+func (s *buildScheduler) enqueue(job *buildJob) {
+	s.mu.Lock()
+	s.queue = append(s.queue, job)
+	started := s.schedule()
+	s.mu.Unlock()
+
+	s.startAll(started)
+}
+
+// dequeue removes the given job from the queue. false is returned if the job is not in the queue,
+// which means it has already started.
+func (s *buildScheduler) dequeue(job *buildJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, j := range s.queue {
+		if j == job {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// finish marks the given job as done, and starts the jobs that were waiting for it.
+func (s *buildScheduler) finish(job *buildJob) {
+	s.mu.Lock()
+	if s.active[job.build.TemplateID] == job {
+		delete(s.active, job.build.TemplateID)
+	}
+	started := s.schedule()
+	s.mu.Unlock()
+
+	s.startAll(started)
+}
+
+// position returns the position of the build with the given ID in the queue, starting from 1.
+// 0 is returned if the build is not queued.
+func (s *buildScheduler) position(buildID uuid.UUID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, job := range s.queue {
+		if job.build.ID == buildID {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// schedule moves as many jobs as possible from the queue to active, and returns the moved jobs.
+// Jobs of templates that are already being built are skipped so that they do not hold up other templates.
+// s.mu must be held.
+func (s *buildScheduler) schedule() []*buildJob {
+	var started []*buildJob
+
+	queue := s.queue[:0]
+	for _, job := range s.queue {
+		_, isTemplateActive := s.active[job.build.TemplateID]
+		if len(s.active) < s.maxConcurrentBuilds && !isTemplateActive {
+			s.active[job.build.TemplateID] = job
+			started = append(started, job)
+		} else {
+			queue = append(queue, job)
+		}
+	}
+	s.queue = queue
+
+	return started
+}
+
+func (s *buildScheduler) startAll(jobs []*buildJob) {
+	for _, job := range jobs {
+		go s.start(job)
+	}
+}
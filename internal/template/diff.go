@@ -0,0 +1,198 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change in a unified diff.
+const diffContextLines = 3
+
+// maxDiffCells limits the size of the table used to compute a diff.
+// Files that are too large to diff line by line are shown as fully replaced.
+const maxDiffCells = 16 * 1024 * 1024
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns the difference between a and b in the unified diff format,
+// or an empty string if they are identical.
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// aLine and bLine are the line numbers of ops[i] in a and b
+	aLine, bLine := 1, 1
+	i := 0
+	for i < len(ops) {
+		if ops[i].kind == ' ' {
+			aLine++
+			bLine++
+			i++
+			continue
+		}
+
+		// found a change; include the preceding context
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		aStart := aLine - (i - start)
+		bStart := bLine - (i - start)
+
+		// extend the hunk until there are more than 2*diffContextLines unchanged lines in a row
+		end := i
+		unchanged := 0
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind == ' ' {
+				unchanged++
+				if unchanged > 2*diffContextLines {
+					break
+				}
+			} else {
+				unchanged = 0
+				end = j
+			}
+		}
+		end += diffContextLines
+		if end >= len(ops) {
+			end = len(ops) - 1
+		}
+
+		var aCount, bCount int
+		var body strings.Builder
+		for _, op := range ops[start : end+1] {
+			switch op.kind {
+			case ' ':
+				aCount++
+				bCount++
+			case '-':
+				aCount++
+			case '+':
+				bCount++
+			}
+			body.WriteByte(op.kind)
+			body.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		sb.WriteString(body.String())
+
+		for _, op := range ops[i : end+1] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		i = end + 1
+	}
+
+	return sb.String()
+}
+
+// diffLines computes the shortest edit script that turns a into b using the longest common subsequence of lines.
+func diffLines(a, b []string) []diffOp {
+	// strip the common prefix and suffix to keep the table small
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(ma), len(mb)
+
+	if n*m > maxDiffCells {
+		for _, l := range ma {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range mb {
+			ops = append(ops, diffOp{'+', l})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of ma[i:] and mb[j:]
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < n && j < m {
+			switch {
+			case ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, diffOp{'-', ma[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j]})
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			ops = append(ops, diffOp{'-', ma[i]})
+		}
+		for ; j < m; j++ {
+			ops = append(ops, diffOp{'+', mb[j]})
+		}
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	return ops
+}
+
+// splitLines splits content into lines that keep their newline,
+// so that a last line without a newline differs from the same line with one.
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range refers to the line before the hunk
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
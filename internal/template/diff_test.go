@@ -0,0 +1,73 @@
+package template
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "identical",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "insertion",
+			a:    "a\nb\nc\n",
+			b:    "a\nb\nx\nc\n",
+			want: "@@ -1,3 +1,4 @@\n a\n b\n+x\n c\n",
+		},
+		{
+			name: "deletion",
+			a:    "a\nb\nc\nd\n",
+			b:    "a\nc\nd\n",
+			want: "@@ -1,4 +1,3 @@\n a\n-b\n c\n d\n",
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "a\nb\n",
+			want: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "deleted file",
+			a:    "a\n",
+			b:    "",
+			want: "@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "trailing newline removed",
+			a:    "a\nb\n",
+			b:    "a\nb",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			name: "trailing newline added",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n",
+			b:    "1\nX\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\nY\n15\n",
+			want: "@@ -1,5 +1,5 @@\n 1\n-2\n+X\n 3\n 4\n 5\n" +
+				"@@ -11,5 +11,5 @@\n 11\n 12\n 13\n-14\n+Y\n 15\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want != "" {
+				want = "--- a/file\n+++ b/file\n" + want
+			}
+			if got := unifiedDiff("a/file", "b/file", []byte(tt.a), []byte(tt.b)); got != want {
+				t.Errorf("expected diff\n%s\ngot\n%s", want, got)
+			}
+		})
+	}
+}
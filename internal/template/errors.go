@@ -1,5 +1,7 @@
 package template
 
+import "strings"
+
 type errBadTemplate struct {
 	message string
 }
@@ -7,3 +9,14 @@ type errBadTemplate struct {
 func (err *errBadTemplate) Error() string {
 	return err.message
 }
+
+type errImageInUse struct {
+	workspaces []string
+}
+
+func (err *errImageInUse) Error() string {
+	if len(err.workspaces) == 0 {
+		return "Image is used by a container"
+	}
+	return "Image is used by workspace(s): " + strings.Join(err.workspaces, ", ")
+}
@@ -1,14 +1,15 @@
 package template
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"tesseract/internal/apierror"
-	"tesseract/internal/service"
 )
 
 type createTemplateRequestBody struct {
@@ -23,8 +24,14 @@ type postTemplateRequestBody struct {
 	Description *string        `json:"description"`
 	Files       []templateFile `json:"files"`
 
-	ImageTag  *string            `json:"imageTag"`
-	BuildArgs map[string]*string `json:"buildArgs"`
+	ImageTag   *string            `json:"imageTag"`
+	BuildArgs  map[string]*string `json:"buildArgs"`
+	Dockerfile *string            `json:"dockerfile"`
+}
+
+type renameTemplateFileRequestBody struct {
+	// Path is the new path of the file
+	Path string `json:"path"`
 }
 
 func fetchAllTemplates(c echo.Context) error {
@@ -150,10 +157,15 @@ func buildTemplate(c echo.Context, body postTemplateRequestBody) error {
 		return err
 	}
 
-	outputChan, err := mgr.buildTemplate(ctx, template, buildTemplateOptions{
+	opts := buildTemplateOptions{
 		imageTag:  *body.ImageTag,
 		buildArgs: body.BuildArgs,
-	})
+	}
+	if body.Dockerfile != nil {
+		opts.dockerfilePath = *body.Dockerfile
+	}
+
+	build, err := mgr.buildTemplate(ctx, template, opts)
 	if err != nil {
 		var errBadTemplate *errBadTemplate
 		if errors.As(err, &errBadTemplate) {
@@ -162,24 +174,7 @@ func buildTemplate(c echo.Context, body postTemplateRequestBody) error {
 		return err
 	}
 
-	w := c.Response()
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	for o := range outputChan {
-		switch o := o.(type) {
-		case error:
-			return err
-		case string:
-			if _, err = w.Write([]byte(o)); err != nil {
-				return err
-			}
-			w.Flush()
-		}
-	}
-
-	return nil
+	return c.JSON(http.StatusOK, build)
 }
 
 func deleteTemplate(c echo.Context) error {
@@ -200,7 +195,7 @@ func deleteTemplate(c echo.Context) error {
 func fetchTemplateFile(c echo.Context) error {
 	mgr := templateManagerFrom(c)
 	templateName := c.Param("templateName")
-	filePath := c.Param("filePath")
+	filePath := templateFilePath(c)
 
 	file, err := mgr.findTemplateFile(c.Request().Context(), templateName, filePath)
 	if err != nil {
@@ -216,14 +211,19 @@ func fetchTemplateFile(c echo.Context) error {
 func updateTemplateFile(c echo.Context) error {
 	mgr := templateManagerFrom(c)
 	templateName := c.Param("templateName")
-	filePath := c.Param("filePath")
+	filePath := templateFilePath(c)
+
+	mode, err := fileModeFromQuery(c)
+	if err != nil {
+		return err
+	}
 
 	newContent, err := io.ReadAll(c.Request().Body)
 	if err != nil {
 		return err
 	}
 
-	err = mgr.updateTemplateFile(c.Request().Context(), templateName, filePath, newContent)
+	err = mgr.updateTemplateFile(c.Request().Context(), templateName, filePath, newContent, mode, c.QueryParam("message"))
 	if err != nil {
 		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateFileNotFound) {
 			return echo.NewHTTPError(http.StatusNotFound)
@@ -234,21 +234,382 @@ func updateTemplateFile(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
-func fetchAllTemplateImages(c echo.Context) error {
-	db := service.Database(c)
+func createTemplateFile(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	templateName := c.Param("templateName")
+	filePath := templateFilePath(c)
+
+	if isReservedTemplateFilePath(filePath) {
+		return echo.NewHTTPError(http.StatusBadRequest, "reserved file path")
+	}
+
+	mode, err := fileModeFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	content, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	file, err := mgr.createTemplateFile(c.Request().Context(), templateName, filePath, content, mode, c.QueryParam("message"))
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errTemplateFileExists) {
+			return apierror.New(http.StatusConflict, "TEMPLATE_FILE_EXISTS", err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, file)
+}
+
+func renameTemplateFile(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	templateName := c.Param("templateName")
+	filePath := templateFilePath(c)
+
+	var body renameTemplateFileRequestBody
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	if !isValidTemplateFilePath(body.Path) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid file path")
+	}
+	if isReservedTemplateFilePath(body.Path) {
+		return echo.NewHTTPError(http.StatusBadRequest, "reserved file path")
+	}
+
+	err := mgr.renameTemplateFile(c.Request().Context(), templateName, filePath, body.Path, c.QueryParam("message"))
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateFileNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errTemplateFileExists) {
+			return apierror.New(http.StatusConflict, "TEMPLATE_FILE_EXISTS", err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func deleteTemplateFile(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	templateName := c.Param("templateName")
+	filePath := templateFilePath(c)
+
+	err := mgr.deleteTemplateFile(c.Request().Context(), templateName, filePath, c.QueryParam("message"))
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateFileNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func fetchTemplateRevisions(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	revisions, err := mgr.findTemplateRevisions(c.Request().Context(), c.Param("templateName"))
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, revisions)
+}
+
+func fetchTemplateRevision(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	revisionID, err := uuid.Parse(c.Param("revisionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	revision, err := mgr.findTemplateRevision(c.Request().Context(), c.Param("templateName"), revisionID)
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateRevisionNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, revision)
+}
+
+// fetchTemplateRevisionDiff compares a revision against the revision given in the "base" query parameter,
+// or against the previous revision if it is absent.
+func fetchTemplateRevisionDiff(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	revisionID, err := uuid.Parse(c.Param("revisionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	var baseID uuid.UUID
+	if base := c.QueryParam("base"); base != "" {
+		baseID, err = uuid.Parse(base)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid base revision")
+		}
+	}
 
-	var images []Image
-	err := db.NewSelect().Model(&images).Scan(c.Request().Context())
+	diffs, err := mgr.diffTemplateRevisions(c.Request().Context(), c.Param("templateName"), revisionID, baseID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.JSON(http.StatusOK, make([]Image, 0))
+		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateRevisionNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
 		}
 		return err
 	}
 
-	if len(images) == 0 {
-		return c.JSON(http.StatusOK, make([]Image, 0))
+	return c.JSON(http.StatusOK, diffs)
+}
+
+func restoreTemplateRevision(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	revisionID, err := uuid.Parse(c.Param("revisionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	template, err := mgr.restoreTemplateRevision(c.Request().Context(), c.Param("templateName"), revisionID)
+	if err != nil {
+		if errors.Is(err, errTemplateNotFound) || errors.Is(err, errTemplateRevisionNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, template)
+}
+
+// fetchAllBuilds returns all builds, or only builds of the template given in the "template" query parameter.
+func fetchAllBuilds(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	builds, err := mgr.findBuilds(c.Request().Context(), c.QueryParam("template"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, builds)
+}
+
+func fetchBuild(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	buildID, err := uuid.Parse(c.Param("buildId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	build, err := mgr.findBuild(c.Request().Context(), buildID, false)
+	if err != nil {
+		if errors.Is(err, errBuildNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, build)
+}
+
+// fetchBuildLog returns the log of a build as plain text.
+// Only the last n lines are returned if the "tail" query parameter is set to n.
+// If the "follow" query parameter is true, the output of a running build is streamed until the build ends.
+// Closing the connection detaches from the build without cancelling it.
+func fetchBuildLog(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+	ctx := c.Request().Context()
+
+	buildID, err := uuid.Parse(c.Param("buildId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	tail := -1
+	if t := c.QueryParam("tail"); t != "" {
+		tail, err = strconv.Atoi(t)
+		if err != nil || tail < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid tail")
+		}
+	}
+
+	follow := false
+	if f := c.QueryParam("follow"); f != "" {
+		follow, err = strconv.ParseBool(f)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid follow")
+		}
+	}
+
+	build, err := mgr.findBuild(ctx, buildID, !follow)
+	if err != nil {
+		if errors.Is(err, errBuildNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	c.Response().Header().Set("X-Build-Status", string(build.Status))
+
+	if !follow {
+		log := build.Log
+		if tail >= 0 {
+			log = lastLines(log, tail)
+		}
+		return c.String(http.StatusOK, log)
+	}
+
+	w := c.Response()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	first := true
+	return mgr.followBuild(ctx, buildID, func(text string) error {
+		if first && tail >= 0 {
+			text = lastLines(text, tail)
+		}
+		first = false
+		if _, err := w.Write([]byte(text)); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	})
+}
+
+func fetchBuildQueue(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	queue, err := mgr.findBuildQueue(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, queue)
+}
+
+// cancelBuild stops a queued or running build and returns the cancelled build.
+func cancelBuild(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	buildID, err := uuid.Parse(c.Param("buildId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	build, err := mgr.cancelBuild(c.Request().Context(), buildID)
+	if err != nil {
+		if errors.Is(err, errBuildNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errBuildNotRunning) {
+			return apierror.New(http.StatusConflict, "BUILD_NOT_RUNNING", err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, build)
+}
+
+// fileModeFromQuery parses the optional "mode" query parameter, an octal permission string such as "755".
+// Zero is returned if the parameter is absent.
+func fileModeFromQuery(c echo.Context) (int64, error) {
+	m := c.QueryParam("mode")
+	if m == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseInt(m, 8, 64)
+	if err != nil || mode <= 0 || mode > 0777 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid file mode")
+	}
+	return mode, nil
+}
+
+func fetchAllTemplateImages(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	images, err := mgr.findImages(c.Request().Context())
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, images)
 }
+
+func fetchTemplateImage(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	img, err := mgr.findImage(c.Request().Context(), c.Param("imageId"))
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, img)
+}
+
+func deleteTemplateImage(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	err := mgr.deleteImage(c.Request().Context(), c.Param("imageId"))
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		var errImageInUse *errImageInUse
+		if errors.As(err, &errImageInUse) {
+			return apierror.New(http.StatusConflict, "IMAGE_IN_USE", err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func pruneTemplateImages(c echo.Context) error {
+	mgr := templateManagerFrom(c)
+
+	report, err := mgr.pruneImages(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// lastLines returns the last n lines of s.
+func lastLines(s string, n int) string {
+	if n == 0 {
+		return ""
+	}
+	end := len(s)
+	if strings.HasSuffix(s, "\n") {
+		end--
+	}
+	i := end
+	for ; n > 0 && i > 0; n-- {
+		i = strings.LastIndexByte(s[:i], '\n')
+		if i < 0 {
+			return s
+		}
+	}
+	if n > 0 {
+		return s
+	}
+	return s[i+1:]
+}
@@ -0,0 +1,387 @@
+package template
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/uptrace/bun"
+	"slices"
+	"strings"
+)
+
+const (
+	// labelTemplateName is the label that marks an image as built by tesseract.
+	// Its value is the name of the template the image is built from.
+	labelTemplateName = "tesseract.template"
+
+	// labelBuildID is the label containing the ID of the build that produced an image.
+	labelBuildID = "tesseract.build"
+)
+
+var errImageNotFound = errors.New("image not found")
+
+// findImages returns all images built from templates, along with their details from docker.
+func (mgr *templateManager) findImages(ctx context.Context) ([]Image, error) {
+	var images []Image
+	err := mgr.db.NewSelect().Model(&images).
+		Relation("Template", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]Image, 0), nil
+		}
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return make([]Image, 0), nil
+	}
+
+	if err = mgr.inspectImages(ctx, images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// findImage returns the image with the given ID along with its details from docker.
+func (mgr *templateManager) findImage(ctx context.Context, imageID string) (*Image, error) {
+	var img Image
+	err := mgr.db.NewSelect().Model(&img).
+		Relation("Template", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Where("image_id = ?", imageID).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errImageNotFound
+		}
+		return nil, err
+	}
+
+	images := []Image{img}
+	if err = mgr.inspectImages(ctx, images); err != nil {
+		return nil, err
+	}
+
+	return &images[0], nil
+}
+
+// inspectImages fills in the details of the given images from docker,
+// and marks images that no longer exist in docker as orphaned.
+func (mgr *templateManager) inspectImages(ctx context.Context, images []Image) error {
+	usage, err := mgr.findImageUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	inspected := make(map[string]*types.ImageInspect)
+	for i := range images {
+		img := &images[i]
+		if img.Template != nil {
+			img.TemplateName = img.Template.Name
+		}
+
+		info, ok := inspected[img.ImageID]
+		if !ok {
+			res, _, err := mgr.dockerClient.ImageInspectWithRaw(ctx, img.ImageID)
+			if err != nil && !errdefs.IsNotFound(err) {
+				return err
+			}
+			if err == nil {
+				info = &res
+			}
+			inspected[img.ImageID] = info
+		}
+
+		if info == nil {
+			img.Orphaned = true
+		} else {
+			img.Size = info.Size
+			img.CreatedAt = info.Created
+			img.Layers = info.RootFS.Layers
+			if info.Config != nil {
+				img.Labels = info.Config.Labels
+			}
+		}
+
+		img.Workspaces = usage.workspaces[img.ImageID]
+		if img.Workspaces == nil {
+			img.Workspaces = make([]string, 0)
+		}
+	}
+
+	return nil
+}
+
+// imageUsage describes which containers use which images.
+type imageUsage struct {
+	// containers maps image IDs to the number of containers using them.
+	containers map[string]int
+
+	// workspaces maps image IDs to the names of the workspaces using them.
+	workspaces map[string][]string
+}
+
+// findImageUsage finds the images used by all containers, including workspaces.
+func (mgr *templateManager) findImageUsage(ctx context.Context) (*imageUsage, error) {
+	containers, err := mgr.dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &imageUsage{
+		containers: make(map[string]int),
+		workspaces: make(map[string][]string),
+	}
+
+	imageIDs := make(map[string]string, len(containers))
+	for _, c := range containers {
+		usage.containers[c.ImageID]++
+		imageIDs[c.ID] = c.ImageID
+	}
+
+	if len(containers) == 0 {
+		return usage, nil
+	}
+
+	containerIDs := make([]string, 0, len(imageIDs))
+	for id := range imageIDs {
+		containerIDs = append(containerIDs, id)
+	}
+
+	var workspaces []struct {
+		Name        string
+		ContainerID string
+	}
+	err = mgr.db.NewSelect().
+		Table("workspaces").
+		Column("name", "container_id").
+		Where("container_id IN (?)", bun.In(containerIDs)).
+		Order("name ASC").
+		Scan(ctx, &workspaces)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	for _, w := range workspaces {
+		imageID := imageIDs[w.ContainerID]
+		usage.workspaces[imageID] = append(usage.workspaces[imageID], w.Name)
+	}
+
+	return usage, nil
+}
+
+// deleteImage removes the image with the given ID from docker and from tesseract.
+// The image is only removed if no container uses it.
+func (mgr *templateManager) deleteImage(ctx context.Context, imageID string) error {
+	exists, err := mgr.db.NewSelect().
+		Table("template_images").
+		Where("image_id = ?", imageID).
+		Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errImageNotFound
+	}
+
+	usage, err := mgr.findImageUsage(ctx)
+	if err != nil {
+		return err
+	}
+	if usage.containers[imageID] > 0 {
+		return &errImageInUse{workspaces: usage.workspaces[imageID]}
+	}
+
+	if err = mgr.removeImageTags(ctx, imageID); err != nil {
+		if errdefs.IsConflict(err) {
+			return &errImageInUse{}
+		}
+		return err
+	}
+
+	_, err = mgr.db.NewDelete().
+		Table("template_images").
+		Where("image_id = ?", imageID).
+		Exec(ctx)
+	return err
+}
+
+// removeImageTags removes the tags that tesseract gave the image with the given ID, which removes the image from docker
+// once it has no tags left. Tags that other programs gave the image are kept, and so is the image in that case.
+// Images are not removed by force, so that docker refuses to remove images that are still in use.
+func (mgr *templateManager) removeImageTags(ctx context.Context, imageID string) error {
+	inspect, _, err := mgr.dockerClient.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(inspect.RepoTags) == 0 {
+		_, err = mgr.dockerClient.ImageRemove(ctx, imageID, image.RemoveOptions{PruneChildren: true})
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	var tags []string
+	err = mgr.db.NewSelect().
+		Table("template_images").
+		Column("image_tag").
+		Where("image_id = ?", imageID).
+		Scan(ctx, &tags)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	for _, tag := range inspect.RepoTags {
+		if !slices.ContainsFunc(tags, func(t string) bool { return normalizeImageTag(t) == tag }) {
+			continue
+		}
+		// a tag is only removed while it refers to the image, so that a newer image with the same tag is kept.
+		_, err = mgr.dockerClient.ImageRemove(ctx, tag, image.RemoveOptions{PruneChildren: true})
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeImageTag adds the "latest" tag to image references without a tag, e.g. "my-template" becomes
+// "my-template:latest", which is how docker lists the tags of images.
+func normalizeImageTag(tag string) string {
+	name := tag[strings.LastIndex(tag, "/")+1:]
+	if strings.Contains(name, ":") || strings.Contains(name, "@") {
+		return tag
+	}
+	return tag + ":latest"
+}
+
+// pruneImages removes dangling images that are built by tesseract,
+// as well as images that tesseract knows about but no longer exist in docker.
+func (mgr *templateManager) pruneImages(ctx context.Context) (*imagePruneReport, error) {
+	report := &imagePruneReport{
+		DeletedImages: make([]string, 0),
+	}
+
+	res, err := mgr.dockerClient.ImagesPrune(ctx, filters.NewArgs(
+		filters.Arg("dangling", "true"),
+		filters.Arg("label", labelTemplateName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range res.ImagesDeleted {
+		if d.Deleted != "" {
+			report.DeletedImages = append(report.DeletedImages, d.Deleted)
+		}
+	}
+	report.SpaceReclaimed = res.SpaceReclaimed
+
+	// images built before builds were labelled can only be found through template_images.
+	dangling, err := mgr.dockerClient.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("dangling", "true")),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := mgr.findImageUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range dangling {
+		if usage.containers[img.ID] > 0 {
+			continue
+		}
+
+		exists, err := mgr.db.NewSelect().
+			Table("template_images").
+			Where("image_id = ?", img.ID).
+			Exists(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		_, err = mgr.dockerClient.ImageRemove(ctx, img.ID, image.RemoveOptions{PruneChildren: true})
+		if err != nil {
+			if errdefs.IsNotFound(err) || errdefs.IsConflict(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		report.DeletedImages = append(report.DeletedImages, img.ID)
+		if img.Size > 0 {
+			report.SpaceReclaimed += uint64(img.Size)
+		}
+	}
+
+	var images []Image
+	if err = mgr.db.NewSelect().Model(&images).Scan(ctx); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	checked := make(map[string]bool)
+	for _, img := range images {
+		if checked[img.ImageID] {
+			continue
+		}
+		checked[img.ImageID] = true
+
+		_, _, err := mgr.dockerClient.ImageInspectWithRaw(ctx, img.ImageID)
+		if err == nil {
+			continue
+		}
+		if !errdefs.IsNotFound(err) {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		res, err := tx.NewDelete().
+			Table("template_images").
+			Where("image_id = ?", img.ImageID).
+			Exec(ctx)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		report.RemovedOrphans += int(n)
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return report, nil
+}
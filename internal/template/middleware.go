@@ -2,19 +2,24 @@ package template
 
 import (
 	"net/http"
+	"net/url"
 	"tesseract/internal/service"
 
 	"github.com/labstack/echo/v4"
 )
 
+const keyTemplateFilePath = "templateFilePath"
+
 func newTemplateManagerMiddleware(service service.Services) echo.MiddlewareFunc {
-	mgr := templateManager{
+	mgr := &templateManager{
 		db:           service.Database,
 		dockerClient: service.DockerClient,
+		buildJobs:    newBuildJobs(),
 	}
+	mgr.buildScheduler = newBuildScheduler(service.Config.MaxConcurrentBuilds, mgr.runBuild)
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			c.Set("templateManager", &mgr)
+			c.Set("templateManager", mgr)
 			return next(c)
 		}
 	}
@@ -32,14 +37,24 @@ func validateTemplateName(next echo.HandlerFunc) echo.HandlerFunc {
 
 func validateTemplateFilePath(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		filePath := c.Param("filePath")
-		if filePath == "" {
+		filePath, err := url.PathUnescape(c.Param("*"))
+		if err != nil || filePath == "" {
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
+		if !isValidTemplateFilePath(filePath) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid file path")
+		}
+		c.Set(keyTemplateFilePath, filePath)
 		return next(c)
 	}
 }
 
+// templateFilePath returns the path of the template file in the current request,
+// which may contain slashes for files in nested directories.
+func templateFilePath(c echo.Context) string {
+	return c.Get(keyTemplateFilePath).(string)
+}
+
 func templateManagerFrom(c echo.Context) *templateManager {
 	return c.Get("templateManager").(*templateManager)
 }
@@ -12,8 +12,24 @@ func DefineRoutes(g *echo.Group, services service.Services) {
 	g.PUT("/templates/:templateName", createTemplate, validateTemplateName)
 	g.POST("/templates/:templateName", updateOrBuildTemplate, validateTemplateName)
 	g.DELETE("/templates/:templateName", deleteTemplate, validateTemplateName)
-	g.GET("/templates/:templateName/:filePath", fetchTemplateFile, validateTemplateName, validateTemplateFilePath)
-	g.POST("/templates/:templateName/:filePath", updateTemplateFile, validateTemplateName, validateTemplateFilePath)
+	g.GET("/templates/:templateName/*", fetchTemplateFile, validateTemplateName, validateTemplateFilePath)
+	g.PUT("/templates/:templateName/*", createTemplateFile, validateTemplateName, validateTemplateFilePath)
+	g.POST("/templates/:templateName/*", updateTemplateFile, validateTemplateName, validateTemplateFilePath)
+	g.PATCH("/templates/:templateName/*", renameTemplateFile, validateTemplateName, validateTemplateFilePath)
+	g.DELETE("/templates/:templateName/*", deleteTemplateFile, validateTemplateName, validateTemplateFilePath)
+	// revisions are not under /templates/:templateName, where any path is a template file.
+	g.GET("/template-revisions/:templateName", fetchTemplateRevisions, validateTemplateName)
+	g.GET("/template-revisions/:templateName/:revisionId", fetchTemplateRevision, validateTemplateName)
+	g.GET("/template-revisions/:templateName/:revisionId/diff", fetchTemplateRevisionDiff, validateTemplateName)
+	g.POST("/template-revisions/:templateName/:revisionId/restore", restoreTemplateRevision, validateTemplateName)
 	g.GET("/template-images", fetchAllTemplateImages)
+	g.POST("/template-images/prune", pruneTemplateImages)
+	g.GET("/template-images/:imageId", fetchTemplateImage)
+	g.DELETE("/template-images/:imageId", deleteTemplateImage)
+	g.GET("/builds", fetchAllBuilds)
+	g.GET("/builds/queue", fetchBuildQueue)
+	g.GET("/builds/:buildId", fetchBuild)
+	g.DELETE("/builds/:buildId", cancelBuild)
+	g.GET("/builds/:buildId/log", fetchBuildLog)
 	g.GET("/base-templates", fetchBaseTemplates)
 }
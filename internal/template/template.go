@@ -1,14 +1,32 @@
 package template
 
 import (
+	"context"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
 	"regexp"
+	"strings"
+	"tesseract/internal/service"
+	"time"
 )
 
 // templateNameRegex is a regex to test whether a given template name is valid
 var templateNameRegex = regexp.MustCompile("^[\\w-]+$")
 
+// reservedTemplateFilePaths are names that cannot be used as the first segment of a template file path
+// because they are routes under /templates/:templateName.
+var reservedTemplateFilePaths = []string{"revisions"}
+
+func isReservedTemplateFilePath(p string) bool {
+	first, _, _ := strings.Cut(p, "/")
+	for _, r := range reservedTemplateFilePaths {
+		if first == r {
+			return true
+		}
+	}
+	return false
+}
+
 type template struct {
 	bun.BaseModel `bun:"table:templates,alias:template"`
 
@@ -29,6 +47,96 @@ type templateFile struct {
 	TemplateID uuid.UUID `bun:"type:uuid" json:"-"`
 	FilePath   string    `json:"path"`
 	Content    []byte    `bun:"type:blob" json:"content"`
+
+	// Mode is the permission bits of the file in the build context, e.g. 0755 for an executable script.
+	Mode int64 `json:"mode"`
+}
+
+// templateRevision is an immutable snapshot of all the files in a template.
+// A new revision is created every time the files of a template change.
+type templateRevision struct {
+	bun.BaseModel `bun:"table:template_revisions,alias:template_revision"`
+
+	// ID is a UUIDv7, so revisions sort in the order they are created.
+	ID         uuid.UUID `bun:",type:uuid,pk" json:"id"`
+	TemplateID uuid.UUID `bun:",type:uuid" json:"-"`
+	Message    string    `json:"message"`
+	CreatedAt  string    `json:"createdAt"`
+
+	Files []*templateRevisionFile `bun:"rel:has-many,join:id=revision_id" json:"files,omitempty"`
+}
+
+type templateRevisionFile struct {
+	bun.BaseModel `bun:"table:template_revision_files,alias:template_revision_file"`
+
+	RevisionID uuid.UUID `bun:",type:uuid,pk" json:"-"`
+	FilePath   string    `bun:",pk" json:"path"`
+	Content    []byte    `bun:"type:blob" json:"content"`
+	Mode       int64     `json:"mode"`
+}
+
+// templateFileDiff describes how a file changed between two revisions.
+type templateFileDiff struct {
+	Path   string         `json:"path"`
+	Status fileDiffStatus `json:"status"`
+
+	// Diff is the change in the unified diff format.
+	Diff string `json:"diff"`
+}
+
+type fileDiffStatus string
+
+const (
+	fileDiffStatusAdded    fileDiffStatus = "added"
+	fileDiffStatusDeleted  fileDiffStatus = "deleted"
+	fileDiffStatusModified fileDiffStatus = "modified"
+)
+
+// templateBuild records a build of a template, including its full log.
+type templateBuild struct {
+	bun.BaseModel `bun:"table:template_builds,alias:template_build"`
+
+	// ID is a UUIDv7, so builds sort in the order they are queued.
+	ID         uuid.UUID          `bun:",type:uuid,pk" json:"id"`
+	TemplateID uuid.UUID          `bun:",type:uuid" json:"-"`
+	RevisionID *uuid.UUID         `bun:",type:uuid" json:"revisionId,omitempty"`
+	ImageTag   string             `json:"imageTag"`
+	ImageID    string             `json:"imageId,omitempty"`
+	BuildArgs  map[string]*string `json:"buildArgs,omitempty"`
+	QueuedAt   string             `json:"queuedAt"`
+	StartedAt  string             `json:"startedAt,omitempty"`
+	FinishedAt string             `bun:",nullzero" json:"finishedAt,omitempty"`
+	Status     buildStatus        `json:"status"`
+	Log        string             `json:"-"`
+
+	// TemplateName is the name of the template that is built.
+	TemplateName string `bun:"-" json:"templateName"`
+
+	// QueuePosition is the position of a queued build in the build queue, starting from 1.
+	QueuePosition int `bun:"-" json:"queuePosition,omitempty"`
+
+	Template *template `bun:"rel:belongs-to,join:template_id=id" json:"-"`
+}
+
+type buildStatus string
+
+const (
+	buildStatusQueued    buildStatus = "queued"
+	buildStatusRunning   buildStatus = "running"
+	buildStatusSucceeded buildStatus = "succeeded"
+	buildStatusFailed    buildStatus = "failed"
+	buildStatusCancelled buildStatus = "cancelled"
+)
+
+// buildQueue is the state of the build queue.
+type buildQueue struct {
+	MaxConcurrentBuilds int `json:"maxConcurrentBuilds"`
+
+	// Running contains the builds that are running.
+	Running []templateBuild `json:"running"`
+
+	// Queued contains the builds that are waiting to start, in the order they will be considered.
+	Queued []templateBuild `json:"queued"`
 }
 
 type Image struct {
@@ -37,4 +145,52 @@ type Image struct {
 	TemplateID uuid.UUID `bun:"type:uuid" json:"-"`
 	ImageTag   string    `json:"imageTag"`
 	ImageID    string    `json:"imageId"`
+
+	// RevisionID is the ID of the template revision the image is built from.
+	RevisionID *uuid.UUID `bun:",type:uuid" json:"revisionId,omitempty"`
+
+	// TemplateName is the name of the template the image is built from.
+	TemplateName string `bun:"-" json:"templateName,omitempty"`
+
+	// Size is the size of the image in bytes, as reported by docker.
+	Size int64 `bun:"-" json:"size,omitempty"`
+
+	// CreatedAt is when docker created the image.
+	CreatedAt string `bun:"-" json:"createdAt,omitempty"`
+
+	// Layers contains the digests of the layers of the image.
+	Layers []string `bun:"-" json:"layers,omitempty"`
+
+	Labels map[string]string `bun:"-" json:"labels,omitempty"`
+
+	// Orphaned is true if the image no longer exists in docker.
+	Orphaned bool `bun:"-" json:"orphaned"`
+
+	// Workspaces contains the names of the workspaces that use the image.
+	Workspaces []string `bun:"-" json:"workspaces"`
+
+	Template *template `bun:"rel:belongs-to,join:template_id=id" json:"-"`
+}
+
+// imagePruneReport describes what was removed when images are pruned.
+type imagePruneReport struct {
+	// DeletedImages contains the IDs of the images that were removed from docker.
+	DeletedImages []string `json:"deletedImages"`
+
+	// RemovedOrphans is the number of orphaned images that were removed from tesseract.
+	RemovedOrphans int `json:"removedOrphans"`
+
+	SpaceReclaimed uint64 `json:"spaceReclaimed"`
+}
+
+// SyncAll marks builds that were still queued or running when tesseract last stopped as failed,
+// since they are no longer tracked.
+func SyncAll(ctx context.Context, services service.Services) error {
+	_, err := services.Database.NewUpdate().Table("template_builds").
+		Set("status = ?", buildStatusFailed).
+		Set("finished_at = ?", time.Now().Format(time.RFC3339)).
+		Set("log = log || ?", "build interrupted because tesseract stopped\n").
+		Where("status IN (?)", bun.In([]buildStatus{buildStatusQueued, buildStatusRunning})).
+		Exec(ctx)
+	return err
 }
@@ -1,7 +1,6 @@
 package template
 
 import (
-	"archive/tar"
 	"bufio"
 	"bytes"
 	"context"
@@ -11,9 +10,10 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/docker/docker/errdefs"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"sort"
+	"strings"
 	"tesseract/internal/docker"
 	"time"
 )
@@ -21,6 +21,11 @@ import (
 type templateManager struct {
 	db           *bun.DB
 	dockerClient *client.Client
+
+	// buildJobs contains the builds that are currently queued or running.
+	buildJobs *buildJobs
+
+	buildScheduler *buildScheduler
 }
 
 type createTemplateOptions struct {
@@ -40,15 +45,24 @@ type updateTemplateOptions struct {
 }
 
 type buildTemplateOptions struct {
-	tx        *bun.Tx
 	imageTag  string
 	buildArgs map[string]*string
+
+	// dockerfilePath is the path of the Dockerfile in the template. Defaults to defaultDockerfilePath.
+	dockerfilePath string
 }
 
 var errTemplateNotFound = errors.New("template not found")
 var errTemplateExists = errors.New("template already exists")
 var errBaseTemplateNotFound = errors.New("base template not found")
 var errTemplateFileNotFound = errors.New("template file not found")
+var errTemplateFileExists = errors.New("template file already exists")
+var errTemplateRevisionNotFound = errors.New("template revision not found")
+var errBuildNotFound = errors.New("build not found")
+var errBuildNotRunning = errors.New("build is not queued or running")
+
+// buildLogFlushInterval is how often the output of a running build is saved to the database.
+const buildLogFlushInterval = time.Second
 
 func (mgr *templateManager) beginTx(ctx context.Context) (bun.Tx, error) {
 	tx, err := mgr.db.BeginTx(ctx, nil)
@@ -144,13 +158,15 @@ func (mgr *templateManager) createTemplate(ctx context.Context, opts createTempl
 	}
 	dockerfile := templateFile{
 		TemplateID: id,
-		FilePath:   "Dockerfile",
+		FilePath:   defaultDockerfilePath,
 		Content:    []byte(baseTemplate.Content),
+		Mode:       defaultFileMode,
 	}
 	readme := templateFile{
 		TemplateID: id,
 		FilePath:   "README.md",
 		Content:    make([]byte, 0),
+		Mode:       defaultFileMode,
 	}
 	files := []*templateFile{&dockerfile, &readme}
 
@@ -162,6 +178,11 @@ func (mgr *templateManager) createTemplate(ctx context.Context, opts createTempl
 		return nil, err
 	}
 
+	if _, err = mgr.createRevision(ctx, tx, id, "Create template"); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
 	t.Files = files
 	t.FileMap = make(map[string]*templateFile, len(files))
 	for _, f := range t.Files {
@@ -230,143 +251,254 @@ func (mgr *templateManager) updateTemplate(ctx context.Context, name string, opt
 	return &template, nil
 }
 
-func (mgr *templateManager) buildTemplate(ctx context.Context, template *template, opts buildTemplateOptions) (<-chan any, error) {
-	tx := opts.tx
-	autoCommit := false
-	if tx == nil {
-		_tx, err := mgr.db.BeginTx(ctx, nil)
-		if err != nil {
-			return nil, err
-		}
-		autoCommit = true
-		tx = &_tx
-	}
-
+// buildTemplate queues a build of the given template and returns the build record immediately.
+// The build runs in the background once the build scheduler starts it, and is owned by the server,
+// so it keeps running after ctx is done. It can be stopped with cancelBuild,
+// and its output can be followed with followBuild.
+// The build and its output are recorded in template_builds.
+func (mgr *templateManager) buildTemplate(ctx context.Context, template *template, opts buildTemplateOptions) (*templateBuild, error) {
 	if len(template.Files) == 0 {
 		return nil, errors.New("cannot build docker template: no files in template")
 	}
 
-	buf := new(bytes.Buffer)
-	tw := tar.NewWriter(buf)
-	defer tw.Close()
-
-	var dockerfile []byte
-	for _, file := range template.Files {
-		if file.FilePath == "Dockerfile" {
-			dockerfile = file.Content
-			break
-		}
-	}
-	if len(dockerfile) == 0 {
-		return nil, errors.New("cannot build docker template: template does not contain Dockerfile")
+	revisionID, err := mgr.ensureRevision(ctx, mgr.db, template.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	h := tar.Header{
-		Name: "Dockerfile",
-		Size: int64(len(dockerfile)),
+	dockerfilePath := opts.dockerfilePath
+	if dockerfilePath == "" {
+		dockerfilePath = defaultDockerfilePath
 	}
-	err := tw.WriteHeader(&h)
+
+	buildContext, err := newBuildContext(template.Files, dockerfilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = tw.Write(dockerfile)
+	buildID, err := uuid.NewV7()
 	if err != nil {
 		return nil, err
 	}
 
-	r := bytes.NewReader(buf.Bytes())
+	build := &templateBuild{
+		ID:           buildID,
+		TemplateID:   template.ID,
+		RevisionID:   &revisionID,
+		ImageTag:     opts.imageTag,
+		BuildArgs:    opts.buildArgs,
+		QueuedAt:     time.Now().Format(time.RFC3339),
+		Status:       buildStatusQueued,
+		TemplateName: template.Name,
+	}
+	if _, err = mgr.db.NewInsert().Model(build).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	// the copy is returned because job.build is updated by the build goroutine.
+	result := *build
 
+	job := newBuildJob(build, buildContext.Bytes(), dockerfilePath)
+	mgr.buildJobs.add(job)
+	mgr.buildScheduler.enqueue(job)
+
+	result.QueuePosition = mgr.buildScheduler.position(build.ID)
+
+	return &result, nil
+}
+
+// runBuild runs the docker build of the given job, which has just been started by the build scheduler,
+// then records the result of the build.
+func (mgr *templateManager) runBuild(job *buildJob) {
+	ctx := job.ctx
+	build := job.build
+
+	// ctx is cancelled when the build is cancelled, but the build should still be recorded.
+	dbCtx := context.WithoutCancel(ctx)
+
+	if ctx.Err() != nil {
+		job.write("build cancelled\n")
+		mgr.endBuildJob(job, buildStatusCancelled, "build cancelled\n")
+		return
+	}
+
+	build.Status = buildStatusRunning
+	build.StartedAt = time.Now().Format(time.RFC3339)
+	_, err := mgr.db.NewUpdate().Model(build).
+		Set("status = ?", build.Status).
+		Set("started_at = ?", build.StartedAt).
+		WherePK().
+		Exec(dbCtx)
+	if err != nil {
+		job.write(err.Error() + "\n")
+		mgr.endBuildJob(job, buildStatusFailed, err.Error()+"\n")
+		return
+	}
+
+	r := bytes.NewReader(job.buildContext)
 	res, err := mgr.dockerClient.ImageBuild(ctx, r, types.ImageBuildOptions{
-		Context:   r,
-		Tags:      []string{opts.imageTag},
-		BuildArgs: opts.buildArgs,
+		Context:    r,
+		Dockerfile: job.dockerfilePath,
+		Tags:       []string{build.ImageTag},
+		BuildArgs:  build.BuildArgs,
+		Labels: map[string]string{
+			labelTemplateName: build.TemplateName,
+			labelBuildID:      build.ID.String(),
+		},
 	})
 	if err != nil {
-		if errdefs.IsInvalidParameter(err) {
-			return nil, &errBadTemplate{
-				// the docker sdk returns an error message that looks like:
-				// "Error response from daemon: dockerfile parse error on line 1: unknown instruction: FR (did you mean FROM?)"
-				// we don't want the "error response..." part because it is meaningless
-				message: docker.CleanErrorMessage(err.Error()),
-			}
+		status := buildStatusFailed
+		if ctx.Err() != nil {
+			status = buildStatusCancelled
 		}
-		return nil, err
+		// the docker sdk returns an error message that looks like:
+		// "Error response from daemon: dockerfile parse error on line 1: unknown instruction: FR (did you mean FROM?)"
+		// we don't want the "error response..." part because it is meaningless
+		text := docker.CleanErrorMessage(err.Error()) + "\n"
+		job.write(text)
+		mgr.endBuildJob(job, status, text)
+		return
 	}
 
-	outputChan := make(chan any)
+	body := res.Body
+	defer body.Close()
+
+	// pendingLog is the part of the log that is not yet saved in the database
+	var pendingLog strings.Builder
+	lastFlush := time.Now()
 
-	go func() {
-		defer close(outputChan)
+	output := func(text string) {
+		job.write(text)
+		pendingLog.WriteString(text)
+		if time.Since(lastFlush) >= buildLogFlushInterval {
+			if err := mgr.appendBuildLog(dbCtx, build.ID, pendingLog.String()); err == nil {
+				pendingLog.Reset()
+			}
+			lastFlush = time.Now()
+		}
+	}
 
-		scanner := bufio.NewScanner(res.Body)
-		var imageID string
+	scanner := bufio.NewScanner(body)
+	var imageID string
+	status := buildStatusSucceeded
 
-		for scanner.Scan() {
-			t := scanner.Text()
+scan:
+	for scanner.Scan() {
+		t := scanner.Text()
 
-			fmt.Println("DOCKER LOG: ", t)
+		var msg map[string]any
+		err := json.Unmarshal([]byte(t), &msg)
+		if err != nil {
+			continue
+		}
 
-			var msg map[string]any
-			err = json.Unmarshal([]byte(t), &msg)
-			if err != nil {
-				outputChan <- err
+		if stream, ok := msg["stream"].(string); ok {
+			output(stream)
+		} else if errmsg, ok := msg["error"].(string); ok {
+			output(errmsg + "\n")
+			status = buildStatusFailed
+			break scan
+		} else if status, ok := msg["status"].(string); ok {
+			var text string
+			if progress, ok := msg["progress"].(string); ok {
+				text = fmt.Sprintf("%v: %v\n", status, progress)
+			} else {
+				text = status + "\n"
 			}
-
-			if stream, ok := msg["stream"].(string); ok {
-				outputChan <- stream
-			} else if errmsg, ok := msg["error"].(string); ok {
-				outputChan <- errmsg + "\n"
-				return
-			} else if status, ok := msg["status"].(string); ok {
-				var text string
-				if progress, ok := msg["progress"].(string); ok {
-					text = fmt.Sprintf("%v: %v\n", status, progress)
-				} else {
-					text = status + "\n"
-				}
-				outputChan <- text
-			} else if aux, ok := msg["aux"].(map[string]any); ok {
-				if id, ok := aux["ID"].(string); ok {
-					imageID = id
-				}
+			output(text)
+		} else if aux, ok := msg["aux"].(map[string]any); ok {
+			if id, ok := aux["ID"].(string); ok {
+				imageID = id
 			}
 		}
+	}
 
-		var img *Image
+	if ctx.Err() != nil {
+		status = buildStatusCancelled
+		output("build cancelled\n")
+	} else if status == buildStatusSucceeded && (scanner.Err() != nil || imageID == "") {
+		status = buildStatusFailed
+	}
 
-		if imageID != "" {
-			img = &Image{
-				TemplateID: template.ID,
-				ImageTag:   opts.imageTag,
-				ImageID:    imageID,
-			}
+	if status == buildStatusSucceeded {
+		img := &Image{
+			TemplateID: build.TemplateID,
+			ImageTag:   build.ImageTag,
+			ImageID:    imageID,
+			RevisionID: build.RevisionID,
+		}
 
-			_, err = tx.NewInsert().Model(img).
-				On("CONFLICT DO UPDATE").
-				Set("image_id = EXCLUDED.image_id").
-				Exec(ctx)
-			if err != nil {
-				_ = tx.Rollback()
-				outputChan <- err
-				return
-			}
+		_, err := mgr.db.NewInsert().Model(img).
+			On("CONFLICT DO UPDATE").
+			Set("image_id = EXCLUDED.image_id").
+			Set("revision_id = EXCLUDED.revision_id").
+			Exec(dbCtx)
+		if err != nil {
+			output(err.Error() + "\n")
+			status = buildStatusFailed
+		} else {
+			build.ImageID = imageID
 		}
+	}
 
-		if autoCommit {
-			if err = tx.Commit(); err != nil {
-				_ = tx.Rollback()
-				outputChan <- err
-				return
-			}
+	mgr.endBuildJob(job, status, pendingLog.String())
+}
+
+// endBuildJob records the final status of the build of the given job and stops tracking the job.
+func (mgr *templateManager) endBuildJob(job *buildJob, status buildStatus, remainingLog string) {
+	mgr.finishBuild(context.Background(), job.build, status, remainingLog)
+	// the build is saved before the job is removed, so that the full log can always be found in one of them.
+	mgr.buildJobs.remove(job.build.ID)
+	job.finish()
+	job.cancel()
+	close(job.done)
+	mgr.buildScheduler.finish(job)
+}
+
+// cancelBuild stops the queued or running build with the given ID, and returns the build once it has stopped.
+func (mgr *templateManager) cancelBuild(ctx context.Context, buildID uuid.UUID) (*templateBuild, error) {
+	job, ok := mgr.buildJobs.find(buildID)
+	if !ok {
+		if _, err := mgr.findBuild(ctx, buildID, false); err != nil {
+			return nil, err
 		}
+		return nil, errBuildNotRunning
+	}
+
+	job.cancel()
+
+	// a queued build is never started by the scheduler, so it has to be ended here.
+	if mgr.buildScheduler.dequeue(job) {
+		job.write("build cancelled\n")
+		mgr.endBuildJob(job, buildStatusCancelled, "build cancelled\n")
+	}
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return mgr.findBuild(ctx, buildID, false)
+}
 
-		if img != nil {
-			outputChan <- img
+// followBuild calls onOutput with the log of the given build, then with any new output of the build
+// until the build ends or ctx is done. ctx being done only detaches from the build; the build keeps running.
+func (mgr *templateManager) followBuild(ctx context.Context, buildID uuid.UUID, onOutput func(string) error) error {
+	if job, ok := mgr.buildJobs.find(buildID); ok {
+		err := job.follow(ctx, 0, onOutput)
+		if ctx.Err() != nil {
+			return nil
 		}
-	}()
+		return err
+	}
 
-	return outputChan, nil
+	build, err := mgr.findBuild(ctx, buildID, true)
+	if err != nil {
+		return err
+	}
+
+	return onOutput(build.Log)
 }
 
 func (mgr *templateManager) deleteTemplate(ctx context.Context, name string) error {
@@ -433,7 +565,150 @@ func (mgr *templateManager) findTemplateFile(ctx context.Context, templateName,
 	return &file, nil
 }
 
-func (mgr *templateManager) updateTemplateFile(ctx context.Context, templateName, filePath string, content []byte) error {
+// updateTemplateFile replaces the content of the given template file.
+// The mode of the file is also updated if mode is not zero.
+// A new revision is created with the given message, or a generated one if message is empty.
+func (mgr *templateManager) updateTemplateFile(ctx context.Context, templateName, filePath string, content []byte, mode int64, message string) error {
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var template template
+	err = tx.NewSelect().Model(&template).
+		Column("id").
+		Where("Name = ?", templateName).
+		Scan(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return errTemplateNotFound
+		}
+		return err
+	}
+
+	if _, err = mgr.ensureRevision(ctx, tx, template.ID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	q := tx.NewUpdate().Table("template_files").
+		Set("content = ?", content)
+	if mode != 0 {
+		q = q.Set("mode = ?", mode)
+	}
+
+	res, err := q.
+		Where("template_id = ?", template.ID).
+		Where("file_path = ?", filePath).
+		Exec(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if count == 0 {
+		_ = tx.Rollback()
+		return errTemplateFileNotFound
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Update %v", filePath)
+	}
+	if _, err = mgr.createRevision(ctx, tx, template.ID, message); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// createTemplateFile adds a new file to the given template.
+// If mode is zero, defaultFileMode is used.
+// A new revision is created with the given message, or a generated one if message is empty.
+func (mgr *templateManager) createTemplateFile(ctx context.Context, templateName, filePath string, content []byte, mode int64, message string) (*templateFile, error) {
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var template template
+	err = tx.NewSelect().Model(&template).
+		Column("id").
+		Where("Name = ?", templateName).
+		Scan(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errTemplateNotFound
+		}
+		return nil, err
+	}
+
+	if _, err = mgr.ensureRevision(ctx, tx, template.ID); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	exists, err := tx.NewSelect().Table("template_files").
+		Where("template_id = ?", template.ID).
+		Where("file_path = ?", filePath).
+		Exists(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if exists {
+		_ = tx.Rollback()
+		return nil, errTemplateFileExists
+	}
+
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+
+	file := templateFile{
+		TemplateID: template.ID,
+		FilePath:   filePath,
+		Content:    content,
+		Mode:       mode,
+	}
+
+	if _, err = tx.NewInsert().Model(&file).Exec(ctx); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Create %v", filePath)
+	}
+	if _, err = mgr.createRevision(ctx, tx, template.ID, message); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// renameTemplateFile moves the given template file to newFilePath.
+// A new revision is created with the given message, or a generated one if message is empty.
+func (mgr *templateManager) renameTemplateFile(ctx context.Context, templateName, filePath, newFilePath, message string) error {
 	tx, err := mgr.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -445,25 +720,122 @@ func (mgr *templateManager) updateTemplateFile(ctx context.Context, templateName
 		Where("Name = ?", templateName).
 		Scan(ctx)
 	if err != nil {
+		_ = tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
 			return errTemplateNotFound
 		}
 		return err
 	}
 
-	_, err = tx.NewUpdate().Table("template_files").
-		Set("content = ?", content).
+	if _, err = mgr.ensureRevision(ctx, tx, template.ID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	exists, err := tx.NewSelect().Table("template_files").
+		Where("template_id = ?", template.ID).
+		Where("file_path = ?", newFilePath).
+		Exists(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if exists {
+		_ = tx.Rollback()
+		return errTemplateFileExists
+	}
+
+	res, err := tx.NewUpdate().Table("template_files").
+		Set("file_path = ?", newFilePath).
 		Where("template_id = ?", template.ID).
 		Where("file_path = ?", filePath).
 		Exec(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if count == 0 {
+		_ = tx.Rollback()
+		return errTemplateFileNotFound
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Rename %v to %v", filePath, newFilePath)
+	}
+	if _, err = mgr.createRevision(ctx, tx, template.ID, message); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// deleteTemplateFile removes the given file from the given template.
+// A new revision is created with the given message, or a generated one if message is empty.
+func (mgr *templateManager) deleteTemplateFile(ctx context.Context, templateName, filePath, message string) error {
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var template template
+	err = tx.NewSelect().Model(&template).
+		Column("id").
+		Where("Name = ?", templateName).
+		Scan(ctx)
 	if err != nil {
 		_ = tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
-			return errTemplateFileNotFound
+			return errTemplateNotFound
 		}
 		return err
 	}
 
+	if _, err = mgr.ensureRevision(ctx, tx, template.ID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	res, err := tx.NewDelete().Table("template_files").
+		Where("template_id = ?", template.ID).
+		Where("file_path = ?", filePath).
+		Exec(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if count == 0 {
+		_ = tx.Rollback()
+		return errTemplateFileNotFound
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Delete %v", filePath)
+	}
+	if _, err = mgr.createRevision(ctx, tx, template.ID, message); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		return err
@@ -471,3 +843,404 @@ func (mgr *templateManager) updateTemplateFile(ctx context.Context, templateName
 
 	return nil
 }
+
+// createRevision snapshots the current files of the given template into a new revision.
+func (mgr *templateManager) createRevision(ctx context.Context, db bun.IDB, templateID uuid.UUID, message string) (*templateRevision, error) {
+	var files []templateFile
+	err := db.NewSelect().Model(&files).
+		Where("template_id = ?", templateID).
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, err
+	}
+
+	revision := templateRevision{
+		ID:         id,
+		TemplateID: templateID,
+		Message:    message,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+		Files:      make([]*templateRevisionFile, len(files)),
+	}
+	for i, f := range files {
+		revision.Files[i] = &templateRevisionFile{
+			RevisionID: id,
+			FilePath:   f.FilePath,
+			Content:    f.Content,
+			Mode:       f.Mode,
+		}
+	}
+
+	if _, err = db.NewInsert().Model(&revision).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(revision.Files) > 0 {
+		if _, err = db.NewInsert().Model(&revision.Files).Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
+
+// ensureRevision returns the ID of the latest revision of the given template.
+// Templates created before revisions were introduced have no revision,
+// in which case one is created from the current files so that they are not lost on the next change.
+func (mgr *templateManager) ensureRevision(ctx context.Context, db bun.IDB, templateID uuid.UUID) (uuid.UUID, error) {
+	var revision templateRevision
+	err := db.NewSelect().Model(&revision).
+		Column("id").
+		Where("template_id = ?", templateID).
+		Order("id DESC").
+		Limit(1).
+		Scan(ctx)
+	if err == nil {
+		return revision.ID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, err
+	}
+
+	created, err := mgr.createRevision(ctx, db, templateID, "Initial revision")
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return created.ID, nil
+}
+
+// findTemplateRevisions returns all revisions of the given template without their files, newest first.
+func (mgr *templateManager) findTemplateRevisions(ctx context.Context, templateName string) ([]templateRevision, error) {
+	var tmpl template
+	err := mgr.db.NewSelect().Model(&tmpl).
+		Column("id").
+		Where("Name = ?", templateName).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errTemplateNotFound
+		}
+		return nil, err
+	}
+
+	var revisions []templateRevision
+	err = mgr.db.NewSelect().Model(&revisions).
+		Where("template_id = ?", tmpl.ID).
+		Order("id DESC").
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]templateRevision, 0), nil
+		}
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		return make([]templateRevision, 0), nil
+	}
+
+	return revisions, nil
+}
+
+// findTemplateRevision returns the given revision of the given template with all of its files.
+func (mgr *templateManager) findTemplateRevision(ctx context.Context, templateName string, revisionID uuid.UUID) (*templateRevision, error) {
+	var tmpl template
+	err := mgr.db.NewSelect().Model(&tmpl).
+		Column("id").
+		Where("Name = ?", templateName).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errTemplateNotFound
+		}
+		return nil, err
+	}
+
+	var revision templateRevision
+	err = mgr.db.NewSelect().Model(&revision).
+		Relation("Files").
+		Where("template_revision.id = ?", revisionID).
+		Where("template_revision.template_id = ?", tmpl.ID).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errTemplateRevisionNotFound
+		}
+		return nil, err
+	}
+
+	return &revision, nil
+}
+
+// diffTemplateRevisions compares the files of revision against the files of base.
+// If base is uuid.Nil, revision is compared against the revision before it.
+// Only files that differ are returned.
+func (mgr *templateManager) diffTemplateRevisions(ctx context.Context, templateName string, revisionID, baseID uuid.UUID) ([]templateFileDiff, error) {
+	revision, err := mgr.findTemplateRevision(ctx, templateName, revisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseFiles []*templateRevisionFile
+	if baseID == uuid.Nil {
+		var base templateRevision
+		err = mgr.db.NewSelect().Model(&base).
+			Column("id").
+			Where("template_id = ?", revision.TemplateID).
+			Where("id < ?", revision.ID).
+			Order("id DESC").
+			Limit(1).
+			Scan(ctx)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		baseID = base.ID
+	}
+	if baseID != uuid.Nil {
+		base, err := mgr.findTemplateRevision(ctx, templateName, baseID)
+		if err != nil {
+			return nil, err
+		}
+		baseFiles = base.Files
+	}
+
+	baseFileMap := make(map[string]*templateRevisionFile, len(baseFiles))
+	for _, f := range baseFiles {
+		baseFileMap[f.FilePath] = f
+	}
+
+	diffs := make([]templateFileDiff, 0)
+	for _, f := range revision.Files {
+		baseFile, ok := baseFileMap[f.FilePath]
+		if !ok {
+			diffs = append(diffs, templateFileDiff{
+				Path:   f.FilePath,
+				Status: fileDiffStatusAdded,
+				Diff:   unifiedDiff("/dev/null", "b/"+f.FilePath, nil, f.Content),
+			})
+			continue
+		}
+
+		delete(baseFileMap, f.FilePath)
+		if string(baseFile.Content) != string(f.Content) || baseFile.Mode != f.Mode {
+			diffs = append(diffs, templateFileDiff{
+				Path:   f.FilePath,
+				Status: fileDiffStatusModified,
+				Diff:   unifiedDiff("a/"+f.FilePath, "b/"+f.FilePath, baseFile.Content, f.Content),
+			})
+		}
+	}
+	for _, f := range baseFiles {
+		if _, ok := baseFileMap[f.FilePath]; ok {
+			diffs = append(diffs, templateFileDiff{
+				Path:   f.FilePath,
+				Status: fileDiffStatusDeleted,
+				Diff:   unifiedDiff("a/"+f.FilePath, "/dev/null", f.Content, nil),
+			})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+
+	return diffs, nil
+}
+
+// restoreTemplateRevision replaces the files of the given template with the files in the given revision.
+// The restore itself is recorded as a new revision, so it can be undone.
+func (mgr *templateManager) restoreTemplateRevision(ctx context.Context, templateName string, revisionID uuid.UUID) (*template, error) {
+	revision, err := mgr.findTemplateRevision(ctx, templateName, revisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = mgr.ensureRevision(ctx, tx, revision.TemplateID); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.NewDelete().Table("template_files").
+		Where("template_id = ?", revision.TemplateID).
+		Exec(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	files := make([]*templateFile, len(revision.Files))
+	for i, f := range revision.Files {
+		files[i] = &templateFile{
+			TemplateID: revision.TemplateID,
+			FilePath:   f.FilePath,
+			Content:    f.Content,
+			Mode:       f.Mode,
+		}
+	}
+	if len(files) > 0 {
+		if _, err = tx.NewInsert().Model(&files).Exec(ctx); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	message := fmt.Sprintf("Restore revision %v", revision.ID)
+	if _, err = mgr.createRevision(ctx, tx, revision.TemplateID, message); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return mgr.findTemplate(ctx, templateName)
+}
+
+// appendBuildLog appends text to the saved log of the given build.
+func (mgr *templateManager) appendBuildLog(ctx context.Context, buildID uuid.UUID, text string) error {
+	if text == "" {
+		return nil
+	}
+	_, err := mgr.db.NewUpdate().Table("template_builds").
+		Set("log = log || ?", text).
+		Where("id = ?", buildID).
+		Exec(ctx)
+	return err
+}
+
+// finishBuild saves the final status of the given build along with the rest of its log.
+func (mgr *templateManager) finishBuild(ctx context.Context, build *templateBuild, status buildStatus, remainingLog string) {
+	build.Status = status
+	build.FinishedAt = time.Now().Format(time.RFC3339)
+
+	_, err := mgr.db.NewUpdate().Model(build).
+		Set("status = ?", build.Status).
+		Set("finished_at = ?", build.FinishedAt).
+		Set("image_id = ?", build.ImageID).
+		Set("log = log || ?", remainingLog).
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		fmt.Printf("failed to save build %v: %v\n", build.ID, err)
+	}
+}
+
+// findBuilds returns builds without their logs, newest first.
+// Only builds of the given template are returned if templateName is not empty.
+func (mgr *templateManager) findBuilds(ctx context.Context, templateName string) ([]templateBuild, error) {
+	var builds []templateBuild
+	q := mgr.db.NewSelect().Model(&builds).
+		ExcludeColumn("log").
+		Relation("Template", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Order("template_build.id DESC")
+	if templateName != "" {
+		q = q.Where("template.name = ?", templateName)
+	}
+
+	if err := q.Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]templateBuild, 0), nil
+		}
+		return nil, err
+	}
+
+	if len(builds) == 0 {
+		return make([]templateBuild, 0), nil
+	}
+
+	for i := range builds {
+		builds[i].TemplateName = builds[i].Template.Name
+		if builds[i].Status == buildStatusQueued {
+			builds[i].QueuePosition = mgr.buildScheduler.position(builds[i].ID)
+		}
+	}
+
+	return builds, nil
+}
+
+// findBuild returns the build with the given ID. Its log is only included if withLog is true.
+func (mgr *templateManager) findBuild(ctx context.Context, buildID uuid.UUID, withLog bool) (*templateBuild, error) {
+	var build templateBuild
+	q := mgr.db.NewSelect().Model(&build).
+		Relation("Template", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Where("template_build.id = ?", buildID)
+	if !withLog {
+		q = q.ExcludeColumn("log")
+	}
+
+	if err := q.Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errBuildNotFound
+		}
+		return nil, err
+	}
+
+	build.TemplateName = build.Template.Name
+	if build.Status == buildStatusQueued {
+		build.QueuePosition = mgr.buildScheduler.position(build.ID)
+	}
+
+	// the saved log of a running build can lag behind its actual output
+	if job, ok := mgr.buildJobs.find(buildID); withLog && ok {
+		build.Log = job.output()
+	}
+
+	return &build, nil
+}
+
+// findBuildQueue returns the builds that are running or waiting to start.
+func (mgr *templateManager) findBuildQueue(ctx context.Context) (*buildQueue, error) {
+	var builds []templateBuild
+	err := mgr.db.NewSelect().Model(&builds).
+		ExcludeColumn("log").
+		Relation("Template", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Where("template_build.status IN (?)", bun.In([]buildStatus{buildStatusQueued, buildStatusRunning})).
+		Order("template_build.id ASC").
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	queue := &buildQueue{
+		MaxConcurrentBuilds: mgr.buildScheduler.maxConcurrentBuilds,
+		Running:             make([]templateBuild, 0),
+		Queued:              make([]templateBuild, 0),
+	}
+
+	for _, build := range builds {
+		build.TemplateName = build.Template.Name
+		if build.Status == buildStatusRunning {
+			queue.Running = append(queue.Running, build)
+			continue
+		}
+		build.QueuePosition = mgr.buildScheduler.position(build.ID)
+		// the build may have been started since it was selected
+		if build.QueuePosition > 0 {
+			queue.Queued = append(queue.Queued, build)
+		}
+	}
+
+	sort.Slice(queue.Queued, func(i, j int) bool {
+		return queue.Queued[i].QueuePosition < queue.Queued[j].QueuePosition
+	})
+
+	return queue, nil
+}
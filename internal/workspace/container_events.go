@@ -0,0 +1,127 @@
+package workspace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"tesseract/internal/service"
+	"time"
+)
+
+// maxWatchDelay is the longest WatchContainers waits before listening to docker events again after the stream fails.
+const maxWatchDelay = 30 * time.Second
+
+// WatchContainers keeps the addresses that the ports of workspaces are forwarded to up to date
+// when workspace containers are started, stopped, paused or unpaused, including by other programs than tesseract
+// or when a container crashes. It blocks until ctx is done.
+func WatchContainers(ctx context.Context, services service.Services) {
+	mgr := newWorkspaceManager(services)
+
+	var delay time.Duration
+	for {
+		err := mgr.watchContainerEvents(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if delay == 0 {
+			delay = time.Second
+		} else {
+			delay = min(2*delay, maxWatchDelay)
+		}
+		fmt.Printf("error watching docker events: %v; retrying in %v\n", err, delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		// events that happened while not listening are missed, so every workspace is refreshed.
+		if err = mgr.refreshAllContainerAddresses(ctx); err != nil {
+			fmt.Printf("failed to refresh workspace addresses: %v\n", err)
+		} else {
+			delay = 0
+		}
+	}
+}
+
+// watchContainerEvents refreshes the address of the workspace of every container that is started or stopped,
+// until the event stream fails or ctx is done.
+func (mgr workspaceManager) watchContainerEvents(ctx context.Context) error {
+	msgs, errs := mgr.dockerClient.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", string(events.ActionStart)),
+			filters.Arg("event", string(events.ActionDie)),
+			filters.Arg("event", string(events.ActionPause)),
+			filters.Arg("event", string(events.ActionUnPause)),
+		),
+	})
+
+	for {
+		select {
+		case msg := <-msgs:
+			if err := mgr.refreshContainerAddress(ctx, msg.Actor.ID); err != nil {
+				fmt.Printf("failed to refresh address of container %v: %v\n", msg.Actor.ID, err)
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// refreshContainerAddress forwards the ports of the workspace with the given container to the current IP of the container,
+// or to nowhere if the container is not running. Containers that do not belong to a workspace are ignored.
+func (mgr workspaceManager) refreshContainerAddress(ctx context.Context, containerID string) error {
+	var w workspace
+	err := mgr.db.NewSelect().Model(&w).
+		Relation("PortMappings").
+		Where("container_id = ?", containerID).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	return mgr.refreshAddress(ctx, &w)
+}
+
+// refreshAllContainerAddresses forwards the ports of every workspace to the current IP of its container.
+func (mgr workspaceManager) refreshAllContainerAddresses(ctx context.Context) error {
+	var workspaces []workspace
+	err := mgr.db.NewSelect().Model(&workspaces).
+		Relation("PortMappings").
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var errs []error
+	for i := range workspaces {
+		errs = append(errs, mgr.refreshAddress(ctx, &workspaces[i]))
+	}
+	return errors.Join(errs...)
+}
+
+func (mgr workspaceManager) refreshAddress(ctx context.Context, w *workspace) error {
+	inspect, err := mgr.dockerClient.ContainerInspect(ctx, w.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	var ip string
+	if inspect.State.Running && !inspect.State.Paused {
+		ip = inspect.NetworkSettings.IPAddress
+	}
+
+	mgr.reverseProxy.SetWorkspaceAddress(w.Name, ip)
+	forwardPorts(mgr.portForwarder, w, ip)
+
+	return nil
+}
@@ -1,18 +1,59 @@
 package workspace
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type spawnedShell struct {
 	io.Reader
 	io.Writer
 
-	execID string
+	execID      string
+	containerID string
+	user        string
+	conn        types.HijackedResponse
+	docker      *client.Client
+
+	// pid is the pid of the shell in the container, which it is signalled by when it is closed.
+	pid int
+}
+
+type spawnShellOptions struct {
+	// cmd is the command to run in the shell. Defaults to defaultShellCommand.
+	cmd []string
+
+	// user is the user the shell runs as. Defaults to the user of the container.
+	user string
+
+	// rows and cols are the initial size of the tty. Ignored if either is zero.
+	rows uint
+	cols uint
+}
+
+var defaultShellCommand = []string{"/bin/sh"}
+
+// shellWrapper prints the pid of the shell in the container on its first line of output before running the shell,
+// which keeps the pid since it is run with exec.
+var shellWrapper = []string{"/bin/sh", "-c", `echo "$$"; exec "$@"`, "sh"}
+
+// killShellTimeout is how long a shell has to exit after its terminal is closed before it is killed.
+const killShellTimeout = 5 * time.Second
+
+type execCommandOptions struct {
+	user string
+	cmd  []string
+	env  []string
 }
 
 func stopContainer(ctx context.Context, docker *client.Client, containerID string) error {
@@ -33,23 +74,151 @@ func inspectContainer(ctx context.Context, docker *client.Client, containerID st
 	return docker.ContainerInspect(ctx, containerID)
 }
 
-func spawnNewShell(ctx context.Context, docker *client.Client, containerID string) (*spawnedShell, error) {
+func spawnNewShell(ctx context.Context, docker *client.Client, containerID string, opts spawnShellOptions) (*spawnedShell, error) {
+	cmd := opts.cmd
+	if len(cmd) == 0 {
+		cmd = defaultShellCommand
+	}
+
+	var consoleSize *[2]uint
+	if opts.rows > 0 && opts.cols > 0 {
+		consoleSize = &[2]uint{opts.rows, opts.cols}
+	}
+
 	res, err := docker.ContainerExecCreate(ctx, containerID, container.ExecOptions{
-		Tty:    true,
-		Detach: true,
+		User:         opts.user,
+		Tty:          true,
+		ConsoleSize:  consoleSize,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          append(slices.Clone(shellWrapper), cmd...),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	attached, err := docker.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{})
+	attached, err := docker.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{
+		Tty:         true,
+		ConsoleSize: consoleSize,
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// the line with the pid is read before anything else, so that it is not shown in the terminal.
+	line, err := attached.Reader.ReadString('\n')
+	if err != nil {
+		attached.Close()
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		attached.Close()
+		return nil, fmt.Errorf("failed to read the pid of the shell: %w", err)
+	}
+
 	return &spawnedShell{
-		Reader: attached.Reader,
-		Writer: attached.Conn,
-		execID: res.ID,
+		Reader:      attached.Reader,
+		Writer:      attached.Conn,
+		execID:      res.ID,
+		containerID: containerID,
+		user:        opts.user,
+		conn:        attached,
+		docker:      docker,
+		pid:         pid,
 	}, nil
 }
+
+// resize changes the size of the tty of the shell.
+func (sh *spawnedShell) resize(ctx context.Context, rows, cols uint) error {
+	return sh.docker.ContainerExecResize(ctx, sh.execID, container.ResizeOptions{
+		Height: rows,
+		Width:  cols,
+	})
+}
+
+// Close detaches from the shell and ends its process.
+// Closing the attached stream only closes stdin of the process, which programs in a tty do not necessarily exit on,
+// so the process is sent SIGHUP like when a terminal is closed, and killed if it does not exit within killShellTimeout.
+// The signals are sent from inside the container, since the pid that docker reports for the process is only meaningful
+// on the host that docker runs on. docker removes the exec instance once the process exits.
+func (sh *spawnedShell) Close() error {
+	sh.conn.Close()
+
+	// the request that the shell was spawned for is usually done by now.
+	ctx, cancel := context.WithTimeout(context.Background(), killShellTimeout+5*time.Second)
+	defer cancel()
+
+	inspect, err := sh.docker.ContainerExecInspect(ctx, sh.execID)
+	if err != nil || !inspect.Running {
+		return err
+	}
+
+	if err = sh.signal(ctx, "HUP"); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(killShellTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if inspect, err = sh.docker.ContainerExecInspect(ctx, sh.execID); err != nil || !inspect.Running {
+			return err
+		}
+	}
+
+	return sh.signal(ctx, "KILL")
+}
+
+// signal sends the signal with the given name to the shell from inside its container, as the user the shell runs as.
+func (sh *spawnedShell) signal(ctx context.Context, name string) error {
+	return execCommand(ctx, sh.docker, sh.containerID, execCommandOptions{
+		user: sh.user,
+		cmd:  []string{"/bin/sh", "-c", `kill -s "$1" "$2"`, "sh", name, strconv.Itoa(sh.pid)},
+	})
+}
+
+// execCommand runs a command in the given container and waits for it to exit.
+// The output of the command is included in the returned error if it exits with a non-zero status.
+func execCommand(ctx context.Context, docker *client.Client, containerID string, opts execCommandOptions) error {
+	_, err := execCommandOutput(ctx, docker, containerID, opts)
+	return err
+}
+
+// execCommandOutput runs a command in the given container, waits for it to exit, and returns what it writes to stdout.
+// The output of the command is included in the returned error if it exits with a non-zero status.
+func execCommandOutput(ctx context.Context, docker *client.Client, containerID string, opts execCommandOptions) ([]byte, error) {
+	res, err := docker.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		User:         opts.user,
+		Env:          opts.env,
+		Cmd:          opts.cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attached, err := docker.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer attached.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, attached.Reader); err != nil {
+		return nil, err
+	}
+
+	inspect, err := docker.ContainerExecInspect(ctx, res.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if inspect.ExitCode != 0 {
+		output := strings.TrimSpace(stderr.String() + stdout.String())
+		return nil, fmt.Errorf("%v exited with status %d: %v", opts.cmd[0], inspect.ExitCode, output)
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -1,6 +1,10 @@
 package workspace
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+	"tesseract/internal/service"
+)
 
 type errWorkspaceExists struct {
 	message string
@@ -15,5 +19,37 @@ func (err *errWorkspaceExists) Error() string {
 }
 
 func (err *errPortMappingConflicts) Error() string {
-	return "Subdomain(s) already in use: " + strings.Join(err.conflicts, ", ")
+	return "Subdomain(s) or port(s) already in use: " + strings.Join(err.conflicts, ", ")
+}
+
+type errMountPathInUse struct {
+	mountPath string
+}
+
+func (err *errMountPathInUse) Error() string {
+	return "Another volume is already mounted at " + err.mountPath
+}
+
+type errSSHPortInUse struct {
+	port int
+}
+
+func (err *errSSHPortInUse) Error() string {
+	return "SSH port " + strconv.Itoa(err.port) + " is already in use by another program"
+}
+
+type errSSHPortRangeExhausted struct {
+	portRange service.PortRange
+}
+
+func (err *errSSHPortRangeExhausted) Error() string {
+	return "All SSH ports in " + err.portRange.String() + " are in use"
+}
+
+type errForwardedPortRangeExhausted struct {
+	portRange service.PortRange
+}
+
+func (err *errForwardedPortRangeExhausted) Error() string {
+	return "All forwarded ports in " + err.portRange.String() + " are in use"
 }
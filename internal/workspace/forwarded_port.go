@@ -0,0 +1,110 @@
+package workspace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/uptrace/bun"
+	"net"
+	"slices"
+	"strconv"
+	"syscall"
+	"tesseract/internal/portforward"
+	"tesseract/internal/service"
+)
+
+// allocateHostPorts forwards each tcp and udp port among the given port mappings from the lowest port in portRange
+// that is neither allocated to another port mapping nor used by another program, and sets its HostPort.
+// No port is forwarded if an error is returned.
+func allocateHostPorts(ctx context.Context, db bun.IDB, forwarder *portforward.Forwarder, portRange service.PortRange, mappings []portMapping, containerIP string) error {
+	var forwarded []portMapping
+	err := db.NewSelect().Model(&forwarded).
+		Column("protocol", "host_port").
+		Where("host_port IS NOT NULL").
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// a tcp port and a udp port with the same number are different ports, so they are allocated separately.
+	allocatedPorts := make(map[string][]int)
+	for _, m := range forwarded {
+		allocatedPorts[m.Protocol] = append(allocatedPorts[m.Protocol], m.HostPort)
+	}
+
+	for i := range mappings {
+		m := &mappings[i]
+		if m.Protocol == portProtocolHTTP {
+			continue
+		}
+
+		port, err := allocateHostPort(forwarder, portRange, m.Protocol, allocatedPorts[m.Protocol], forwardTarget(containerIP, m.ContainerPort))
+		if err != nil {
+			removeForwardedPorts(forwarder, mappings[:i])
+			return err
+		}
+
+		m.HostPort = port
+		allocatedPorts[m.Protocol] = append(allocatedPorts[m.Protocol], port)
+	}
+
+	return nil
+}
+
+func allocateHostPort(forwarder *portforward.Forwarder, portRange service.PortRange, protocol string, allocatedPorts []int, target string) (int, error) {
+	for port := portRange.Start; port <= portRange.End; port++ {
+		if slices.Contains(allocatedPorts, port) {
+			continue
+		}
+
+		err := forwarder.Listen(protocol, port, target)
+		if err == nil {
+			return port, nil
+		}
+		// the port is used by another program, so the next one is tried.
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return 0, err
+		}
+	}
+
+	return 0, &errForwardedPortRangeExhausted{portRange: portRange}
+}
+
+// forwardPorts forwards the tcp and udp ports of the given workspace to the given container IP,
+// or refuses connections to them if the IP is empty, i.e. the container is not running.
+// Ports that are not bound, e.g. because another program used them when tesseract started, are bound again.
+func forwardPorts(forwarder *portforward.Forwarder, w *workspace, containerIP string) {
+	for _, m := range w.PortMappings {
+		if m.Protocol == portProtocolHTTP || m.HostPort == 0 {
+			continue
+		}
+
+		target := forwardTarget(containerIP, m.ContainerPort)
+		if forwarder.IsForwarding(m.Protocol, m.HostPort) {
+			forwarder.SetTarget(m.Protocol, m.HostPort, target)
+			continue
+		}
+		if err := forwarder.Listen(m.Protocol, m.HostPort, target); err != nil {
+			fmt.Printf("failed to forward %v port %d of workspace %v: %v\n", m.Protocol, m.HostPort, w.Name, err)
+		}
+	}
+}
+
+// removeForwardedPorts stops forwarding the tcp and udp ports among the given port mappings.
+func removeForwardedPorts(forwarder *portforward.Forwarder, mappings []portMapping) {
+	for _, m := range mappings {
+		if m.Protocol != portProtocolHTTP && m.HostPort != 0 {
+			forwarder.Remove(m.Protocol, m.HostPort)
+		}
+	}
+}
+
+// forwardTarget returns the address of the given port of a container with the given IP,
+// or an empty string if the container has no IP.
+func forwardTarget(containerIP string, port int) string {
+	if containerIP == "" {
+		return ""
+	}
+	return net.JoinHostPort(containerIP, strconv.Itoa(port))
+}
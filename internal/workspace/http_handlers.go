@@ -4,19 +4,93 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/docker/docker/errdefs"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"tesseract/internal/apierror"
+	"tesseract/internal/docker"
+	"tesseract/internal/reverseproxy"
+	"tesseract/internal/service"
+	"time"
 )
 
 type createWorkspaceRequestBody struct {
-	ImageID string `json:"imageId"`
-	Runtime string `json:"runtime"`
+	ImageID    string `json:"imageId"`
+	Runtime    string `json:"runtime"`
+	VolumePath string `json:"volumePath"`
 }
 
 type updateWorkspaceRequestBody struct {
 	Status       string        `json:"status"`
 	PortMappings []portMapping `json:"ports"`
+
+	// ImageID is the ID of the image the workspace should be rebased onto.
+	ImageID string `json:"imageId"`
+}
+
+type updatePortMappingRequestBody struct {
+	// WakeOnRequest is whether requests to the port start the workspace if it is stopped. It is kept if omitted.
+	WakeOnRequest *bool `json:"wakeOnRequest"`
+
+	// Visibility is who can access the port. It is kept if omitted.
+	Visibility *reverseproxy.Visibility `json:"visibility"`
+}
+
+type createShareLinkRequestBody struct {
+	// ExpiresIn is after how many seconds the share link expires. Defaults to defaultShareLinkLifetime.
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type shareLinkResponseBody struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// defaultShareLinkLifetime is how long share links are valid for if no expiry is given.
+const defaultShareLinkLifetime = 24 * time.Hour
+
+// maxShareLinkLifetime is the longest share links can be valid for.
+// Share links cannot be revoked one by one, only all at once by changing the visibility of the port, so they have to expire.
+const maxShareLinkLifetime = 30 * 24 * time.Hour
+
+type addWorkspaceVolumeRequestBody struct {
+	// Name is the name of an existing detached volume to attach.
+	// A new volume is created if it is empty.
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type addSSHKeyRequestBody struct {
+	// Name is a name to identify the key. Defaults to the comment of the key.
+	Name string `json:"name"`
+
+	// PublicKey is the public key in the authorized_keys format, e.g. the content of ~/.ssh/id_ed25519.pub.
+	PublicKey string `json:"publicKey"`
+
+	// Owner is who the key belongs to.
+	Owner string `json:"owner"`
+
+	// Users are the user names the key can log in as, or "*" for any user but root.
+	Users []string `json:"users"`
+
+	// Workspaces are the names of the workspaces the key can log in to, or "*" for any workspace.
+	Workspaces []string `json:"workspaces"`
+}
+
+type updateSSHKeyRequestBody struct {
+	// Owner is who the key belongs to. It is kept if omitted.
+	Owner *string `json:"owner"`
+
+	// Users are the user names the key can log in as. They are kept if omitted.
+	Users []string `json:"users"`
+
+	// Workspaces are the names of the workspaces the key can log in to. They are kept if omitted.
+	Workspaces []string `json:"workspaces"`
 }
 
 const keyCurrentWorkspace = "currentWorkspace"
@@ -79,20 +153,29 @@ func createWorkspace(c echo.Context, workspaceName string) error {
 	mgr := workspaceManagerFrom(c)
 
 	w, err := mgr.createWorkspace(c.Request().Context(), createWorkspaceOptions{
-		name:    workspaceName,
-		imageID: body.ImageID,
-		runtime: body.Runtime,
+		name:       workspaceName,
+		imageID:    body.ImageID,
+		runtime:    body.Runtime,
+		volumePath: body.VolumePath,
 	})
 	if err != nil {
 		if errors.Is(err, errImageNotFound) {
 			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("no image with id %v exists", body.ImageID))
 		}
+		if errors.Is(err, errInvalidMountPath) {
+			return apierror.New(http.StatusBadRequest, "INVALID_MOUNT_PATH", err.Error())
+		}
 
 		var errWorkspaceExists *errWorkspaceExists
 		if errors.As(err, &errWorkspaceExists) {
 			return apierror.New(http.StatusBadRequest, "WORKSPACE_EXISTS", errWorkspaceExists.message)
 		}
 
+		var errSSHPortRangeExhausted *errSSHPortRangeExhausted
+		if errors.As(err, &errSSHPortRangeExhausted) {
+			return apierror.New(http.StatusServiceUnavailable, "SSH_PORTS_EXHAUSTED", err.Error())
+		}
+
 		return err
 	}
 
@@ -110,6 +193,15 @@ func updateWorkspace(c echo.Context, workspace *workspace) error {
 
 	mgr := workspaceManagerFrom(c)
 
+	if body.ImageID != "" {
+		if err = mgr.rebaseWorkspace(ctx, workspace, body.ImageID); err != nil {
+			if errors.Is(err, errImageNotFound) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("no image with id %v exists", body.ImageID))
+			}
+			return err
+		}
+	}
+
 	switch status(body.Status) {
 	case statusStopped:
 		if err = mgr.stopWorkspace(ctx, workspace); err != nil {
@@ -119,6 +211,14 @@ func updateWorkspace(c echo.Context, workspace *workspace) error {
 
 	case statusRunning:
 		if err = mgr.startWorkspace(ctx, workspace); err != nil {
+			var errSSHPortInUse *errSSHPortInUse
+			if errors.As(err, &errSSHPortInUse) {
+				return apierror.New(http.StatusConflict, "SSH_PORT_IN_USE", err.Error())
+			}
+			var errSSHPortRangeExhausted *errSSHPortRangeExhausted
+			if errors.As(err, &errSSHPortRangeExhausted) {
+				return apierror.New(http.StatusServiceUnavailable, "SSH_PORTS_EXHAUSTED", err.Error())
+			}
 			return err
 		}
 		break
@@ -130,6 +230,25 @@ func updateWorkspace(c echo.Context, workspace *workspace) error {
 			if errors.As(err, &errPortMappingConflicts) {
 				return apierror.New(http.StatusConflict, "PORT_MAPPINGS_EXIST", err.Error())
 			}
+			if errors.Is(err, errInvalidPortProtocol) {
+				return apierror.New(http.StatusBadRequest, "INVALID_PORT_PROTOCOL", err.Error())
+			}
+			if errors.Is(err, errInvalidSubdomain) {
+				return apierror.New(http.StatusBadRequest, "INVALID_SUBDOMAIN", err.Error())
+			}
+			if errors.Is(err, errWakeOnRequestUnsupported) {
+				return apierror.New(http.StatusBadRequest, "WAKE_ON_REQUEST_UNSUPPORTED", err.Error())
+			}
+			if errors.Is(err, errInvalidPortVisibility) {
+				return apierror.New(http.StatusBadRequest, "INVALID_PORT_VISIBILITY", err.Error())
+			}
+			if errors.Is(err, errPortVisibilityUnsupported) {
+				return apierror.New(http.StatusBadRequest, "PORT_VISIBILITY_UNSUPPORTED", err.Error())
+			}
+			var errForwardedPortRangeExhausted *errForwardedPortRangeExhausted
+			if errors.As(err, &errForwardedPortRangeExhausted) {
+				return apierror.New(http.StatusServiceUnavailable, "FORWARDED_PORTS_EXHAUSTED", err.Error())
+			}
 			return err
 		}
 	}
@@ -150,22 +269,100 @@ func deleteWorkspace(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
-func deleteWorkspacePortMapping(c echo.Context) error {
+func updateWorkspacePortMapping(c echo.Context) error {
 	workspace := currentWorkspace(c)
 	mgr := workspaceManagerFrom(c)
 
-	portName := c.Param("portName")
-	if portName == "" {
+	var body updatePortMappingRequestBody
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	portMapping := findPortMapping(workspace, c.Param("portName"))
+	if portMapping == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if body.WakeOnRequest != nil {
+		err := mgr.setPortWakeOnRequest(c.Request().Context(), workspace, portMapping, *body.WakeOnRequest)
+		if err != nil {
+			if errors.Is(err, errWakeOnRequestUnsupported) {
+				return apierror.New(http.StatusBadRequest, "WAKE_ON_REQUEST_UNSUPPORTED", err.Error())
+			}
+			return err
+		}
+	}
+
+	if body.Visibility != nil {
+		err := mgr.setPortVisibility(c.Request().Context(), workspace, portMapping, *body.Visibility)
+		if err != nil {
+			if errors.Is(err, errInvalidPortVisibility) {
+				return apierror.New(http.StatusBadRequest, "INVALID_PORT_VISIBILITY", err.Error())
+			}
+			if errors.Is(err, errPortVisibilityUnsupported) {
+				return apierror.New(http.StatusBadRequest, "PORT_VISIBILITY_UNSUPPORTED", err.Error())
+			}
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, portMapping)
+}
+
+func createPortShareLink(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	var body createShareLinkRequestBody
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	maxExpiresIn := int(maxShareLinkLifetime.Seconds())
+	if body.ExpiresIn < 0 || body.ExpiresIn > maxExpiresIn {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expiresIn must be between 1 and %d seconds", maxExpiresIn))
+	}
+	lifetime := defaultShareLinkLifetime
+	if body.ExpiresIn != 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	portMapping := findPortMapping(workspace, c.Param("portName"))
+	if portMapping == nil {
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
 
-	var portMapping *portMapping
-	for _, m := range workspace.PortMappings {
-		if m.Subdomain == portName {
-			portMapping = &m
-			break
+	expiresAt := time.Now().Add(lifetime).Truncate(time.Second)
+	token, err := mgr.createShareToken(workspace, portMapping, expiresAt)
+	if err != nil {
+		if errors.Is(err, errPortNotShareable) {
+			return apierror.New(http.StatusBadRequest, "PORT_NOT_SHAREABLE", err.Error())
 		}
+		return err
+	}
+
+	// the link points to the subdomain of the port on the same scheme and port that the dashboard is served on.
+	u := url.URL{
+		Scheme:   c.Scheme(),
+		Host:     portMapping.RoutedSubdomain + "." + mgr.hostName,
+		Path:     "/",
+		RawQuery: url.Values{reverseproxy.ShareTokenParam: {token}}.Encode(),
 	}
+	if _, port, err := net.SplitHostPort(c.Request().Host); err == nil {
+		u.Host = net.JoinHostPort(u.Host, port)
+	}
+
+	return c.JSON(http.StatusOK, shareLinkResponseBody{
+		URL:       u.String(),
+		ExpiresAt: expiresAt,
+	})
+}
+
+func deleteWorkspacePortMapping(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	portMapping := findPortMapping(workspace, c.Param("portName"))
 	if portMapping == nil {
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
@@ -178,6 +375,19 @@ func deleteWorkspacePortMapping(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// findPortMapping returns the port mapping of the given workspace with the given name, or nil if there is none.
+func findPortMapping(workspace *workspace, portName string) *portMapping {
+	if portName == "" {
+		return nil
+	}
+	for i := range workspace.PortMappings {
+		if workspace.PortMappings[i].name() == portName {
+			return &workspace.PortMappings[i]
+		}
+	}
+	return nil
+}
+
 func fetchWorkspaceRuntimes(c echo.Context) error {
 	mgr := workspaceManagerFrom(c)
 	runtimes, err := mgr.findAvailableWorkspaceRuntimes(c.Request().Context())
@@ -186,3 +396,241 @@ func fetchWorkspaceRuntimes(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, runtimes)
 }
+
+func fetchAllWorkspaceVolumes(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+	volumes, err := mgr.findAllVolumes(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, volumes)
+}
+
+// fetchWorkspaceListeningPorts responds with the tcp ports that processes in the workspace listen on,
+// which is empty if the workspace is not running.
+func fetchWorkspaceListeningPorts(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	ports, err := mgr.findListeningPorts(c.Request().Context(), workspace)
+	if err != nil {
+		if errors.Is(err, errPortDetectionUnavailable) {
+			return apierror.New(http.StatusConflict, "PORT_DETECTION_UNAVAILABLE", err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ports)
+}
+
+func fetchWorkspaceVolumes(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	if len(workspace.Volumes) == 0 {
+		return c.JSON(http.StatusOK, make([]workspaceVolume, 0))
+	}
+	return c.JSON(http.StatusOK, workspace.Volumes)
+}
+
+func addWorkspaceVolume(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+	ctx := c.Request().Context()
+
+	var body addWorkspaceVolumeRequestBody
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	var v *workspaceVolume
+	var err error
+	if body.Name == "" {
+		v, err = mgr.createVolume(ctx, workspace, body.MountPath)
+	} else {
+		v, err = mgr.attachVolume(ctx, workspace, body.Name, body.MountPath)
+	}
+	if err != nil {
+		if errors.Is(err, errVolumeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errVolumeInUse) {
+			return apierror.New(http.StatusConflict, "VOLUME_IN_USE", err.Error())
+		}
+		if errors.Is(err, errInvalidMountPath) {
+			return apierror.New(http.StatusBadRequest, "INVALID_MOUNT_PATH", err.Error())
+		}
+
+		var errMountPathInUse *errMountPathInUse
+		if errors.As(err, &errMountPathInUse) {
+			return apierror.New(http.StatusConflict, "MOUNT_PATH_IN_USE", err.Error())
+		}
+
+		return err
+	}
+
+	return c.JSON(http.StatusOK, v)
+}
+
+func detachWorkspaceVolume(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	err := mgr.detachVolume(c.Request().Context(), workspace, c.Param("volumeName"))
+	if err != nil {
+		if errors.Is(err, errVolumeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func deleteWorkspaceVolume(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+
+	err := mgr.deleteVolume(c.Request().Context(), c.Param("volumeName"))
+	if err != nil {
+		if errors.Is(err, errVolumeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errVolumeInUse) {
+			return apierror.New(http.StatusConflict, "VOLUME_IN_USE", err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func fetchAllSSHKeys(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+
+	keys, err := mgr.findSSHKeys(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, keys)
+}
+
+func addSSHKey(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+
+	var body addSSHKeyRequestBody
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	key, err := mgr.addSSHKey(c.Request().Context(), body.Name, body.PublicKey, body.Owner, body.Users, body.Workspaces)
+	if err != nil {
+		if errors.Is(err, errInvalidSSHKey) {
+			return apierror.New(http.StatusBadRequest, "INVALID_SSH_KEY", err.Error())
+		}
+		if errors.Is(err, errInvalidSSHKeyScope) {
+			return apierror.New(http.StatusBadRequest, "INVALID_SSH_KEY_SCOPE", err.Error())
+		}
+		if errors.Is(err, errSSHKeyExists) {
+			return apierror.New(http.StatusConflict, "SSH_KEY_EXISTS", err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, key)
+}
+
+func updateSSHKey(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+
+	id, err := uuid.Parse(c.Param("keyId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	var body updateSSHKeyRequestBody
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	key, err := mgr.updateSSHKey(c.Request().Context(), id, body.Owner, body.Users, body.Workspaces)
+	if err != nil {
+		if errors.Is(err, errSSHKeyNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if errors.Is(err, errInvalidSSHKeyScope) {
+			return apierror.New(http.StatusBadRequest, "INVALID_SSH_KEY_SCOPE", err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, key)
+}
+
+func deleteSSHKey(c echo.Context) error {
+	mgr := workspaceManagerFrom(c)
+
+	id, err := uuid.Parse(c.Param("keyId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err = mgr.deleteSSHKey(c.Request().Context(), id); err != nil {
+		if errors.Is(err, errSSHKeyNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func fetchWorkspaceSessions(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+	return c.JSON(http.StatusOK, mgr.findSessions(workspace))
+}
+
+func disconnectWorkspaceSession(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	if err := mgr.disconnectSession(workspace, c.Param("sessionId")); err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// openWorkspaceTerminal upgrades the request to a websocket connection that is bridged to a new shell in the workspace.
+// The command and the user of the shell can be chosen with the "cmd" (repeatable) and "user" query parameters,
+// and the initial size of the terminal with "rows" and "cols".
+func openWorkspaceTerminal(c echo.Context) error {
+	workspace := currentWorkspace(c)
+	mgr := workspaceManagerFrom(c)
+
+	opts := spawnShellOptions{
+		cmd:  c.QueryParams()["cmd"],
+		user: c.QueryParam("user"),
+	}
+	if rows, err := strconv.ParseUint(c.QueryParam("rows"), 10, 0); err == nil {
+		opts.rows = uint(rows)
+	}
+	if cols, err := strconv.ParseUint(c.QueryParam("cols"), 10, 0); err == nil {
+		opts.cols = uint(cols)
+	}
+
+	shell, err := spawnNewShell(c.Request().Context(), mgr.dockerClient, workspace.ContainerID, opts)
+	if err != nil {
+		if errdefs.IsConflict(err) {
+			return apierror.New(http.StatusConflict, "WORKSPACE_NOT_RUNNING", docker.CleanErrorMessage(err.Error()))
+		}
+		return err
+	}
+	defer shell.Close()
+
+	return service.Melody(c).HandleRequestWithKeys(c.Response(), c.Request(), map[string]any{
+		keyTerminalShell: shell,
+	})
+}
@@ -0,0 +1,232 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"tesseract/internal/listeningports"
+	"tesseract/internal/reverseproxy"
+	"tesseract/internal/service"
+	"time"
+)
+
+// detectPortsTimeout is how long reading the listening sockets of a workspace may take.
+const detectPortsTimeout = 10 * time.Second
+
+// hostProcPath is where the proc filesystem of the host is, through which the sockets of containers are read.
+const hostProcPath = "/proc"
+
+// detectPortsCommand prints the tcp sockets of a container. /proc/net/tcp6 does not exist if ipv6 is disabled.
+// It is only used if the sockets cannot be read from the host, e.g. because tesseract runs in a container itself
+// or docker runs on another host.
+var detectPortsCommand = []string{"sh", "-c", "cat /proc/net/tcp; cat /proc/net/tcp6 2>/dev/null || true"}
+
+// errPortDetectionUnavailable is returned when the sockets of a workspace can neither be read from the host
+// nor from inside the workspace, e.g. because its image does not have sh. This does not change until the workspace
+// is rebased, so it is not logged on every refresh.
+var errPortDetectionUnavailable = errors.New("listening ports cannot be detected in this workspace")
+
+// errNotContainerProcess is returned when the pid that docker reports for a container is not a process of the container
+// in the proc filesystem of tesseract, since it runs in another pid namespace or on another host than docker.
+var errNotContainerProcess = errors.New("the process is not in the container")
+
+// WatchListeningPorts detects the ports that processes in running workspaces listen on at the configured interval,
+// and forwards ports that start listening if auto forwarding is enabled. It blocks until ctx is done.
+func WatchListeningPorts(ctx context.Context, services service.Services) {
+	mgr := newWorkspaceManager(services)
+	config := services.Config.PortDetection
+
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := mgr.refreshAllListeningPorts(ctx, config); err != nil && ctx.Err() == nil {
+			fmt.Printf("failed to detect listening ports: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshAllListeningPorts detects the listening ports of every workspace and records them in mgr.listeningPorts.
+func (mgr workspaceManager) refreshAllListeningPorts(ctx context.Context, config service.PortDetectionConfig) error {
+	var workspaces []workspace
+	err := mgr.db.NewSelect().Model(&workspaces).
+		Relation("PortMappings").
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var errs []error
+	for i := range workspaces {
+		w := &workspaces[i]
+
+		ports, running, err := mgr.detectListeningPorts(ctx, w)
+		if errors.Is(err, errPortDetectionUnavailable) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("workspace %v: %w", w.Name, err))
+			continue
+		}
+		if !running {
+			mgr.listeningPorts.Remove(w.Name)
+			continue
+		}
+
+		added := mgr.listeningPorts.Set(w.Name, ports)
+		if config.AutoForward {
+			mgr.autoForwardPorts(ctx, w, added, config)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// findListeningPorts returns the ports that processes in the given workspace listen on,
+// along with the subdomains that they are forwarded through.
+// The ports that were last detected are returned if there are any, otherwise they are detected now.
+func (mgr workspaceManager) findListeningPorts(ctx context.Context, workspace *workspace) ([]listeningPort, error) {
+	ports, ok := mgr.listeningPorts.Ports(workspace.Name)
+	if !ok {
+		// the detected ports are not recorded, so that the next refresh still sees new ports as added and forwards them.
+		var err error
+		if ports, _, err = mgr.detectListeningPorts(ctx, workspace); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]listeningPort, 0, len(ports))
+	for _, p := range ports {
+		lp := listeningPort{Port: p}
+		if m, ok := findHTTPPortMapping(workspace, p.Port); ok {
+			lp.Subdomain = m.Subdomain
+		}
+		result = append(result, lp)
+	}
+	return result, nil
+}
+
+// detectListeningPorts reads the tcp ports that processes in the given workspace listen on,
+// from the proc filesystem of the host, or by running detectPortsCommand in the workspace if that is not possible.
+// It returns false if the workspace is not running, in which case nothing listens in it.
+func (mgr workspaceManager) detectListeningPorts(ctx context.Context, workspace *workspace) ([]listeningports.Port, bool, error) {
+	inspect, err := mgr.dockerClient.ContainerInspect(ctx, workspace.ContainerID)
+	if err != nil {
+		return nil, false, err
+	}
+	if !inspect.State.Running || inspect.State.Paused {
+		return nil, false, nil
+	}
+
+	output, err := readHostSockets(inspect.State.Pid, inspect.ID)
+	if err != nil {
+		ctx, cancel := context.WithTimeout(ctx, detectPortsTimeout)
+		defer cancel()
+
+		output, err = execCommandOutput(ctx, mgr.dockerClient, workspace.ContainerID, execCommandOptions{
+			cmd: detectPortsCommand,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, err
+			}
+			return nil, false, fmt.Errorf("%w: %v", errPortDetectionUnavailable, err)
+		}
+	}
+
+	ports, err := listeningports.Parse(bytes.NewReader(output))
+	if err != nil {
+		return nil, false, err
+	}
+	return ports, true, nil
+}
+
+// readHostSockets reads /proc/net/tcp and /proc/net/tcp6 of the network namespace of the process with the given pid
+// on the host, which is the main process of the container with the given ID.
+// The process is checked to be in the container before and after reading, since the pid may belong to another process,
+// e.g. if docker runs on another host, or if the container stopped and the pid was reused in the meantime.
+func readHostSockets(pid int, containerID string) ([]byte, error) {
+	if err := checkContainerProcess(pid, containerID); err != nil {
+		return nil, err
+	}
+
+	var output []byte
+	for _, name := range []string{"tcp", "tcp6"} {
+		content, err := os.ReadFile(filepath.Join(hostProcPath, strconv.Itoa(pid), "net", name))
+		if err != nil {
+			if name == "tcp6" && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		output = append(output, content...)
+	}
+
+	if err := checkContainerProcess(pid, containerID); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// checkContainerProcess returns errNotContainerProcess if the process with the given pid on the host is not in the cgroup
+// of the container with the given ID. The cgroup of a container is named after its full ID with every cgroup driver,
+// which cgroup paths contain unless tesseract runs in a cgroup namespace of its own.
+func checkContainerProcess(pid int, containerID string) error {
+	if pid == 0 || containerID == "" {
+		return errNotContainerProcess
+	}
+	cgroup, err := os.ReadFile(filepath.Join(hostProcPath, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(cgroup, []byte(containerID)) {
+		return errNotContainerProcess
+	}
+	return nil
+}
+
+// autoForwardPorts forwards the given ports of the given workspace as private http ports,
+// through subdomains generated from the configured pattern. Ports that only listen on loopback addresses,
+// ignored ports and ports that are already forwarded as http ports are skipped.
+func (mgr workspaceManager) autoForwardPorts(ctx context.Context, workspace *workspace, ports []listeningports.Port, config service.PortDetectionConfig) {
+	for _, p := range ports {
+		if p.LoopbackOnly || slices.Contains(config.IgnoredPorts, p.Port) {
+			continue
+		}
+		if _, ok := findHTTPPortMapping(workspace, p.Port); ok {
+			continue
+		}
+
+		err := mgr.addPortMappings(ctx, workspace, []portMapping{{
+			ContainerPort: p.Port,
+			Protocol:      portProtocolHTTP,
+			Subdomain:     config.Subdomain(workspace.Name, p.Port),
+			Visibility:    reverseproxy.VisibilityPrivate,
+		}})
+		if err != nil {
+			fmt.Printf("failed to forward port %d of workspace %v: %v\n", p.Port, workspace.Name, err)
+		}
+	}
+}
+
+// findHTTPPortMapping returns the first port mapping that forwards the given container port of the workspace through a subdomain.
+func findHTTPPortMapping(workspace *workspace, containerPort int) (portMapping, bool) {
+	for _, m := range workspace.PortMappings {
+		if m.Protocol == portProtocolHTTP && m.ContainerPort == containerPort {
+			return m, true
+		}
+	}
+	return portMapping{}, false
+}
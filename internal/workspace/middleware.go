@@ -7,12 +7,7 @@ import (
 )
 
 func newWorkspaceManagerMiddleware(services service.Services) echo.MiddlewareFunc {
-	mgr := workspaceManager{
-		db:           services.Database,
-		dockerClient: services.DockerClient,
-		reverseProxy: services.ReverseProxy,
-		sshProxy:     services.SSHProxy,
-	}
+	mgr := newWorkspaceManager(services)
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			c.Set("workspaceManager", mgr)
@@ -21,6 +16,21 @@ func newWorkspaceManagerMiddleware(services service.Services) echo.MiddlewareFun
 	}
 }
 
+func newWorkspaceManager(services service.Services) workspaceManager {
+	return workspaceManager{
+		db:                 services.Database,
+		dockerClient:       services.DockerClient,
+		reverseProxy:       services.ReverseProxy,
+		sshProxy:           services.SSHProxy,
+		sshPortRange:       services.Config.SSHPortRange,
+		portForwarder:      services.PortForwarder,
+		forwardedPortRange: services.Config.ForwardedPortRange,
+		hostName:           services.Config.HostName,
+		subdomainScheme:    services.Config.SubdomainScheme,
+		listeningPorts:     services.ListeningPorts,
+	}
+}
+
 func workspaceManagerFrom(c echo.Context) workspaceManager {
 	return c.Get("workspaceManager").(workspaceManager)
 }
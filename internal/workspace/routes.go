@@ -7,9 +7,25 @@ import (
 
 func DefineRoutes(g *echo.Group, services service.Services) {
 	g.Use(newWorkspaceManagerMiddleware(services))
+	registerTerminalHandlers(services.Melody)
 	g.GET("/workspaces", fetchAllWorkspaces)
 	g.POST("/workspaces/:workspaceName", updateOrCreateWorkspace, currentWorkspaceMiddleware(true))
 	g.DELETE("/workspaces/:workspaceName", deleteWorkspace, currentWorkspaceMiddleware(false))
+	g.PATCH("/workspaces/:workspaceName/forwarded-ports/:portName", updateWorkspacePortMapping, currentWorkspaceMiddleware(false))
 	g.DELETE("/workspaces/:workspaceName/forwarded-ports/:portName", deleteWorkspacePortMapping, currentWorkspaceMiddleware(false))
+	g.POST("/workspaces/:workspaceName/forwarded-ports/:portName/share-links", createPortShareLink, currentWorkspaceMiddleware(false))
+	g.GET("/workspaces/:workspaceName/listening-ports", fetchWorkspaceListeningPorts, currentWorkspaceMiddleware(false))
+	g.GET("/workspaces/:workspaceName/volumes", fetchWorkspaceVolumes, currentWorkspaceMiddleware(false))
+	g.POST("/workspaces/:workspaceName/volumes", addWorkspaceVolume, currentWorkspaceMiddleware(false))
+	g.DELETE("/workspaces/:workspaceName/volumes/:volumeName", detachWorkspaceVolume, currentWorkspaceMiddleware(false))
+	g.GET("/workspaces/:workspaceName/terminal", openWorkspaceTerminal, currentWorkspaceMiddleware(false))
+	g.GET("/workspaces/:workspaceName/sessions", fetchWorkspaceSessions, currentWorkspaceMiddleware(false))
+	g.DELETE("/workspaces/:workspaceName/sessions/:sessionId", disconnectWorkspaceSession, currentWorkspaceMiddleware(false))
 	g.GET("/workspace-runtimes", fetchWorkspaceRuntimes)
+	g.GET("/workspace-volumes", fetchAllWorkspaceVolumes)
+	g.DELETE("/workspace-volumes/:volumeName", deleteWorkspaceVolume)
+	g.GET("/ssh-keys", fetchAllSSHKeys)
+	g.POST("/ssh-keys", addSSHKey)
+	g.PATCH("/ssh-keys/:keyId", updateSSHKey)
+	g.DELETE("/ssh-keys/:keyId", deleteSSHKey)
 }
@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// protocolSSH is the protocol of sessions through the ssh gateway.
+// Sessions through the reverse proxy use the protocols defined in the reverseproxy package.
+const protocolSSH = "ssh"
+
+var errSessionNotFound = errors.New("session not found")
+
+// findSessions returns the open connections to the given workspace, oldest first.
+func (mgr workspaceManager) findSessions(workspace *workspace) []session {
+	sessions := make([]session, 0)
+
+	for _, s := range mgr.sshProxy.Sessions(workspace.Name) {
+		sessions = append(sessions, session{
+			ID:            s.ID,
+			Protocol:      protocolSSH,
+			User:          s.User,
+			RemoteAddress: s.RemoteAddr,
+			StartedAt:     s.StartedAt.Format(time.RFC3339),
+			startedAt:     s.StartedAt,
+			BytesIn:       s.BytesIn,
+			BytesOut:      s.BytesOut,
+		})
+	}
+
+	for _, m := range workspace.PortMappings {
+		if m.Protocol != portProtocolHTTP {
+			continue
+		}
+		for _, s := range mgr.reverseProxy.Sessions(m.RoutedSubdomain) {
+			sessions = append(sessions, session{
+				ID:            s.ID,
+				Protocol:      s.Protocol,
+				Subdomain:     m.Subdomain,
+				RemoteAddress: s.RemoteAddr,
+				StartedAt:     s.StartedAt.Format(time.RFC3339),
+				startedAt:     s.StartedAt,
+				BytesIn:       s.BytesIn,
+				BytesOut:      s.BytesOut,
+			})
+		}
+	}
+
+	// sessions that start at the same time are ordered by ID, so that the order is the same on every request.
+	slices.SortFunc(sessions, func(a, b session) int {
+		if c := a.startedAt.Compare(b.startedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return sessions
+}
+
+// disconnectSession closes the open connection to the given workspace with the given session ID.
+func (mgr workspaceManager) disconnectSession(workspace *workspace, id string) error {
+	if mgr.sshProxy.CloseSession(workspace.Name, id) {
+		return nil
+	}
+
+	for _, m := range workspace.PortMappings {
+		if m.Protocol == portProtocolHTTP && mgr.reverseProxy.CloseSession(m.RoutedSubdomain, id) {
+			return nil
+		}
+	}
+
+	return errSessionNotFound
+}
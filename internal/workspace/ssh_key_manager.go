@@ -0,0 +1,232 @@
+package workspace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/ssh"
+	"slices"
+	"strings"
+	"tesseract/internal/sshproxy"
+	"time"
+)
+
+var errSSHKeyNotFound = errors.New("ssh key not found")
+var errSSHKeyExists = errors.New("ssh key already exists")
+var errInvalidSSHKey = errors.New("invalid ssh public key")
+var errInvalidSSHKeyScope = errors.New("users and workspaces must each list at least one name, or " + sshproxy.AnyName + " for any")
+
+// removeAuthorizedKeysScript removes the blocks managed by tesseract from the authorized_keys of every user.
+// The ssh gateway adds its key to the block of a user when someone logs in as the user through it,
+// so this revokes the key for everyone who is not logged in as again.
+// Files that are symlinks are skipped, because the script runs as root.
+const removeAuthorizedKeysScript = `set -e
+awk -F: '$6 != "" { print $6 }' /etc/passwd |
+while IFS= read -r home; do
+	f="$home/.ssh/authorized_keys"
+	[ -f "$f" ] && [ ! -L "$f" ] || continue
+	grep -q '^# BEGIN tesseract$' "$f" || continue
+	tmp="$(mktemp)"
+	sed '/^# BEGIN tesseract$/,/^# END tesseract$/d' "$f" > "$tmp"
+	cat "$tmp" > "$f"
+	rm -f "$tmp"
+done
+`
+
+func (mgr workspaceManager) findSSHKeys(ctx context.Context) ([]sshKey, error) {
+	var keys []sshKey
+	err := mgr.db.NewSelect().Model(&keys).
+		Order("created_at ASC").
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]sshKey, 0), nil
+		}
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return make([]sshKey, 0), nil
+	}
+
+	return keys, nil
+}
+
+// addSSHKey registers the given public key, which is in the authorized_keys format,
+// to log in as the given users to the given workspaces. The comment of the key is used as its name if name is empty.
+func (mgr workspaceManager) addSSHKey(ctx context.Context, name, publicKey, owner string, users, workspaces []string) (*sshKey, error) {
+	pk, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return nil, errInvalidSSHKey
+	}
+
+	if err = validateSSHKeyScope(users, workspaces); err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = comment
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, err
+	}
+
+	key := sshKey{
+		ID:          id,
+		Name:        name,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))),
+		Fingerprint: ssh.FingerprintSHA256(pk),
+		Owner:       owner,
+		Users:       users,
+		Workspaces:  workspaces,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := tx.NewSelect().
+		Table("ssh_keys").
+		Where("fingerprint = ?", key.Fingerprint).
+		Exists(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if exists {
+		_ = tx.Rollback()
+		return nil, errSSHKeyExists
+	}
+
+	if _, err = tx.NewInsert().Model(&key).Exec(ctx); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = loadSSHKeys(ctx, mgr.db, mgr.sshProxy); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// updateSSHKey changes the owner and the scope of the given key. Fields that are nil are kept.
+func (mgr workspaceManager) updateSSHKey(ctx context.Context, id uuid.UUID, owner *string, users, workspaces []string) (*sshKey, error) {
+	var key sshKey
+	if err := mgr.db.NewSelect().Model(&key).Where("id = ?", id).Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errSSHKeyNotFound
+		}
+		return nil, err
+	}
+
+	if owner != nil {
+		key.Owner = *owner
+	}
+	if users != nil {
+		key.Users = users
+	}
+	if workspaces != nil {
+		key.Workspaces = workspaces
+	}
+
+	if err := validateSSHKeyScope(key.Users, key.Workspaces); err != nil {
+		return nil, err
+	}
+
+	_, err := mgr.db.NewUpdate().Model(&key).
+		Column("owner", "users", "workspaces").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = loadSSHKeys(ctx, mgr.db, mgr.sshProxy); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// validateSSHKeyScope checks that a key is allowed to log in as at least one user to at least one workspace.
+func validateSSHKeyScope(users, workspaces []string) error {
+	if len(users) == 0 || len(workspaces) == 0 {
+		return errInvalidSSHKeyScope
+	}
+	if slices.Contains(workspaces, "") {
+		return errInvalidSSHKeyScope
+	}
+	// uids and groups are not accepted, since they can log in as root under another name.
+	for _, user := range users {
+		if user != sshproxy.AnyName && !sshproxy.IsValidUserName(user) {
+			return errInvalidSSHKeyScope
+		}
+	}
+	return nil
+}
+
+func (mgr workspaceManager) deleteSSHKey(ctx context.Context, id uuid.UUID) error {
+	res, err := mgr.db.NewDelete().
+		Table("ssh_keys").
+		Where("id = ?", id).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errSSHKeyNotFound
+	}
+
+	return loadSSHKeys(ctx, mgr.db, mgr.sshProxy)
+}
+
+// loadSSHKeys authorizes the registered keys in the ssh gateway, within their scopes.
+func loadSSHKeys(ctx context.Context, db bun.IDB, proxy *sshproxy.SSHProxy) error {
+	var keys []sshKey
+	if err := db.NewSelect().Model(&keys).Scan(ctx); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	authorizedKeys := make([]sshproxy.AuthorizedKey, 0, len(keys))
+	for _, key := range keys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+		if err != nil {
+			return err
+		}
+		authorizedKeys = append(authorizedKeys, sshproxy.AuthorizedKey{
+			Key:        pk,
+			Users:      key.Users,
+			Workspaces: key.Workspaces,
+		})
+	}
+
+	proxy.SetAuthorizedKeys(authorizedKeys)
+
+	return nil
+}
+
+// removeAuthorizedKeys removes the keys authorized by tesseract from the users in the given container.
+func removeAuthorizedKeys(ctx context.Context, docker *client.Client, containerID string) error {
+	return execCommand(ctx, docker, containerID, execCommandOptions{
+		user: "root",
+		cmd:  []string{"/bin/sh", "-c", removeAuthorizedKeysScript},
+	})
+}
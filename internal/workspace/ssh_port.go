@@ -0,0 +1,70 @@
+package workspace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/uptrace/bun"
+	"slices"
+	"syscall"
+	"tesseract/internal/service"
+	"tesseract/internal/sshproxy"
+)
+
+// bindSSHPort makes the ssh gateway accept connections to the given workspace on the ssh port of the workspace.
+// A port is allocated from portRange and saved if the workspace does not have one yet.
+func bindSSHPort(ctx context.Context, db bun.IDB, proxy *sshproxy.SSHProxy, portRange service.PortRange, w *workspace) error {
+	if w.SSHPort != 0 {
+		if err := proxy.ListenWorkspace(w.Name, w.SSHPort); err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return &errSSHPortInUse{port: w.SSHPort}
+			}
+			return err
+		}
+		return nil
+	}
+
+	port, err := allocateSSHPort(ctx, db, proxy, portRange, w.Name)
+	if err != nil {
+		return err
+	}
+
+	w.SSHPort = port
+	if _, err = db.NewUpdate().Model(w).Column("ssh_port").WherePK().Exec(ctx); err != nil {
+		proxy.CloseWorkspace(w.Name)
+		w.SSHPort = 0
+		return err
+	}
+
+	return nil
+}
+
+// allocateSSHPort finds the lowest port in portRange that is neither allocated to another workspace
+// nor used by another program, and makes the ssh gateway accept connections to the given workspace on it.
+func allocateSSHPort(ctx context.Context, db bun.IDB, proxy *sshproxy.SSHProxy, portRange service.PortRange, workspaceName string) (int, error) {
+	var allocatedPorts []int
+	err := db.NewSelect().Model((*workspace)(nil)).
+		Column("ssh_port").
+		Where("ssh_port IS NOT NULL").
+		Scan(ctx, &allocatedPorts)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	for port := portRange.Start; port <= portRange.End; port++ {
+		if slices.Contains(allocatedPorts, port) {
+			continue
+		}
+
+		err = proxy.ListenWorkspace(workspaceName, port)
+		if err == nil {
+			return port, nil
+		}
+		// the port is used by another program, so the next one is tried.
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return 0, err
+		}
+	}
+
+	return 0, &errSSHPortRangeExhausted{portRange: portRange}
+}
@@ -0,0 +1,107 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/olahol/melody"
+)
+
+// terminalMessage is a control message sent by the client of a terminal session as a text message.
+// Binary messages are forwarded to the shell as-is.
+type terminalMessage struct {
+	Type terminalMessageType `json:"type"`
+
+	// Data is the input for the shell. Only used by terminalMessageInput.
+	Data string `json:"data"`
+
+	// Rows and Cols are the new size of the terminal. Only used by terminalMessageResize.
+	Rows uint `json:"rows"`
+	Cols uint `json:"cols"`
+}
+
+type terminalMessageType string
+
+const (
+	terminalMessageInput  terminalMessageType = "input"
+	terminalMessageResize terminalMessageType = "resize"
+)
+
+const keyTerminalShell = "terminalShell"
+
+// closeNormalClosure is the websocket close code sent when the shell exits.
+const closeNormalClosure = 1000
+
+// registerTerminalHandlers registers handlers on the given melody instance
+// that bridge websocket sessions opened by openWorkspaceTerminal to their shells.
+func registerTerminalHandlers(m *melody.Melody) {
+	m.HandleConnect(func(s *melody.Session) {
+		if shell, ok := terminalShellFrom(s); ok {
+			go pumpTerminalOutput(s, shell)
+		}
+	})
+
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		shell, ok := terminalShellFrom(s)
+		if !ok {
+			return
+		}
+
+		var tm terminalMessage
+		if err := json.Unmarshal(msg, &tm); err != nil {
+			return
+		}
+
+		switch tm.Type {
+		case terminalMessageInput:
+			if _, err := shell.Write([]byte(tm.Data)); err != nil {
+				_ = s.Close()
+			}
+
+		case terminalMessageResize:
+			if tm.Rows > 0 && tm.Cols > 0 {
+				if err := shell.resize(s.Request.Context(), tm.Rows, tm.Cols); err != nil {
+					fmt.Printf("failed to resize terminal %v: %v\n", shell.execID, err)
+				}
+			}
+		}
+	})
+
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
+		shell, ok := terminalShellFrom(s)
+		if !ok {
+			return
+		}
+		if _, err := shell.Write(msg); err != nil {
+			_ = s.Close()
+		}
+	})
+}
+
+// pumpTerminalOutput forwards the output of the shell to the websocket session until the shell exits.
+func pumpTerminalOutput(s *melody.Session, shell *spawnedShell) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := shell.Read(buf)
+		if n > 0 {
+			// melody queues the message, so the buffer cannot be reused
+			out := make([]byte, n)
+			copy(out, buf[:n])
+			if err := s.WriteBinary(out); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			_ = s.CloseWithMsg(melody.FormatCloseMessage(closeNormalClosure, "shell exited"))
+			return
+		}
+	}
+}
+
+func terminalShellFrom(s *melody.Session) (*spawnedShell, bool) {
+	v, ok := s.Get(keyTerminalShell)
+	if !ok {
+		return nil, false
+	}
+	shell, ok := v.(*spawnedShell)
+	return shell, ok
+}
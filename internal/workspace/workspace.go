@@ -9,12 +9,15 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
-	"net/url"
 	"regexp"
+	"slices"
 	"sync"
 	"tesseract/internal/docker"
+	"tesseract/internal/listeningports"
+	"tesseract/internal/portforward"
 	"tesseract/internal/reverseproxy"
 	"tesseract/internal/service"
+	"time"
 )
 
 type workspace struct {
@@ -31,12 +34,16 @@ type workspace struct {
 
 	CreatedAt string `json:"createdAt"`
 
-	SSHPort int `bun:"-" json:"sshPort,omitempty"`
+	// SSHPort is the port of the ssh gateway that is dedicated to the workspace.
+	// It is allocated when the workspace is created, and kept until the workspace is deleted.
+	SSHPort int `bun:",nullzero" json:"sshPort,omitempty"`
 
 	Status status `bun:"-" json:"status"`
 
 	PortMappings []portMapping `bun:"rel:has-many,join:id=workspace_id" json:"ports,omitempty"`
 
+	Volumes []workspaceVolume `bun:"rel:has-many,join:id=workspace_id" json:"volumes,omitempty"`
+
 	Runtime string `json:"runtime"`
 }
 
@@ -45,11 +52,129 @@ type portMapping struct {
 
 	WorkspaceID   uuid.UUID `bun:",type:uuid,pk" json:"-"`
 	ContainerPort int       `json:"port"`
-	Subdomain     string    `json:"subdomain"`
+
+	// Protocol is "http" for ports that are forwarded through a subdomain of the reverse proxy,
+	// or "tcp" or "udp" for ports that are forwarded from HostPort.
+	Protocol string `json:"protocol"`
+
+	// Subdomain is the subdomain that an http port is forwarded through. It is empty for tcp and udp ports.
+	Subdomain string `json:"subdomain"`
+
+	// RoutedSubdomain is the subdomain of the host name that an http port is routed through in the current subdomain scheme,
+	// which the database keeps unique across workspaces. It is empty for tcp and udp ports, and for http ports that conflict with another port.
+	RoutedSubdomain string `bun:",nullzero" json:"-"`
+
+	// HostPort is the port on the host that a tcp or udp port is forwarded from.
+	// It is allocated when the port is forwarded, and kept until the port mapping is deleted.
+	HostPort int `bun:",nullzero" json:"hostPort,omitempty"`
+
+	// WakeOnRequest is whether requests to the subdomain of an http port start the workspace if it is stopped.
+	WakeOnRequest bool `json:"wakeOnRequest"`
+
+	// Visibility is who can access the subdomain of an http port. tcp and udp ports are always public.
+	Visibility reverseproxy.Visibility `json:"visibility"`
+
+	// ShareSecret is what the share tokens of an http port are signed for.
+	// It is replaced whenever the visibility of the port changes, which revokes its share links.
+	ShareSecret string `json:"-"`
 
 	Workspace workspace `bun:"rel:belongs-to,join:workspace_id=id" json:"-"`
 }
 
+// portProtocolHTTP is the protocol of port mappings that are forwarded through the reverse proxy.
+// tcp and udp port mappings use the protocols defined in the portforward package.
+const portProtocolHTTP = "http"
+
+// name identifies the port mapping in the api. It is the subdomain of an http port,
+// or the protocol and host port of a tcp or udp port, e.g. "tcp-20000".
+func (m portMapping) name() string {
+	if m.Protocol == portProtocolHTTP {
+		return m.Subdomain
+	}
+	return fmt.Sprintf("%s-%d", m.Protocol, m.HostPort)
+}
+
+// workspaceVolume is a docker volume managed by tesseract that is mounted into a workspace.
+// Volumes outlive the container they are mounted in, so they are kept when a workspace is deleted or recreated.
+type workspaceVolume struct {
+	bun.BaseModel `bun:"table:workspace_volumes,alias:workspace_volume"`
+
+	// Name is the name of the docker volume
+	Name string `bun:",pk" json:"name"`
+
+	// WorkspaceID is the ID of the workspace the volume is attached to, or uuid.Nil if the volume is detached.
+	WorkspaceID uuid.UUID `bun:",type:uuid,nullzero" json:"-"`
+
+	MountPath string `json:"mountPath"`
+
+	CreatedAt string `json:"createdAt"`
+
+	// WorkspaceName is the name of the workspace the volume is attached to.
+	// It is only populated when volumes are listed across all workspaces.
+	WorkspaceName string `bun:"-" json:"workspaceName,omitempty"`
+
+	Workspace *workspace `bun:"rel:belongs-to,join:workspace_id=id" json:"-"`
+}
+
+// sshKey is a public key that is allowed to ssh into the workspaces in its scope through the ssh gateway.
+type sshKey struct {
+	bun.BaseModel `bun:"table:ssh_keys,alias:ssh_key"`
+
+	ID uuid.UUID `bun:",type:uuid,pk" json:"id"`
+
+	Name string `json:"name"`
+
+	// PublicKey is the public key in the authorized_keys format, without a comment.
+	PublicKey string `json:"publicKey"`
+
+	// Fingerprint is the SHA256 fingerprint of the key, in the same format as ssh-keygen -l.
+	Fingerprint string `json:"fingerprint"`
+
+	// Owner is who the key belongs to. It is only informational.
+	Owner string `json:"owner"`
+
+	// Users are the user names the key can log in as in workspaces, which may include "*" for any user but root.
+	Users []string `json:"users"`
+
+	// Workspaces are the names of the workspaces the key can log in to, which may include "*" for any workspace.
+	Workspaces []string `json:"workspaces"`
+
+	CreatedAt string `json:"createdAt"`
+}
+
+// session is an open connection to a workspace, through either the ssh gateway or the reverse proxy.
+type session struct {
+	ID string `json:"id"`
+
+	// Protocol is "ssh", "http" or "websocket".
+	Protocol string `json:"protocol"`
+
+	// User is the user that an ssh session is logged in as.
+	User string `json:"user,omitempty"`
+
+	// Subdomain is the subdomain of the forwarded port that an http or websocket session is connected to.
+	Subdomain string `json:"subdomain,omitempty"`
+
+	RemoteAddress string `json:"remoteAddress"`
+
+	StartedAt string `json:"startedAt"`
+
+	// startedAt is when the session started, which sessions are sorted by, since StartedAt only has seconds.
+	startedAt time.Time
+
+	BytesIn int64 `json:"bytesIn"`
+
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// listeningPort is a port that processes in a workspace listen on.
+type listeningPort struct {
+	listeningports.Port
+
+	// Subdomain is the subdomain that the port is forwarded through as an http port, if it is.
+	Subdomain string `json:"subdomain,omitempty"`
+}
+
 type workspaceRuntime struct {
 	Name string `json:"name"`
 	Path string `json:"path"`
@@ -74,9 +199,14 @@ func SyncAll(ctx context.Context, services service.Services) error {
 		return err
 	}
 
+	if err = loadSSHKeys(ctx, services.Database, services.SSHProxy); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	var workspaces []workspace
 	if err = tx.NewSelect().Model(&workspaces).
-		Column("id", "container_id").
+		Column("id", "name", "container_id", "ssh_port").
 		Scan(ctx); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil
@@ -119,12 +249,13 @@ func SyncAll(ctx context.Context, services service.Services) error {
 				return
 			}
 
-			internalPort := docker.ContainerSSHHostPort(ctx, inspect)
-			if internalPort <= 0 {
-				return
-			}
+			services.SSHProxy.AddEntry(w.Name, w.ContainerID, docker.ContainerSSHHostPort(ctx, inspect))
+			services.ReverseProxy.SetWorkspaceAddress(w.Name, inspect.NetworkSettings.IPAddress)
 
-			err = services.SSHProxy.NewProxyEntryTo(internalPort)
+			// the gateway key is authorized again for users as they log in, so this is not treated as an error.
+			if err := removeAuthorizedKeys(ctx, services.DockerClient, w.ContainerID); err != nil {
+				fmt.Printf("failed to remove ssh keys in workspace %v: %v\n", w.Name, err)
+			}
 		}()
 	}
 
@@ -143,25 +274,42 @@ func SyncAll(ctx context.Context, services service.Services) error {
 		}
 	}
 
+	// ports are bound one at a time, because workspaces without a port are allocated one,
+	// which must not be given to two workspaces.
+	for i := range workspaces {
+		w := &workspaces[i]
+		if slices.ContainsFunc(deletedWorkspaces, func(d workspace) bool { return d.ID == w.ID }) {
+			continue
+		}
+		// the workspace can still be reached through the gateway port if its own port cannot be bound,
+		// and binding is retried when the workspace is started, so this is not treated as an error.
+		if err = bindSSHPort(ctx, tx, services.SSHProxy, services.Config.SSHPortRange, w); err != nil {
+			fmt.Printf("failed to bind ssh port of workspace %v: %v\n", w.Name, err)
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
 
-	if err = initializeHTTPProxies(ctx, services.Database, services.DockerClient, services.ReverseProxy); err != nil {
+	if err = initializeHTTPProxies(ctx, services.Database, services.DockerClient, services.ReverseProxy, services.PortForwarder, services.Config.SubdomainScheme); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func initializeHTTPProxies(ctx context.Context, db *bun.DB, dockerClient *client.Client, proxy *reverseproxy.ReverseProxy) error {
+// initializeHTTPProxies forwards the ports of all port mappings to their workspaces,
+// through the reverse proxy for http ports and from their host ports for tcp and udp ports.
+func initializeHTTPProxies(ctx context.Context, db *bun.DB, dockerClient *client.Client, proxy *reverseproxy.ReverseProxy, forwarder *portforward.Forwarder, scheme service.SubdomainScheme) error {
 	var mappings []portMapping
 	if err := db.NewSelect().
 		Model(&mappings).
 		Relation("Workspace", func(q *bun.SelectQuery) *bun.SelectQuery {
-			return q.Column("container_id")
+			return q.Column("name", "container_id")
 		}).
+		OrderExpr("port_mapping.rowid").
 		Scan(ctx); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil
@@ -173,6 +321,10 @@ func initializeHTTPProxies(ctx context.Context, db *bun.DB, dockerClient *client
 		return nil
 	}
 
+	if err := updateRoutedSubdomains(ctx, db, mappings, scheme); err != nil {
+		return err
+	}
+
 	var wg sync.WaitGroup
 	var errs []error
 	var mu sync.Mutex
@@ -189,17 +341,34 @@ func initializeHTTPProxies(ctx context.Context, db *bun.DB, dockerClient *client
 				mu.Unlock()
 			}()
 
-			inspect, err := dockerClient.ContainerInspect(ctx, m.Workspace.ContainerID)
-			if err != nil {
+			if m.Protocol == portProtocolHTTP {
+				// requests are proxied to the address of the workspace, which is set when the workspace is started.
+				// ports without a routed subdomain were left out by updateRoutedSubdomains, which logged why.
+				if m.RoutedSubdomain == "" {
+					return
+				}
+				err := proxy.AddEntry(m.RoutedSubdomain, m.Workspace.Name, m.ContainerPort, reverseproxy.EntryOptions{
+					Visibility:    m.Visibility,
+					WakeOnRequest: m.WakeOnRequest,
+					ShareSecret:   m.ShareSecret,
+				})
+				if err != nil {
+					fmt.Printf("failed to forward port %d of workspace %v through %v: %v\n", m.ContainerPort, m.Workspace.Name, m.RoutedSubdomain, err)
+				}
 				return
 			}
 
-			u, err := url.Parse(fmt.Sprintf("http://%s:%d", inspect.NetworkSettings.IPAddress, m.ContainerPort))
+			inspect, err := dockerClient.ContainerInspect(ctx, m.Workspace.ContainerID)
 			if err != nil {
 				return
 			}
 
-			proxy.AddEntry(m.Subdomain, u)
+			// the other ports of the workspace are still usable if the port is taken by another program,
+			// so this is not treated as an error.
+			target := forwardTarget(inspect.NetworkSettings.IPAddress, m.ContainerPort)
+			if err := forwarder.Listen(m.Protocol, m.HostPort, target); err != nil {
+				fmt.Printf("failed to forward %v port %d of workspace %v: %v\n", m.Protocol, m.HostPort, m.Workspace.Name, err)
+			}
 		}()
 	}
 
@@ -211,3 +380,73 @@ func initializeHTTPProxies(ctx context.Context, db *bun.DB, dockerClient *client
 
 	return nil
 }
+
+// updateRoutedSubdomains sets the routed subdomains of the given http ports for the given subdomain scheme,
+// in the order of the given ports, and saves them.
+// Subdomains can conflict after switching to the flat subdomain scheme, in which case the later port is left out,
+// so that the other ports are still usable. Ports whose subdomain is no longer valid are left out as well.
+func updateRoutedSubdomains(ctx context.Context, db *bun.DB, mappings []portMapping, scheme service.SubdomainScheme) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// routed subdomains are cleared first, so that swapping them between ports does not violate their unique index.
+	_, err = tx.NewUpdate().
+		Model((*portMapping)(nil)).
+		Set("routed_subdomain = NULL").
+		Where("routed_subdomain IS NOT NULL").
+		Exec(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	routed := make(map[string]bool)
+	for i := range mappings {
+		m := &mappings[i]
+		m.RoutedSubdomain = ""
+		if m.Protocol != portProtocolHTTP {
+			continue
+		}
+
+		if !service.IsValidSubdomain(m.Subdomain) {
+			fmt.Printf("failed to forward port %d of workspace %v: %v\n", m.ContainerPort, m.Workspace.Name, errInvalidSubdomain)
+			continue
+		}
+		subdomain := scheme.RoutedSubdomain(m.Workspace.Name, m.Subdomain)
+		if routed[subdomain] {
+			fmt.Printf("failed to forward port %d of workspace %v through %v: %v\n", m.ContainerPort, m.Workspace.Name, subdomain, reverseproxy.ErrPortMappingConflict)
+			continue
+		}
+		routed[subdomain] = true
+
+		m.RoutedSubdomain = subdomain
+		_, err = tx.NewUpdate().
+			Model(m).
+			Column("routed_subdomain").
+			Where("workspace_id = ?", m.WorkspaceID).
+			Where("protocol = ?", m.Protocol).
+			Where("subdomain = ?", m.Subdomain).
+			Exec(ctx)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// NewWaker returns a function that starts the workspace with the given name,
+// which the reverse proxy calls when a subdomain with wake on request of a stopped workspace is requested.
+func NewWaker(services service.Services) reverseproxy.Waker {
+	mgr := newWorkspaceManager(services)
+	return func(ctx context.Context, workspaceName string) error {
+		w, err := mgr.findWorkspace(ctx, workspaceName)
+		if err != nil {
+			return err
+		}
+		return mgr.startWorkspace(ctx, w)
+	}
+}
@@ -6,16 +6,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
-	"net/url"
-	"strconv"
+	"path"
+	"slices"
+	"strings"
 	"sync"
 	"tesseract/internal/docker"
+	"tesseract/internal/listeningports"
+	"tesseract/internal/portforward"
 	"tesseract/internal/reverseproxy"
+	"tesseract/internal/service"
 	"tesseract/internal/sshproxy"
 	"tesseract/internal/template"
 	"time"
@@ -27,21 +33,57 @@ type workspaceManager struct {
 	dockerClient *client.Client
 	reverseProxy *reverseproxy.ReverseProxy
 	sshProxy     *sshproxy.SSHProxy
+
+	// sshPortRange is the range of ports that the ssh ports of workspaces are allocated from.
+	sshPortRange service.PortRange
+
+	portForwarder *portforward.Forwarder
+
+	// forwardedPortRange is the range of ports that tcp and udp ports of workspaces are forwarded from.
+	forwardedPortRange service.PortRange
+
+	// hostName is the host name that http ports are forwarded through subdomains of.
+	hostName string
+
+	// subdomainScheme is how the subdomains of http ports are laid out under hostName.
+	subdomainScheme service.SubdomainScheme
+
+	// listeningPorts keeps the ports that were last detected in running workspaces.
+	listeningPorts *listeningports.Registry
 }
 
 type createWorkspaceOptions struct {
 	name    string
 	imageID string
 	runtime string
+
+	// volumePath is where a new volume should be mounted in the workspace.
+	// No volume is created if it is empty.
+	volumePath string
 }
 
+// labelWorkspaceName is the docker label that stores the name of the workspace a docker object is created for.
+const labelWorkspaceName = "tesseract.workspace"
+
 var errImageNotFound = errors.New("image not found")
 var errWorkspaceNotFound = errors.New("workspace not found")
 var errRuntimeNotFound = errors.New("runtime not found")
+var errVolumeNotFound = errors.New("volume not found")
+var errVolumeInUse = errors.New("volume is attached to a workspace")
+var errInvalidMountPath = errors.New("mount path must be an absolute path")
+var errInvalidPortProtocol = errors.New("protocol must be http, tcp or udp")
+var errInvalidSubdomain = errors.New("subdomain must only contain letters, digits, _ and -")
+var errWakeOnRequestUnsupported = errors.New("only http ports can wake their workspace on request")
+var errInvalidPortVisibility = errors.New("visibility must be private, token or public")
+var errPortVisibilityUnsupported = errors.New("only http ports can be private or shared through share links")
+var errPortNotShareable = errors.New("share links can only be created for ports with token visibility")
 
 func (mgr workspaceManager) findAllWorkspaces(ctx context.Context) ([]workspace, error) {
 	var workspaces []workspace
-	err := mgr.db.NewSelect().Model(&workspaces).Relation("PortMappings").Scan(ctx)
+	err := mgr.db.NewSelect().Model(&workspaces).
+		Relation("PortMappings").
+		Relation("Volumes").
+		Scan(ctx)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return make([]workspace, 0), nil
@@ -81,12 +123,6 @@ func (mgr workspaceManager) findAllWorkspaces(ctx context.Context) ([]workspace,
 				default:
 					workspaces[i].Status = statusUnknown
 				}
-
-				if internalPort := docker.ContainerSSHHostPort(ctx, inspect); internalPort > 0 {
-					if port := mgr.sshProxy.FindExternalPort(internalPort); port > 0 {
-						workspaces[i].SSHPort = port
-					}
-				}
 			}
 		}()
 	}
@@ -104,6 +140,7 @@ func (mgr workspaceManager) findWorkspace(ctx context.Context, name string) (*wo
 	var w workspace
 	err := mgr.db.NewSelect().Model(&w).
 		Relation("PortMappings").
+		Relation("Volumes").
 		Where("name = ?", name).
 		Scan(ctx)
 	if err != nil {
@@ -149,32 +186,41 @@ func (mgr workspaceManager) createWorkspace(ctx context.Context, opts createWork
 		Where("image_id = ?", opts.imageID).
 		Scan(ctx)
 	if err != nil {
+		_ = tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errImageNotFound
 		}
 		return nil, err
 	}
 
-	containerSSHPort := nat.Port("22/tcp")
-	containerConfig := &container.Config{
-		Tty:   true,
-		Image: img.ImageID,
-		ExposedPorts: nat.PortSet{
-			containerSSHPort: {},
-		},
+	id, err := uuid.NewV7()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
 	}
 
-	hostConfig := &container.HostConfig{
-		PortBindings: nat.PortMap{
-			containerSSHPort: {
-				{"127.0.0.1", ""},
-			},
-		},
-		Runtime: opts.runtime,
+	var volumes []workspaceVolume
+	if opts.volumePath != "" {
+		v, err := mgr.newVolume(ctx, opts.name, opts.volumePath)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		v.WorkspaceID = id
+		volumes = append(volumes, *v)
+	}
+
+	// the volume was only created for this workspace, so it is not kept around empty.
+	removeVolumes := func() {
+		for _, v := range volumes {
+			_ = mgr.dockerClient.VolumeRemove(ctx, v.Name, false)
+		}
 	}
 
-	res, err := mgr.dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, opts.name)
+	res, err := mgr.createContainer(ctx, opts.name, img.ImageID, opts.runtime, volumes)
 	if err != nil {
+		_ = tx.Rollback()
+		removeVolumes()
 		if errdefs.IsConflict(err) {
 			return nil, &errWorkspaceExists{
 				message: docker.CleanErrorMessage(err.Error()),
@@ -183,32 +229,37 @@ func (mgr workspaceManager) createWorkspace(ctx context.Context, opts createWork
 		return nil, err
 	}
 
+	// removeWorkspace removes the container and the volumes of a workspace that could not be created,
+	// so that no container is left behind that tesseract does not know about.
+	removeWorkspace := func() {
+		_ = tx.Rollback()
+		mgr.sshProxy.RemoveEntry(opts.name)
+		mgr.sshProxy.CloseWorkspace(opts.name)
+		_ = mgr.dockerClient.ContainerRemove(ctx, res.ID, container.RemoveOptions{Force: true})
+		removeVolumes()
+	}
+
 	err = mgr.dockerClient.ContainerStart(ctx, res.ID, container.StartOptions{})
 	if err != nil {
+		removeWorkspace()
 		return nil, err
 	}
 
 	inspect, err := mgr.dockerClient.ContainerInspect(ctx, res.ID)
 	if err != nil {
+		removeWorkspace()
 		return nil, err
 	}
 
-	ports := inspect.NetworkSettings.Ports[containerSSHPort]
-	if len(ports) == 0 {
-		return nil, errors.New("failed to bind ssh port for container")
-	}
+	mgr.sshProxy.AddEntry(opts.name, res.ID, docker.ContainerSSHHostPort(ctx, inspect))
 
-	hostPort, err := strconv.Atoi(ports[0].HostPort)
-	if err != nil {
-		return nil, err
-	}
-
-	if err = mgr.sshProxy.NewProxyEntryTo(hostPort); err != nil {
-		return nil, err
+	if err = removeAuthorizedKeys(ctx, mgr.dockerClient, res.ID); err != nil {
+		fmt.Printf("failed to remove ssh keys in workspace %v: %v\n", opts.name, err)
 	}
 
-	id, err := uuid.NewV7()
+	sshPort, err := allocateSSHPort(ctx, tx, mgr.sshProxy, mgr.sshPortRange, opts.name)
 	if err != nil {
+		removeWorkspace()
 		return nil, err
 	}
 
@@ -218,16 +269,26 @@ func (mgr workspaceManager) createWorkspace(ctx context.Context, opts createWork
 		ContainerID: res.ID,
 		ImageTag:    img.ImageTag,
 		CreatedAt:   time.Now().Format(time.RFC3339),
-		SSHPort:     hostPort,
+		SSHPort:     sshPort,
 		Status:      statusRunning,
+		Runtime:     opts.runtime,
+		Volumes:     volumes,
 	}
 	_, err = tx.NewInsert().Model(&w).Exec(ctx)
 	if err != nil {
-		_ = tx.Rollback()
+		removeWorkspace()
 		return nil, err
 	}
 
+	if len(volumes) > 0 {
+		if _, err = tx.NewInsert().Model(&volumes).Exec(ctx); err != nil {
+			removeWorkspace()
+			return nil, err
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
+		removeWorkspace()
 		return nil, err
 	}
 
@@ -288,10 +349,21 @@ func (mgr workspaceManager) deleteWorkspace(ctx context.Context, workspace *work
 		return err
 	}
 
+	mgr.sshProxy.RemoveEntry(workspace.Name)
+	mgr.sshProxy.CloseWorkspace(workspace.Name)
+	mgr.reverseProxy.RemoveWorkspace(workspace.Name)
+	removeForwardedPorts(mgr.portForwarder, workspace.PortMappings)
+	mgr.listeningPorts.Remove(workspace.Name)
+
 	return nil
 }
 
 func (mgr workspaceManager) startWorkspace(ctx context.Context, workspace *workspace) error {
+	// the ssh port is bound first, so that the workspace is not started if its port is taken.
+	if err := bindSSHPort(ctx, mgr.db, mgr.sshProxy, mgr.sshPortRange, workspace); err != nil {
+		return err
+	}
+
 	err := mgr.dockerClient.ContainerStart(ctx, workspace.ContainerID, container.StartOptions{})
 	if err != nil {
 		return err
@@ -302,13 +374,13 @@ func (mgr workspaceManager) startWorkspace(ctx context.Context, workspace *works
 		return err
 	}
 
-	sshPort := docker.ContainerSSHHostPort(ctx, inspect)
-	if sshPort <= 0 {
-		return nil
-	}
+	mgr.sshProxy.AddEntry(workspace.Name, workspace.ContainerID, docker.ContainerSSHHostPort(ctx, inspect))
+	// the container may get a different IP every time it is started.
+	mgr.reverseProxy.SetWorkspaceAddress(workspace.Name, inspect.NetworkSettings.IPAddress)
+	forwardPorts(mgr.portForwarder, workspace, inspect.NetworkSettings.IPAddress)
 
-	if err = mgr.sshProxy.NewProxyEntryTo(sshPort); err != nil {
-		return err
+	if err = removeAuthorizedKeys(ctx, mgr.dockerClient, workspace.ContainerID); err != nil {
+		fmt.Printf("failed to remove ssh keys in workspace %v: %v\n", workspace.Name, err)
 	}
 
 	workspace.Status = statusRunning
@@ -321,65 +393,241 @@ func (mgr workspaceManager) stopWorkspace(ctx context.Context, workspace *worksp
 	if err != nil {
 		return err
 	}
+	mgr.sshProxy.RemoveEntry(workspace.Name)
+	// the port stays allocated to the workspace, and is bound again when the workspace is started.
+	mgr.sshProxy.CloseWorkspace(workspace.Name)
+	mgr.reverseProxy.SetWorkspaceAddress(workspace.Name, "")
+	// forwarded ports stay bound, so that they are not taken by other programs while the workspace is stopped.
+	forwardPorts(mgr.portForwarder, workspace, "")
+	mgr.listeningPorts.Remove(workspace.Name)
 	workspace.Status = statusStopped
 	return nil
 }
 
-func (mgr workspaceManager) addPortMappings(ctx context.Context, workspace *workspace, portMappings []portMapping) error {
-	inspect, err := mgr.dockerClient.ContainerInspect(ctx, workspace.ContainerID)
+// rebaseWorkspace recreates the container of the given workspace from the image with the given ID.
+// The ID, port mappings, runtime and volumes of the workspace are kept.
+func (mgr workspaceManager) rebaseWorkspace(ctx context.Context, workspace *workspace, imageID string) error {
+	var img template.Image
+	err := mgr.db.NewSelect().Model(&img).
+		Where("image_id = ?", imageID).
+		Scan(ctx)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errImageNotFound
+		}
 		return err
 	}
 
-	containerIP := inspect.NetworkSettings.IPAddress
+	running, err := mgr.recreateContainer(ctx, workspace, img.ImageID, workspace.Volumes, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Table("workspaces").
+			Set("image_tag = ?", img.ImageTag).
+			Where("id = ?", workspace.ID).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	urls := make([]*url.URL, len(portMappings))
-	for i, m := range portMappings {
-		u, err := url.Parse(fmt.Sprintf("http://%s:%d", containerIP, m.ContainerPort))
-		if err != nil {
-			return err
+	workspace.ImageTag = img.ImageTag
+
+	if running {
+		return mgr.startWorkspace(ctx, workspace)
+	}
+	return nil
+}
+
+func (mgr workspaceManager) addPortMappings(ctx context.Context, workspace *workspace, portMappings []portMapping) error {
+	var conflictErr errPortMappingConflicts
+
+	for i := range portMappings {
+		m := &portMappings[i]
+		if m.Protocol == "" {
+			m.Protocol = portProtocolHTTP
+		}
+		m.HostPort = 0
+		// http ports are private unless they are made accessible, while tcp and udp ports can only be public.
+		if m.Visibility == "" && m.Protocol == portProtocolHTTP {
+			m.Visibility = reverseproxy.VisibilityPrivate
+		} else if m.Visibility == "" {
+			m.Visibility = reverseproxy.VisibilityPublic
+		}
+		if !m.Visibility.IsValid() {
+			return errInvalidPortVisibility
+		}
+
+		switch m.Protocol {
+		case portProtocolHTTP:
+			if !service.IsValidSubdomain(m.Subdomain) {
+				return errInvalidSubdomain
+			}
+		case portforward.ProtocolTCP, portforward.ProtocolUDP:
+			if m.WakeOnRequest {
+				return errWakeOnRequestUnsupported
+			}
+			if m.Visibility != reverseproxy.VisibilityPublic {
+				return errPortVisibilityUnsupported
+			}
+			// tcp and udp ports are forwarded from a host port instead of a subdomain,
+			// so a container port can only be forwarded once per protocol.
+			m.Subdomain = ""
+			isSamePort := func(other portMapping) bool {
+				return other.Protocol == m.Protocol && other.ContainerPort == m.ContainerPort
+			}
+			if slices.ContainsFunc(workspace.PortMappings, isSamePort) || slices.ContainsFunc(portMappings[:i], isSamePort) {
+				conflictErr.conflicts = append(conflictErr.conflicts, fmt.Sprintf("%d/%s", m.ContainerPort, m.Protocol))
+			}
+		default:
+			return errInvalidPortProtocol
 		}
-		urls[i] = u
 	}
 
+	if len(conflictErr.conflicts) > 0 {
+		return &conflictErr
+	}
+
+	inspect, err := mgr.dockerClient.ContainerInspect(ctx, workspace.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	containerIP := inspect.NetworkSettings.IPAddress
+
 	tx, err := mgr.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	var conflictErr errPortMappingConflicts
+	// the routed subdomains are unique in the database too, which rejects the ports if the reverse proxy missed a conflict.
+	var routed []string
+	removeRoutes := func() {
+		for _, subdomain := range routed {
+			mgr.reverseProxy.RemoveEntry(subdomain)
+		}
+	}
 
 	for i := range portMappings {
-		err = mgr.reverseProxy.AddEntry(portMappings[i].Subdomain, urls[i])
+		portMappings[i].WorkspaceID = workspace.ID
+		portMappings[i].RoutedSubdomain = ""
+		portMappings[i].ShareSecret = uuid.NewString()
+		if portMappings[i].Protocol != portProtocolHTTP {
+			continue
+		}
+		subdomain := mgr.subdomainScheme.RoutedSubdomain(workspace.Name, portMappings[i].Subdomain)
+		err = mgr.reverseProxy.AddEntry(subdomain, workspace.Name, portMappings[i].ContainerPort, reverseproxy.EntryOptions{
+			Visibility:    portMappings[i].Visibility,
+			WakeOnRequest: portMappings[i].WakeOnRequest,
+			ShareSecret:   portMappings[i].ShareSecret,
+		})
 		if err != nil {
 			if errors.Is(err, reverseproxy.ErrPortMappingConflict) {
 				conflictErr.conflicts = append(conflictErr.conflicts, portMappings[i].Subdomain)
 			} else {
+				_ = tx.Rollback()
+				removeRoutes()
 				return err
 			}
-		} else {
-			portMappings[i].WorkspaceID = workspace.ID
+			continue
 		}
+		portMappings[i].RoutedSubdomain = subdomain
+		routed = append(routed, subdomain)
 	}
 
 	if len(conflictErr.conflicts) > 0 {
+		_ = tx.Rollback()
+		removeRoutes()
 		return &conflictErr
 	}
 
+	if err = allocateHostPorts(ctx, tx, mgr.portForwarder, mgr.forwardedPortRange, portMappings, containerIP); err != nil {
+		_ = tx.Rollback()
+		removeRoutes()
+		return err
+	}
+
 	_, err = tx.NewInsert().Model(&portMappings).Exec(ctx)
 	if err != nil {
+		_ = tx.Rollback()
+		removeRoutes()
+		removeForwardedPorts(mgr.portForwarder, portMappings)
 		return err
 	}
 
 	if err = tx.Commit(); err != nil {
+		removeRoutes()
+		removeForwardedPorts(mgr.portForwarder, portMappings)
+		return err
+	}
+
+	workspace.PortMappings = append(workspace.PortMappings, portMappings...)
+
+	return nil
+}
+
+// setPortWakeOnRequest sets whether requests to the given http port of the given workspace start the workspace.
+func (mgr workspaceManager) setPortWakeOnRequest(ctx context.Context, workspace *workspace, portMapping *portMapping, wakeOnRequest bool) error {
+	if portMapping.Protocol != portProtocolHTTP {
+		return errWakeOnRequestUnsupported
+	}
+
+	portMapping.WakeOnRequest = wakeOnRequest
+	_, err := mgr.db.NewUpdate().Model(portMapping).
+		Column("wake_on_request").
+		Where("workspace_id = ?", workspace.ID).
+		Where("protocol = ?", portMapping.Protocol).
+		Where("subdomain = ?", portMapping.Subdomain).
+		Where("container_port = ?", portMapping.ContainerPort).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	mgr.reverseProxy.SetWakeOnRequest(portMapping.RoutedSubdomain, wakeOnRequest)
+
+	return nil
+}
+
+// setPortVisibility sets who can access the given http port of the given workspace.
+func (mgr workspaceManager) setPortVisibility(ctx context.Context, workspace *workspace, portMapping *portMapping, visibility reverseproxy.Visibility) error {
+	if !visibility.IsValid() {
+		return errInvalidPortVisibility
+	}
+	if portMapping.Protocol != portProtocolHTTP && visibility != reverseproxy.VisibilityPublic {
+		return errPortVisibilityUnsupported
+	}
+
+	// share links are revoked whenever the visibility changes, so that they do not work again once the port is shared again.
+	if visibility != portMapping.Visibility {
+		portMapping.ShareSecret = uuid.NewString()
+	}
+	portMapping.Visibility = visibility
+	_, err := mgr.db.NewUpdate().Model(portMapping).
+		Column("visibility", "share_secret").
+		Where("workspace_id = ?", workspace.ID).
+		Where("protocol = ?", portMapping.Protocol).
+		Where("subdomain = ?", portMapping.Subdomain).
+		Where("container_port = ?", portMapping.ContainerPort).
+		Exec(ctx)
+	if err != nil {
 		return err
 	}
 
-	workspace.PortMappings = portMappings
+	if portMapping.Protocol == portProtocolHTTP {
+		mgr.reverseProxy.SetVisibility(portMapping.RoutedSubdomain, visibility, portMapping.ShareSecret)
+	}
 
 	return nil
 }
 
+// createShareToken returns a token that gives access to the given http port of the given workspace until expiresAt.
+// The port must have token visibility.
+func (mgr workspaceManager) createShareToken(workspace *workspace, portMapping *portMapping, expiresAt time.Time) (string, error) {
+	if portMapping.Protocol != portProtocolHTTP || portMapping.Visibility != reverseproxy.VisibilityToken {
+		return "", errPortNotShareable
+	}
+	return mgr.reverseProxy.NewShareToken(workspace.Name, portMapping.RoutedSubdomain, portMapping.ShareSecret, expiresAt), nil
+}
+
 func (mgr workspaceManager) deletePortMapping(ctx context.Context, workspace *workspace, portMapping *portMapping) error {
 	tx, err := mgr.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -388,6 +636,7 @@ func (mgr workspaceManager) deletePortMapping(ctx context.Context, workspace *wo
 
 	_, err = tx.NewDelete().Model(portMapping).
 		Where("workspace_id = ?", workspace.ID).
+		Where("protocol = ?", portMapping.Protocol).
 		Where("subdomain = ?", portMapping.Subdomain).
 		Where("container_port = ?", portMapping.ContainerPort).
 		Exec(ctx)
@@ -401,7 +650,11 @@ func (mgr workspaceManager) deletePortMapping(ctx context.Context, workspace *wo
 		return err
 	}
 
-	mgr.reverseProxy.RemoveEntry(portMapping.Subdomain)
+	if portMapping.Protocol == portProtocolHTTP {
+		mgr.reverseProxy.RemoveEntry(portMapping.RoutedSubdomain)
+	} else {
+		mgr.portForwarder.Remove(portMapping.Protocol, portMapping.HostPort)
+	}
 
 	return nil
 }
@@ -422,3 +675,382 @@ func (mgr workspaceManager) findAvailableWorkspaceRuntimes(ctx context.Context)
 
 	return runtimes, nil
 }
+
+func (mgr workspaceManager) findAllVolumes(ctx context.Context) ([]workspaceVolume, error) {
+	var volumes []workspaceVolume
+	err := mgr.db.NewSelect().Model(&volumes).
+		Relation("Workspace", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Column("name")
+		}).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]workspaceVolume, 0), nil
+		}
+		return nil, err
+	}
+
+	if len(volumes) == 0 {
+		return make([]workspaceVolume, 0), nil
+	}
+
+	for i := range volumes {
+		if volumes[i].Workspace != nil {
+			volumes[i].WorkspaceName = volumes[i].Workspace.Name
+		}
+	}
+
+	return volumes, nil
+}
+
+// createVolume creates a new volume and mounts it in the given workspace at mountPath.
+// The workspace container is recreated in the process.
+func (mgr workspaceManager) createVolume(ctx context.Context, workspace *workspace, mountPath string) (*workspaceVolume, error) {
+	if err := validateMountPath(workspace, mountPath); err != nil {
+		return nil, err
+	}
+
+	v, err := mgr.newVolume(ctx, workspace.Name, mountPath)
+	if err != nil {
+		return nil, err
+	}
+	v.WorkspaceID = workspace.ID
+
+	volumes := append(slices.Clone(workspace.Volumes), *v)
+	running, err := mgr.recreateContainer(ctx, workspace, "", volumes, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(v).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		_ = mgr.dockerClient.VolumeRemove(ctx, v.Name, false)
+		return nil, err
+	}
+
+	workspace.Volumes = volumes
+
+	if running {
+		if err = mgr.startWorkspace(ctx, workspace); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// attachVolume mounts an existing detached volume in the given workspace.
+// If mountPath is empty, the volume is mounted at the path it was last mounted at.
+// The workspace container is recreated in the process.
+func (mgr workspaceManager) attachVolume(ctx context.Context, workspace *workspace, volumeName, mountPath string) (*workspaceVolume, error) {
+	var v workspaceVolume
+	err := mgr.db.NewSelect().Model(&v).
+		Where("name = ?", volumeName).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errVolumeNotFound
+		}
+		return nil, err
+	}
+
+	if v.WorkspaceID != uuid.Nil {
+		return nil, errVolumeInUse
+	}
+
+	if mountPath != "" {
+		v.MountPath = mountPath
+	}
+	if err = validateMountPath(workspace, v.MountPath); err != nil {
+		return nil, err
+	}
+	v.WorkspaceID = workspace.ID
+
+	volumes := append(slices.Clone(workspace.Volumes), v)
+	running, err := mgr.recreateContainer(ctx, workspace, "", volumes, func(ctx context.Context, tx bun.Tx) error {
+		// the volume may have been attached to another workspace while the container was recreated.
+		res, err := tx.NewUpdate().Model(&v).
+			Column("workspace_id", "mount_path").
+			WherePK().
+			Where("workspace_id IS NULL").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil {
+			return err
+		} else if count != 1 {
+			return errVolumeInUse
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	workspace.Volumes = volumes
+
+	if running {
+		if err = mgr.startWorkspace(ctx, workspace); err != nil {
+			return nil, err
+		}
+	}
+
+	return &v, nil
+}
+
+// detachVolume unmounts the given volume from the given workspace.
+// The volume and its content are kept so that it can be attached again later.
+// The workspace container is recreated in the process.
+func (mgr workspaceManager) detachVolume(ctx context.Context, workspace *workspace, volumeName string) error {
+	var volumes []workspaceVolume
+	found := false
+	for _, v := range workspace.Volumes {
+		if v.Name == volumeName {
+			found = true
+		} else {
+			volumes = append(volumes, v)
+		}
+	}
+	if !found {
+		return errVolumeNotFound
+	}
+
+	running, err := mgr.recreateContainer(ctx, workspace, "", volumes, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Table("workspace_volumes").
+			Set("workspace_id = NULL").
+			Where("name = ?", volumeName).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	workspace.Volumes = volumes
+
+	if running {
+		return mgr.startWorkspace(ctx, workspace)
+	}
+	return nil
+}
+
+// deleteVolume permanently removes the given volume and all of its content.
+// Only detached volumes can be deleted.
+func (mgr workspaceManager) deleteVolume(ctx context.Context, volumeName string) error {
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var v workspaceVolume
+	err = tx.NewSelect().Model(&v).
+		Where("name = ?", volumeName).
+		Scan(ctx)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return errVolumeNotFound
+		}
+		return err
+	}
+
+	if v.WorkspaceID != uuid.Nil {
+		_ = tx.Rollback()
+		return errVolumeInUse
+	}
+
+	if _, err = tx.NewDelete().Model(&v).WherePK().Exec(ctx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = mgr.dockerClient.VolumeRemove(ctx, v.Name, false); err != nil && !errdefs.IsNotFound(err) {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// newVolume creates a new docker volume for the workspace with the given name.
+// The returned volume is not yet saved in the database.
+func (mgr workspaceManager) newVolume(ctx context.Context, workspaceName, mountPath string) (*workspaceVolume, error) {
+	if !path.IsAbs(mountPath) {
+		return nil, errInvalidMountPath
+	}
+
+	suffix, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := mgr.dockerClient.VolumeCreate(ctx, volume.CreateOptions{
+		Name: fmt.Sprintf("tesseract-%s-%s", workspaceName, strings.Split(suffix.String(), "-")[0]),
+		Labels: map[string]string{
+			labelWorkspaceName: workspaceName,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &workspaceVolume{
+		Name:      v.Name,
+		MountPath: path.Clean(mountPath),
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// createContainer creates a new, stopped workspace container with the given volumes mounted.
+func (mgr workspaceManager) createContainer(ctx context.Context, name, imageID, runtime string, volumes []workspaceVolume) (container.CreateResponse, error) {
+	containerSSHPort := nat.Port("22/tcp")
+	containerConfig := &container.Config{
+		Tty:   true,
+		Image: imageID,
+		ExposedPorts: nat.PortSet{
+			containerSSHPort: {},
+		},
+	}
+
+	mounts := make([]mount.Mount, len(volumes))
+	for i, v := range volumes {
+		mounts[i] = mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: v.Name,
+			Target: v.MountPath,
+		}
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{
+			containerSSHPort: {
+				{HostIP: "127.0.0.1", HostPort: ""},
+			},
+		},
+		Runtime: runtime,
+		Mounts:  mounts,
+	}
+
+	return mgr.dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, name)
+}
+
+// recreateContainer replaces the container of the given workspace with a new, stopped one that has the given volumes mounted.
+// The new container is created from imageID, or from the image of the current container if imageID is empty.
+// The runtime of the workspace is preserved. Anything that is not stored in a volume is lost.
+//
+// No transaction is held while containers are created and stopped, which can take a while,
+// so that other writes to the database are not blocked. The ID of the new container is saved
+// in a short transaction together with whatever save writes, and the old container is only removed after that.
+// If anything fails before, the new container is removed and the workspace is left as it was.
+//
+// It returns whether the old container was running, in which case the caller starts the workspace again.
+func (mgr workspaceManager) recreateContainer(ctx context.Context, workspace *workspace, imageID string, volumes []workspaceVolume, save func(ctx context.Context, tx bun.Tx) error) (bool, error) {
+	inspect, err := mgr.dockerClient.ContainerInspect(ctx, workspace.ContainerID)
+	if err != nil {
+		return false, err
+	}
+
+	if imageID == "" {
+		imageID = inspect.Image
+	}
+
+	suffix, err := uuid.NewRandom()
+	if err != nil {
+		return false, err
+	}
+
+	// the new container is created under a temporary name first
+	// so that the old container is left untouched if the new container cannot be created.
+	tmpName := fmt.Sprintf("%s-%s", workspace.Name, strings.Split(suffix.String(), "-")[0])
+	res, err := mgr.createContainer(ctx, tmpName, imageID, inspect.HostConfig.Runtime, volumes)
+	if err != nil {
+		return false, err
+	}
+
+	if inspect.State.Running {
+		if err = mgr.dockerClient.ContainerStop(ctx, workspace.ContainerID, container.StopOptions{}); err != nil {
+			_ = mgr.dockerClient.ContainerRemove(ctx, res.ID, container.RemoveOptions{})
+			return false, err
+		}
+	}
+
+	// restoreOldContainer removes the new container and starts the old one again if it was running,
+	// so that the workspace is left as it was if the new container cannot be saved.
+	restoreOldContainer := func() {
+		workspace.ContainerID = inspect.ID
+		_ = mgr.dockerClient.ContainerRemove(ctx, res.ID, container.RemoveOptions{})
+		if inspect.State.Running {
+			_ = mgr.dockerClient.ContainerStart(ctx, inspect.ID, container.StartOptions{})
+		}
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		restoreOldContainer()
+		return false, err
+	}
+
+	workspace.ContainerID = res.ID
+	err = updateContainerID(ctx, tx, workspace)
+	if err == nil && save != nil {
+		err = save(ctx, tx)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		restoreOldContainer()
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		restoreOldContainer()
+		return false, err
+	}
+
+	// the workspace refers to the new container from now on, so a failure to remove the old one only leaves it behind.
+	if err = mgr.dockerClient.ContainerRemove(ctx, inspect.ID, container.RemoveOptions{
+		RemoveVolumes: true,
+	}); err != nil {
+		fmt.Printf("failed to remove the old container of workspace %v: %v\n", workspace.Name, err)
+	}
+
+	// the new container is fully usable under its temporary name, so it is kept if it cannot be renamed.
+	if err = mgr.dockerClient.ContainerRename(ctx, res.ID, workspace.Name); err != nil {
+		fmt.Printf("failed to rename container of workspace %v: %v\n", workspace.Name, err)
+	}
+
+	if inspect.State.Running {
+		// the proxies still refer to the old container until the workspace is started again.
+		mgr.sshProxy.RemoveEntry(workspace.Name)
+		mgr.sshProxy.CloseWorkspace(workspace.Name)
+		mgr.reverseProxy.SetWorkspaceAddress(workspace.Name, "")
+		forwardPorts(mgr.portForwarder, workspace, "")
+		mgr.listeningPorts.Remove(workspace.Name)
+	}
+	workspace.Status = statusStopped
+
+	return inspect.State.Running, nil
+}
+
+func updateContainerID(ctx context.Context, db bun.IDB, workspace *workspace) error {
+	_, err := db.NewUpdate().Model(workspace).
+		Column("container_id").
+		WherePK().
+		Exec(ctx)
+	return err
+}
+
+func validateMountPath(workspace *workspace, mountPath string) error {
+	if !path.IsAbs(mountPath) {
+		return errInvalidMountPath
+	}
+	for _, v := range workspace.Volumes {
+		if v.MountPath == path.Clean(mountPath) {
+			return &errMountPathInUse{mountPath: v.MountPath}
+		}
+	}
+	return nil
+}
@@ -7,14 +7,20 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"tesseract/internal/apierror"
 	"tesseract/internal/migration"
 	"tesseract/internal/service"
 	"tesseract/internal/template"
 	"tesseract/internal/workspace"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/labstack/echo/v4"
@@ -65,8 +71,22 @@ func main() {
 	if err = workspace.SyncAll(syncCtx, services); err != nil {
 		log.Fatalln(err)
 	}
+	if err = template.SyncAll(syncCtx, services); err != nil {
+		log.Fatalln(err)
+	}
 	cancel()
 
+	if err = services.SSHProxy.Start(); err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	services.ReverseProxy.SetWaker(workspace.NewWaker(services))
+	go workspace.WatchContainers(ctx, services)
+	go workspace.WatchListeningPorts(ctx, services)
+
 	apiServer := echo.New()
 	apiServer.Use(services.ReverseProxy.Middleware(), services.Middleware(), middleware.CORS())
 	apiServer.Use(middleware.StaticWithConfig(middleware.StaticConfig{
@@ -78,6 +98,9 @@ func main() {
 	g := apiServer.Group("/api")
 	workspace.DefineRoutes(g, services)
 	template.DefineRoutes(g, services)
+	if services.LocalCA != nil {
+		g.GET("/tls/ca-certificate", services.LocalCA.ServeCertificate)
+	}
 
 	apiServer.HTTPErrorHandler = func(err error, c echo.Context) {
 		var he *echo.HTTPError
@@ -102,5 +125,85 @@ func main() {
 		_ = c.NoContent(http.StatusInternalServerError)
 	}
 
-	apiServer.Logger.Fatal(apiServer.Start(fmt.Sprintf(":%d", config.Port)))
+	// serveErr receives the error of the first server that stops serving.
+	serveErr := make(chan error, 2)
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", config.Port),
+		TLSConfig: services.TLSConfig,
+	}
+	go func() {
+		serveErr <- apiServer.StartServer(server)
+	}()
+
+	servers := []*http.Server{server}
+	if services.TLSConfig != nil && config.TLS.RedirectPort != 0 {
+		redirect := redirectToHTTPS(config.Port)
+		if services.ACMEManager != nil {
+			redirect = services.ACMEManager.HTTPHandler(redirect)
+		}
+		redirectServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.TLS.RedirectPort),
+			Handler: redirect,
+		}
+		servers = append(servers, redirectServer)
+		go func() {
+			serveErr <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-serveErr:
+		log.Println(err)
+	case <-ctx.Done():
+		log.Println("shutting down...")
+	}
+	stop()
+
+	shutdown(services, servers...)
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		os.Exit(1)
+	}
+}
+
+// shutdownTimeout is how long requests in progress are given to finish when tesseract shuts down.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops accepting http, ssh and forwarded connections, and waits for http requests in progress to finish.
+// Open ssh and forwarded connections are closed.
+func shutdown(services service.Services, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down http server at %v: %v\n", server.Addr, err)
+		}
+	}
+	if err := services.SSHProxy.Close(); err != nil {
+		log.Println("error closing ssh proxy:", err)
+	}
+	if err := services.PortForwarder.Close(); err != nil {
+		log.Println("error closing port forwarder:", err)
+	}
+	if err := services.Database.Close(); err != nil {
+		log.Println("error closing database:", err)
+	}
+}
+
+// redirectToHTTPS redirects every request to the same url over https on the given port.
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
 }
@@ -214,17 +214,18 @@ async function buildTemplate({
 	buildArgs: Record<string, string>;
 	onBuildOutput: (chunk: string) => void;
 }) {
-	const res = await fetchApi(`/templates/${templateName}`, {
+	const build: { id: string } = await fetchApi(`/templates/${templateName}`, {
 		method: "POST",
 		body: JSON.stringify({ imageTag, buildArgs }),
+	}).then((res) => res.json());
+
+	// the build runs on the server regardless of this connection,
+	// so the log can be followed again if it is interrupted.
+	const res = await fetchApi(`/builds/${build.id}/log?follow=true`, {
 		headers: {
 			Accept: "text/event-stream",
 		},
 	});
-	if (res.status !== 200) {
-		const errBody = await res.json();
-		throw errBody;
-	}
 	const stream = res.body?.pipeThrough(new TextDecoderStream()).getReader();
 	if (stream) {
 		while (true) {
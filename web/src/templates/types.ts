@@ -12,11 +12,20 @@ interface Template extends TemplateMeta {
 interface TemplateImage {
 	imageTag: string;
 	imageId: string;
+	revisionId?: string;
+	templateName?: string;
+	size?: number;
+	createdAt?: string;
+	layers?: string[];
+	labels?: Record<string, string>;
+	orphaned: boolean;
+	workspaces: string[];
 }
 
 interface FileInTemplate {
 	path: string;
 	content: string;
+	mode: number;
 }
 
 interface BaseTemplate {
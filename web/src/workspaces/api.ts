@@ -3,10 +3,12 @@ import type { QueryStatus } from "@/lib/query";
 import { useCallback, useState } from "react";
 import useSWR, { mutate, useSWRConfig } from "swr";
 import {
+	type PortShareLink,
 	type Workspace,
 	type WorkspacePortMapping,
 	type WorkspaceRuntime,
 	WorkspaceStatus,
+	portMappingName,
 } from "./types";
 
 interface CreateWorkspaceConfig {
@@ -220,7 +222,7 @@ function useDeleteWorkspacePort() {
 										? {
 												...it,
 												ports: it.ports?.filter(
-													(port) => port.subdomain !== portName,
+													(port) => portMappingName(port) !== portName,
 												),
 											}
 										: it,
@@ -240,6 +242,92 @@ function useDeleteWorkspacePort() {
 	return { deleteWorkspacePort, status };
 }
 
+function useUpdateWorkspacePort() {
+	const [status, setStatus] = useState<QueryStatus<ApiError>>({ type: "idle" });
+
+	const updateWorkspacePort = useCallback(
+		async (
+			workspaceName: string,
+			portName: string,
+			update: Partial<
+				Pick<WorkspacePortMapping, "wakeOnRequest" | "visibility">
+			>,
+		) => {
+			setStatus({ type: "loading" });
+			try {
+				await mutate(
+					"/workspaces",
+					fetchApi(`/workspaces/${workspaceName}/forwarded-ports/${portName}`, {
+						method: "PATCH",
+						body: JSON.stringify(update),
+						headers: {
+							"Content-Type": "application/json",
+						},
+					}).then((res): Promise<WorkspacePortMapping> => res.json()),
+					{
+						populateCache: (updatedPort, workspaces) =>
+							workspaces.map(
+								(it: Workspace): Workspace =>
+									it.name === workspaceName
+										? {
+												...it,
+												ports: it.ports?.map((port) =>
+													portMappingName(port) === portName
+														? updatedPort
+														: port,
+												),
+											}
+										: it,
+							),
+						revalidate: false,
+						throwOnError: true,
+					},
+				);
+				setStatus({ type: "ok" });
+			} catch (error: unknown) {
+				setStatus({ type: "error", error: error as ApiError });
+			}
+		},
+		[],
+	);
+
+	return { updateWorkspacePort, status };
+}
+
+function useCreatePortShareLink() {
+	const [status, setStatus] = useState<QueryStatus<ApiError>>({ type: "idle" });
+
+	const createPortShareLink = useCallback(
+		async (
+			workspaceName: string,
+			portName: string,
+		): Promise<PortShareLink | null> => {
+			setStatus({ type: "loading" });
+			try {
+				const res = await fetchApi(
+					`/workspaces/${workspaceName}/forwarded-ports/${portName}/share-links`,
+					{
+						method: "POST",
+						body: JSON.stringify({}),
+						headers: {
+							"Content-Type": "application/json",
+						},
+					},
+				);
+				const link: PortShareLink = await res.json();
+				setStatus({ type: "ok" });
+				return link;
+			} catch (error: unknown) {
+				setStatus({ type: "error", error: error as ApiError });
+				return null;
+			}
+		},
+		[],
+	);
+
+	return { createPortShareLink, status };
+}
+
 function useWorkspaceRuntimes() {
 	return useSWR(
 		"/workspace-runtimes",
@@ -256,4 +344,6 @@ export {
 	useAddWorkspacePort,
 	useWorkspaceRuntimes,
 	useDeleteWorkspacePort,
+	useUpdateWorkspacePort,
+	useCreatePortShareLink,
 };
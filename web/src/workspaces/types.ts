@@ -5,9 +5,41 @@ enum WorkspaceStatus {
 	Unknown = "unknown",
 }
 
+enum PortProtocol {
+	Http = "http",
+	Tcp = "tcp",
+	Udp = "udp",
+}
+
+/**
+ * Who can access an http port: only browsers that opened the dashboard,
+ * also anyone with a share link, or anyone.
+ */
+enum PortVisibility {
+	Private = "private",
+	Token = "token",
+	Public = "public",
+}
+
 interface WorkspacePortMapping {
+	protocol: PortProtocol;
 	subdomain: string;
 	port: number;
+	hostPort?: number;
+	wakeOnRequest?: boolean;
+	visibility?: PortVisibility;
+}
+
+interface PortShareLink {
+	url: string;
+	expiresAt: string;
+}
+
+interface WorkspaceVolume {
+	name: string;
+	mountPath: string;
+	createdAt: string;
+	workspaceName?: string;
 }
 
 interface Workspace {
@@ -18,6 +50,7 @@ interface Workspace {
 	status: WorkspaceStatus;
 	sshPort?: number;
 	ports?: WorkspacePortMapping[];
+	volumes?: WorkspaceVolume[];
 }
 
 interface WorkspaceRuntime {
@@ -25,5 +58,22 @@ interface WorkspaceRuntime {
 	path: string;
 }
 
-export { WorkspaceStatus };
-export type { Workspace, WorkspaceRuntime, WorkspacePortMapping };
+/**
+ * Returns the name that identifies the given port mapping in the API:
+ * the subdomain of an http port, or e.g. "tcp-20000" for a tcp port.
+ */
+function portMappingName(port: WorkspacePortMapping): string {
+	if (port.protocol === PortProtocol.Http) {
+		return port.subdomain;
+	}
+	return `${port.protocol}-${port.hostPort}`;
+}
+
+export { WorkspaceStatus, PortProtocol, PortVisibility, portMappingName };
+export type {
+	PortShareLink,
+	Workspace,
+	WorkspaceRuntime,
+	WorkspacePortMapping,
+	WorkspaceVolume,
+};
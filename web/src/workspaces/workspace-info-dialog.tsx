@@ -6,6 +6,7 @@ import {
 } from "@/components/ui/dialog";
 import { Tabs, TabsContent, TabsList, TabsTrigger } from "@/components/ui/tabs";
 import { useContext } from "react";
+import { WorkspaceStatus } from "./types";
 import { PortInfoTab } from "./workspace-port-info-tab";
 import { WorkspaceTableRowContext } from "./workspace-table";
 
@@ -41,7 +42,7 @@ function TabContainer({ children }: React.PropsWithChildren) {
 function SshTab() {
 	const workspace = useContext(WorkspaceTableRowContext);
 
-	if (!workspace.sshPort) {
+	if (!workspace.sshPort || workspace.status !== WorkspaceStatus.Running) {
 		return (
 			<p>SSH server is not running in this workspace, so SSH is unavailable.</p>
 		);
@@ -2,6 +2,14 @@ import { Button } from "@/components/ui/button";
 import { Form, FormControl, FormField, FormItem } from "@/components/ui/form";
 import { Input } from "@/components/ui/input";
 import { LoadingSpinner } from "@/components/ui/loading-spinner";
+import {
+	Select,
+	SelectContent,
+	SelectItem,
+	SelectTrigger,
+	SelectValue,
+} from "@/components/ui/select";
+import { Switch } from "@/components/ui/switch";
 import {
 	Table,
 	TableBody,
@@ -12,12 +20,31 @@ import {
 } from "@/components/ui/table";
 import { useToast } from "@/hooks/use-toast";
 import { superstructResolver } from "@hookform/resolvers/superstruct";
-import { Check, Trash2, X } from "lucide-react";
+import { Check, Link, Trash2, X } from "lucide-react";
 import { useContext, useEffect, useId } from "react";
 import { useForm } from "react-hook-form";
-import { type Infer, number, object, pattern, size, string } from "superstruct";
+import {
+	type Infer,
+	enums,
+	number,
+	object,
+	refine,
+	size,
+	string,
+} from "superstruct";
 import { create } from "zustand";
-import { useAddWorkspacePort, useDeleteWorkspacePort } from "./api";
+import {
+	useAddWorkspacePort,
+	useCreatePortShareLink,
+	useDeleteWorkspacePort,
+	useUpdateWorkspacePort,
+} from "./api";
+import {
+	PortProtocol,
+	PortVisibility,
+	type WorkspacePortMapping,
+	portMappingName,
+} from "./types";
 import { WorkspaceTableRowContext } from "./workspace-table";
 
 interface PortInfoTabStore {
@@ -36,8 +63,11 @@ function PortInfoTab() {
 			<Table>
 				<TableHeader>
 					<TableRow>
-						<TableHead>Subdomain</TableHead>
+						<TableHead>Protocol</TableHead>
+						<TableHead>Subdomain / host port</TableHead>
 						<TableHead>Port</TableHead>
+						<TableHead>Wake on request</TableHead>
+						<TableHead>Visibility</TableHead>
 					</TableRow>
 				</TableHeader>
 				<PortInfoTableBody />
@@ -53,12 +83,32 @@ function PortInfoTableBody() {
 
 	return (
 		<TableBody>
-			{ports.map(({ port, subdomain }) => (
-				<TableRow key={subdomain}>
-					<TableCell className="py-0">{subdomain}</TableCell>
-					<TableCell className="py-0">{port}</TableCell>
+			{ports.map((portMapping) => (
+				<TableRow key={portMappingName(portMapping)}>
+					<TableCell className="py-0">{portMapping.protocol}</TableCell>
+					<TableCell className="py-0">
+						{portMapping.protocol === PortProtocol.Http
+							? portMapping.subdomain
+							: `:${portMapping.hostPort}`}
+					</TableCell>
+					<TableCell className="py-0">{portMapping.port}</TableCell>
+					<TableCell className="py-0">
+						{portMapping.protocol === PortProtocol.Http ? (
+							<WakeOnRequestSwitch portMapping={portMapping} />
+						) : null}
+					</TableCell>
+					<TableCell className="py-0">
+						{portMapping.protocol === PortProtocol.Http ? (
+							<VisibilitySelect portMapping={portMapping} />
+						) : (
+							PortVisibility.Public
+						)}
+					</TableCell>
 					<TableCell className="p-0 text-right">
-						<DeletePortMappingButton subdomain={subdomain} />
+						{portMapping.visibility === PortVisibility.Token ? (
+							<CopyShareLinkButton name={portMappingName(portMapping)} />
+						) : null}
+						<DeletePortMappingButton name={portMappingName(portMapping)} />
 					</TableCell>
 				</TableRow>
 			))}
@@ -87,10 +137,17 @@ function AddPortButton() {
 	);
 }
 
-const NewPortMappingForm = object({
-	subdomain: pattern(string(), /^[\w-]+$/),
-	port: size(number(), 1, 65536),
-});
+// tcp and udp ports are forwarded from a host port that is allocated by the server, so they have no subdomain.
+const NewPortMappingForm = refine(
+	object({
+		protocol: enums(Object.values(PortProtocol)),
+		subdomain: string(),
+		port: size(number(), 1, 65536),
+	}),
+	"subdomain",
+	({ protocol, subdomain }) =>
+		protocol !== PortProtocol.Http || /^[\w-]+$/.test(subdomain),
+);
 
 function NewPortMappingRow() {
 	const { addWorkspacePort, status } = useAddWorkspacePort();
@@ -103,10 +160,12 @@ function NewPortMappingRow() {
 		resolver: superstructResolver(NewPortMappingForm),
 		disabled: status.type === "loading",
 		defaultValues: {
+			protocol: PortProtocol.Http,
 			subdomain: "",
 			port: 3000,
 		},
 	});
+	const protocol = form.watch("protocol");
 
 	useEffect(() => {
 		switch (status.type) {
@@ -115,8 +174,9 @@ function NewPortMappingRow() {
 					case "CONFLICT":
 						toast({
 							variant: "destructive",
-							title: "Subdomain already in use!",
-							description: "Please use another subdomain for this port.",
+							title: "Port already forwarded!",
+							description:
+								"Please use another subdomain, or remove the existing port first.",
 						});
 						break;
 
@@ -151,7 +211,9 @@ function NewPortMappingRow() {
 	async function submitForm(values: Infer<typeof NewPortMappingForm>) {
 		await addWorkspacePort(workspace.name, [
 			{
-				subdomain: values.subdomain,
+				protocol: values.protocol,
+				subdomain:
+					values.protocol === PortProtocol.Http ? values.subdomain : "",
 				port: values.port,
 			},
 		]);
@@ -164,18 +226,46 @@ function NewPortMappingRow() {
 					<form onSubmit={form.handleSubmit(submitForm)} id={formId}>
 						<FormField
 							control={form.control}
-							name="subdomain"
+							name="protocol"
 							render={({ field }) => (
 								<FormItem>
-									<FormControl>
-										<Input type="text" placeholder="subdomain" {...field} />
-									</FormControl>
+									<Select onValueChange={field.onChange} value={field.value}>
+										<FormControl>
+											<SelectTrigger>
+												<SelectValue />
+											</SelectTrigger>
+										</FormControl>
+										<SelectContent>
+											{Object.values(PortProtocol).map((protocol) => (
+												<SelectItem key={protocol} value={protocol}>
+													{protocol}
+												</SelectItem>
+											))}
+										</SelectContent>
+									</Select>
 								</FormItem>
 							)}
 						/>
 					</form>
 				</Form>
 			</TableCell>
+			<TableCell>
+				<FormField
+					control={form.control}
+					name="subdomain"
+					render={({ field }) => (
+						<Input
+							type="text"
+							placeholder={
+								protocol === PortProtocol.Http ? "subdomain" : "allocated"
+							}
+							form={formId}
+							{...field}
+							disabled={field.disabled || protocol !== PortProtocol.Http}
+						/>
+					)}
+				/>
+			</TableCell>
 			<TableCell>
 				<FormField
 					control={form.control}
@@ -197,6 +287,8 @@ function NewPortMappingRow() {
 					)}
 				/>
 			</TableCell>
+			<TableCell />
+			<TableCell />
 			<TableCell className="px-0">
 				<Button
 					form={formId}
@@ -220,7 +312,113 @@ function NewPortMappingRow() {
 	);
 }
 
-function DeletePortMappingButton({ subdomain }: { subdomain: string }) {
+function WakeOnRequestSwitch({
+	portMapping,
+}: { portMapping: WorkspacePortMapping }) {
+	const { updateWorkspacePort, status } = useUpdateWorkspacePort();
+	const { toast } = useToast();
+	const workspace = useContext(WorkspaceTableRowContext);
+
+	useEffect(() => {
+		if (status.type === "error") {
+			toast({
+				variant: "destructive",
+				title: "Failed to update port.",
+				description: "Unexpected error.",
+			});
+		}
+	}, [status.type, toast]);
+
+	return (
+		<Switch
+			disabled={status.type === "loading"}
+			checked={portMapping.wakeOnRequest ?? false}
+			onCheckedChange={(wakeOnRequest) =>
+				updateWorkspacePort(workspace.name, portMappingName(portMapping), {
+					wakeOnRequest,
+				})
+			}
+		/>
+	);
+}
+
+function VisibilitySelect({
+	portMapping,
+}: { portMapping: WorkspacePortMapping }) {
+	const { updateWorkspacePort, status } = useUpdateWorkspacePort();
+	const { toast } = useToast();
+	const workspace = useContext(WorkspaceTableRowContext);
+
+	useEffect(() => {
+		if (status.type === "error") {
+			toast({
+				variant: "destructive",
+				title: "Failed to update port.",
+				description: "Unexpected error.",
+			});
+		}
+	}, [status.type, toast]);
+
+	return (
+		<Select
+			disabled={status.type === "loading"}
+			value={portMapping.visibility ?? PortVisibility.Public}
+			onValueChange={(visibility) =>
+				updateWorkspacePort(workspace.name, portMappingName(portMapping), {
+					visibility: visibility as PortVisibility,
+				})
+			}
+		>
+			<SelectTrigger className="h-8">
+				<SelectValue />
+			</SelectTrigger>
+			<SelectContent>
+				{Object.values(PortVisibility).map((visibility) => (
+					<SelectItem key={visibility} value={visibility}>
+						{visibility}
+					</SelectItem>
+				))}
+			</SelectContent>
+		</Select>
+	);
+}
+
+function CopyShareLinkButton({ name }: { name: string }) {
+	const { createPortShareLink, status } = useCreatePortShareLink();
+	const { toast } = useToast();
+	const workspace = useContext(WorkspaceTableRowContext);
+
+	async function copyShareLink() {
+		const link = await createPortShareLink(workspace.name, name);
+		if (!link) {
+			toast({
+				variant: "destructive",
+				title: "Failed to create share link.",
+				description: "Unexpected error.",
+			});
+			return;
+		}
+
+		await navigator.clipboard.writeText(link.url);
+		toast({
+			title: "Share link copied!",
+			description: `The link expires at ${new Date(link.expiresAt).toLocaleString()}.`,
+		});
+	}
+
+	return (
+		<Button
+			disabled={status.type === "loading"}
+			variant="ghost"
+			size="icon"
+			onClick={copyShareLink}
+		>
+			{status.type === "loading" ? <LoadingSpinner /> : <Link />}
+		</Button>
+	);
+}
+
+function DeletePortMappingButton({ name }: { name: string }) {
 	const { deleteWorkspacePort, status } = useDeleteWorkspacePort();
 	const { toast } = useToast();
 	const workspace = useContext(WorkspaceTableRowContext);
@@ -237,7 +435,7 @@ function DeletePortMappingButton({ subdomain }: { subdomain: string }) {
 	}, [status.type, toast]);
 
 	async function _deleteWorkspacePort() {
-		await deleteWorkspacePort(workspace.name, subdomain);
+		await deleteWorkspacePort(workspace.name, name);
 	}
 
 	return (